@@ -0,0 +1,198 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+
+	"github.com/google/uuid"
+)
+
+const ndjsonContentType = "application/x-ndjson"
+const importActor = "import"
+
+// longest single receipt line accepted by POST /admin/import
+const maxImportLineSize = 1 << 20
+
+// used to encode each line of the response to POST /admin/import
+type ImportResult struct {
+	Line  int        `json:"line"`
+	Id    *uuid.UUID `json:"id,omitempty"`
+	Error string     `json:"error,omitempty"`
+}
+
+// used to encode the final line of the response to POST /admin/import
+type ImportSummary struct {
+	Imported int `json:"imported"`
+	Failed   int `json:"failed"`
+}
+
+// streams every stored ReceiptScore as one JSON object per line
+func (rs *ReceiptServer) exportReceipts(w http.ResponseWriter, r *http.Request) {
+	scores, err := rs.store.List(r.Context())
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	sort.Slice(scores, func(i, j int) bool {
+		if !scores[i].ProcessedAt.Equal(scores[j].ProcessedAt) {
+			return scores[i].ProcessedAt.Before(scores[j].ProcessedAt)
+		}
+		return bytes.Compare(scores[i].Id[:], scores[j].Id[:]) < 0
+	})
+
+	w.Header().Set("Content-Type", ndjsonContentType)
+	encoder := json.NewEncoder(w)
+	for _, score := range scores {
+		if err := encoder.Encode(score); err != nil {
+			log.Println(err)
+			return
+		}
+	}
+}
+
+// ingests an export line by line, keeping each receipt's original ID and
+// rescoring it if asked or if it belongs to a member, and streams back a
+// result per line
+func (rs *ReceiptServer) importReceipts(w http.ResponseWriter, r *http.Request) {
+	rescore := false
+	if value := r.URL.Query().Get("rescore"); value != "" {
+		var err error
+		rescore, err = strconv.ParseBool(value)
+		if err != nil {
+			http.Error(w, "The rescore parameter must be true or false.", http.StatusBadRequest)
+			return
+		}
+	}
+
+	w.Header().Set("Content-Type", ndjsonContentType)
+	encoder := json.NewEncoder(w)
+	flusher, _ := w.(http.Flusher)
+	scanner := bufio.NewScanner(r.Body)
+	scanner.Buffer(make([]byte, 0, 64*1024), maxImportLineSize)
+
+	var summary ImportSummary
+	line := 0
+	for scanner.Scan() {
+		line++
+		if len(bytes.TrimSpace(scanner.Bytes())) == 0 {
+			continue
+		}
+		result := ImportResult{Line: line}
+		score, err := rs.importReceipt(r.Context(), scanner.Bytes(), rescore)
+		if err != nil {
+			result.Error = err.Error()
+			summary.Failed++
+		} else {
+			result.Id = &score.Id
+			summary.Imported++
+		}
+		if err := encoder.Encode(result); err != nil {
+			log.Println(err)
+			return
+		}
+		if flusher != nil {
+			flusher.Flush()
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		line++
+		encoder.Encode(ImportResult{Line: line, Error: err.Error()})
+		summary.Failed++
+	}
+	encoder.Encode(summary)
+}
+
+func (rs *ReceiptServer) importReceipt(ctx context.Context, line []byte, rescore bool) (ReceiptScore, error) {
+	var score ReceiptScore
+	if err := json.Unmarshal(line, &score); err != nil {
+		return ReceiptScore{}, fmt.Errorf("%w: %v", ErrInvalidReceipt, err)
+	}
+	if score.Id == uuid.Nil {
+		return ReceiptScore{}, fmt.Errorf("%w: missing id", ErrInvalidReceipt)
+	}
+	if err := ValidateReceipt(score.Receipt); err != nil {
+		return ReceiptScore{}, fmt.Errorf("%w: %v", ErrInvalidReceipt, err)
+	}
+	if score.MemberID != "" {
+		if err := ValidateMemberID(score.MemberID); err != nil {
+			return ReceiptScore{}, err
+		}
+	}
+	switch score.Status {
+	case "", ReceiptAccepted, ReceiptPendingReview, ReceiptRejected:
+	default:
+		return ReceiptScore{}, fmt.Errorf("%w: unknown status %q", ErrInvalidReceipt, score.Status)
+	}
+	remaining, err := remainingItems(score, nil)
+	if err != nil {
+		return ReceiptScore{}, fmt.Errorf("%w: %v", ErrInvalidReceipt, err)
+	}
+	// a member's points are only ever credited as scored here, never as the
+	// file claims, and items already returned earn nothing
+	if rescore || score.MemberID != "" {
+		rescored := ReceiptScore{}
+		if len(remaining) > 0 {
+			rescored = rs.processor.Score(score.Id, keptReceipt(score.Receipt, remaining), rs.tenantConfig(ctx).Rules)
+		}
+		rescored.MemberID = score.MemberID
+		rs.applyTier(ctx, &rescored)
+		score.Points = rescored.Points
+		score.RawPoints = rescored.Points
+		score.Tier = rescored.Tier
+	}
+	if score.ProcessedAt.IsZero() {
+		score.ProcessedAt = rs.processor.now()
+	}
+
+	// checked under the commit lock so that concurrent imports of one ID
+	// cannot both find it free
+	rs.commitMu.Lock()
+	defer rs.commitMu.Unlock()
+	_, err = rs.store.Get(ctx, score.Id)
+	if err == nil {
+		return ReceiptScore{}, ErrReceiptExists
+	}
+	if !errors.Is(err, ErrReceiptNotFound) && !errors.Is(err, ErrReceiptExpired) {
+		return ReceiptScore{}, err
+	}
+
+	// caps apply to the points before any were withheld or held, which exports
+	// from before earning caps only have as points
+	score.Points = max(score.RawPoints, score.Points)
+	score.Tenant = TenantFromContext(ctx)
+	rs.applyCaps(ctx, &score)
+	score, err = rs.commitLocked(ctx, score.Id, anyVersion, importEvents(score)...)
+	if err != nil {
+		return ReceiptScore{}, err
+	}
+	rs.duplicates.Register(score)
+	return score, nil
+}
+
+// the events recording an imported receipt: its submission, then each of its
+// refunds without any further change to its points, which were already
+// scored without the items returned
+func importEvents(score ReceiptScore) []ReceiptEvent {
+	events := submissionEvents(score, importActor)
+	for _, refund := range score.Refunds {
+		unchanged, rawPoints := 0, score.RawPoints
+		events = append(events, ReceiptEvent{
+			ReceiptID: score.Id,
+			Type:      EventRefunded,
+			At:        refund.RefundedAt,
+			Actor:     importActor,
+			Points:    &unchanged,
+			RawPoints: &rawPoints,
+			Refund:    &refund,
+		})
+	}
+	return events
+}
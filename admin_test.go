@@ -0,0 +1,198 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/google/uuid"
+)
+
+func TestExportAndImport(t *testing.T) {
+	source := NewReceiptServer(NewReceiptStore(), WithStaff(testAdmin))
+	first := postReceipt(t, source, walgreensReceipt)
+	second := postReceipt(t, source, recasedWalgreensReceipt)
+
+	response := sendAdminRequest(source, http.MethodGet, "/admin/export", "")
+	assertResponseCode(t, response.Code, http.StatusOK)
+	assertContentType(t, response.Header(), ndjsonContentType)
+	export := response.Body.String()
+
+	t.Run("imports an export preserving IDs and points", func(t *testing.T) {
+		store := NewReceiptStore()
+		target := NewReceiptServer(store, WithStaff(testAdmin))
+
+		results, summary := importNDJSON(t, target, "", export)
+
+		assertExpectedPoints(t, summary.Imported, 2)
+		assertExpectedPoints(t, summary.Failed, 0)
+		assertExpectedPoints(t, len(results), 2)
+		for _, id := range []uuid.UUID{first.Id, second.Id} {
+			score, err := store.Get(context.Background(), id)
+			assertNoError(t, err)
+			assertExpectedPoints(t, score.Points, 15)
+		}
+	})
+
+	t.Run("reports failures per line and keeps going", func(t *testing.T) {
+		target := NewReceiptServer(NewReceiptStore(), WithStaff(testAdmin))
+		lines := strings.SplitN(export, "\n", 2)
+		body := lines[0] + "\n{not json\n" + `{"id":"` + uuid.NewString() + `","receipt":{"retailer":""}}` + "\n" + lines[1]
+
+		results, summary := importNDJSON(t, target, "", body)
+
+		assertExpectedPoints(t, summary.Imported, 2)
+		assertExpectedPoints(t, summary.Failed, 2)
+		if results[1].Line != 2 || results[1].Error == "" || results[2].Error == "" {
+			t.Errorf("expected lines 2 and 3 to fail but got %+v", results)
+		}
+	})
+
+	t.Run("refuses to overwrite an existing receipt", func(t *testing.T) {
+		_, summary := importNDJSON(t, source, "", export)
+
+		assertExpectedPoints(t, summary.Failed, 2)
+	})
+
+	t.Run("imports an ID once when it is imported concurrently", func(t *testing.T) {
+		target := NewReceiptServer(NewReceiptStore(), WithStaff(testAdmin))
+		line := strings.SplitN(export, "\n", 2)[0]
+		var wg sync.WaitGroup
+		var mu sync.Mutex
+		imported := 0
+		for range 10 {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				_, summary := importNDJSON(t, target, "", line)
+				mu.Lock()
+				imported += summary.Imported
+				mu.Unlock()
+			}()
+		}
+		wg.Wait()
+
+		assertExpectedPoints(t, imported, 1)
+	})
+
+	t.Run("dates receipts exported without a processing time", func(t *testing.T) {
+		store := NewReceiptStore()
+		target := NewReceiptServer(store, WithStaff(testAdmin))
+		undated := strings.ReplaceAll(strings.SplitN(export, "\n", 2)[0], `"processedAt"`, `"exportedAt"`)
+
+		importNDJSON(t, target, "", undated)
+
+		score, err := store.Get(context.Background(), first.Id)
+		assertNoError(t, err)
+		if score.ProcessedAt.IsZero() {
+			t.Errorf("expected the import to be dated but got %v", score.ProcessedAt)
+		}
+	})
+
+	t.Run("rescores receipts when asked", func(t *testing.T) {
+		store := NewReceiptStore()
+		target := NewReceiptServer(store, WithStaff(testAdmin))
+		tampered := strings.ReplaceAll(export, `"points":15`, `"points":1000`)
+
+		importNDJSON(t, target, "?rescore=true", tampered)
+
+		score, err := store.Get(context.Background(), first.Id)
+		assertNoError(t, err)
+		assertExpectedPoints(t, score.Points, 15)
+	})
+}
+
+func TestImportingRefunds(t *testing.T) {
+	source := NewReceiptServer(NewReceiptStore(), WithStaff(testAdmin))
+	corner := postMemberReceipt(t, source, "alice", cornerMarketReceipt)
+	assertResponseCode(t, sendRefund(source, corner.Id, "M&M Corner Market", gatorade).Code, http.StatusCreated)
+	response := sendAdminRequest(source, http.MethodGet, "/admin/export", "")
+	assertResponseCode(t, response.Code, http.StatusOK)
+
+	target := NewReceiptServer(NewReceiptStore(), WithStaff(testAdmin))
+	_, summary := importNDJSON(t, target, "", response.Body.String())
+
+	assertExpectedPoints(t, summary.Imported, 1)
+	assertReceiptPoints(t, target, corner, 54)
+	if member := getMember(t, target, "alice"); member.Balance != 54 {
+		t.Errorf("expected a balance of 54 but got %d", member.Balance)
+	}
+	response = httptest.NewRecorder()
+	target.ServeHTTP(response, newGetReceiptRequest(corner.Id))
+	if details := decodeDetails(t, response); len(details.Refunds) != 1 {
+		t.Errorf("expected the refund to be imported but got %+v", details.Refunds)
+	}
+}
+
+func TestAdminAuthorization(t *testing.T) {
+	viewer := StaffKey{Key: "viewer-key", Name: "viewer"}
+	server := NewReceiptServer(NewReceiptStore(), WithStaff(testAdmin, viewer))
+	routes := []struct{ method, path string }{
+		{http.MethodGet, "/admin/export"},
+		{http.MethodPost, "/admin/import"},
+		{http.MethodGet, "/admin/reconcile"},
+		{http.MethodPut, "/admin/rewards/mug"},
+	}
+	for _, route := range routes {
+		t.Run(route.method+" "+route.path, func(t *testing.T) {
+			response := sendRequest(server, route.method, route.path, "")
+			assertResponseCode(t, response.Code, http.StatusUnauthorized)
+
+			request := httptest.NewRequest(route.method, route.path, nil)
+			request.Header.Set(staffKeyHeader, "wrong-key")
+			response = httptest.NewRecorder()
+			server.ServeHTTP(response, request)
+			assertResponseCode(t, response.Code, http.StatusUnauthorized)
+
+			request = httptest.NewRequest(route.method, route.path, nil)
+			request.Header.Set(staffKeyHeader, viewer.Key)
+			response = httptest.NewRecorder()
+			server.ServeHTTP(response, request)
+			assertResponseCode(t, response.Code, http.StatusForbidden)
+		})
+	}
+}
+
+var testAdmin = StaffKey{Key: "admin-key", Name: "admin", Roles: []StaffRole{RoleAdmin}}
+
+// sends a request authorized as testAdmin
+func sendAdminRequest(server http.Handler, method, path, body string) *httptest.ResponseRecorder {
+	request := httptest.NewRequest(method, path, strings.NewReader(body))
+	request.Header.Set(staffKeyHeader, testAdmin.Key)
+	response := httptest.NewRecorder()
+	server.ServeHTTP(response, request)
+	return response
+}
+
+func getAdminJSON(t testing.TB, server http.Handler, path string, v any) {
+	t.Helper()
+	response := sendAdminRequest(server, http.MethodGet, path, "")
+	assertResponseCode(t, response.Code, http.StatusOK)
+	err := json.NewDecoder(response.Body).Decode(v)
+	checkDecodeErr(t, response, err)
+}
+
+func importNDJSON(t testing.TB, server http.Handler, query, body string) ([]ImportResult, ImportSummary) {
+	t.Helper()
+	response := sendAdminRequest(server, http.MethodPost, "/admin/import"+query, body)
+	assertResponseCode(t, response.Code, http.StatusOK)
+
+	var results []ImportResult
+	var summary ImportSummary
+	scanner := bufio.NewScanner(response.Body)
+	for scanner.Scan() {
+		if strings.Contains(scanner.Text(), `"imported"`) {
+			assertNoError(t, json.Unmarshal(scanner.Bytes(), &summary))
+			continue
+		}
+		var result ImportResult
+		assertNoError(t, json.Unmarshal(scanner.Bytes(), &result))
+		results = append(results, result)
+	}
+	return results, summary
+}
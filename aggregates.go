@@ -0,0 +1,370 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"maps"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+const defaultLeaderboardLimit = 10
+const maxLeaderboardLimit = 100
+
+var ErrInvalidStatsQuery = errors.New("invalid stats query")
+
+// used to encode receipt and point totals in the /stats responses
+type Totals struct {
+	Receipts      int     `json:"receipts"`
+	Points        int     `json:"points"`
+	AveragePoints float64 `json:"averagePoints"`
+}
+
+type RetailerTotals struct {
+	Retailer string `json:"retailer"`
+	Totals
+}
+
+type DayTotals struct {
+	Date string `json:"date"`
+	Totals
+}
+
+type ItemCountBucket struct {
+	Items    int `json:"items"`
+	Receipts int `json:"receipts"`
+}
+
+type LeaderboardEntry struct {
+	Id           uuid.UUID `json:"id"`
+	Retailer     string    `json:"retailer"`
+	PurchaseDate string    `json:"purchaseDate"`
+	Points       int       `json:"points"`
+}
+
+// purchase dates to aggregate over, either end left empty when open
+type DateRange struct {
+	From string
+	To   string
+}
+
+func (r DateRange) contains(date string) bool {
+	return (r.From == "" || date >= r.From) && (r.To == "" || date <= r.To)
+}
+
+func (t *Totals) add(points, sign int) {
+	t.Receipts += sign
+	t.Points += sign * points
+}
+
+func (t Totals) withAverage() Totals {
+	if t.Receipts > 0 {
+		t.AveragePoints = float64(t.Points) / float64(t.Receipts)
+	}
+	return t
+}
+
+// what one stored receipt adds to the aggregates, kept so it can be taken
+// away again when the receipt changes or goes
+type contribution struct {
+	tenant   string
+	retailer string
+	date     string
+	points   int
+	items    int
+}
+
+type dayAggregate struct {
+	Totals
+	retailers map[string]*Totals
+	items     map[int]int
+}
+
+type tenantAggregates struct {
+	days map[string]*dayAggregate
+	// every receipt by points, highest first, with IDs breaking ties
+	ranking []LeaderboardEntry
+	// the retailer name as first submitted, by normalized name
+	retailerNames map[string]string
+}
+
+// used to keep totals over the stored receipts up to date as they are
+// committed, so that dashboards never have to scan every receipt
+type Aggregates struct {
+	mu            sync.RWMutex
+	contributions map[uuid.UUID]contribution
+	tenants       map[string]*tenantAggregates
+}
+
+func NewAggregates() *Aggregates {
+	return &Aggregates{
+		contributions: make(map[uuid.UUID]contribution),
+		tenants:       make(map[string]*tenantAggregates),
+	}
+}
+
+// replaces whatever the receipt contributed before with its current state
+func (a *Aggregates) Record(ctx context.Context, score ReceiptScore, exists bool) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.forget(score.Id)
+	if !exists {
+		return
+	}
+	c := contribution{
+		tenant:   TenantFromContext(ctx),
+		retailer: NormalizeRetailer(score.Receipt.Retailer),
+		date:     score.Receipt.PurchaseDate,
+		points:   score.Points,
+		items:    len(score.Receipt.Items),
+	}
+	tenant := a.tenant(c.tenant)
+	if _, ok := tenant.retailerNames[c.retailer]; !ok {
+		tenant.retailerNames[c.retailer] = score.Receipt.Retailer
+	}
+	a.apply(score.Id, c, 1)
+	a.contributions[score.Id] = c
+}
+
+// removes a receipt the store dropped on its own, such as on eviction
+func (a *Aggregates) Forget(id uuid.UUID) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.forget(id)
+}
+
+// callers must hold a.mu
+func (a *Aggregates) forget(id uuid.UUID) {
+	c, ok := a.contributions[id]
+	if !ok {
+		return
+	}
+	a.apply(id, c, -1)
+	delete(a.contributions, id)
+}
+
+// callers must hold a.mu
+func (a *Aggregates) tenant(id string) *tenantAggregates {
+	tenant, ok := a.tenants[id]
+	if !ok {
+		tenant = &tenantAggregates{days: make(map[string]*dayAggregate), retailerNames: make(map[string]string)}
+		a.tenants[id] = tenant
+	}
+	return tenant
+}
+
+// adds a contribution with a sign of 1 or takes it away with -1; callers must
+// hold a.mu
+func (a *Aggregates) apply(id uuid.UUID, c contribution, sign int) {
+	tenant := a.tenant(c.tenant)
+	day, ok := tenant.days[c.date]
+	if !ok {
+		day = &dayAggregate{retailers: make(map[string]*Totals), items: make(map[int]int)}
+		tenant.days[c.date] = day
+	}
+	day.add(c.points, sign)
+	retailer, ok := day.retailers[c.retailer]
+	if !ok {
+		retailer = &Totals{}
+		day.retailers[c.retailer] = retailer
+	}
+	retailer.add(c.points, sign)
+	day.items[c.items] += sign
+
+	if retailer.Receipts == 0 {
+		delete(day.retailers, c.retailer)
+	}
+	if day.items[c.items] == 0 {
+		delete(day.items, c.items)
+	}
+	if day.Receipts == 0 {
+		delete(tenant.days, c.date)
+	}
+
+	entry := LeaderboardEntry{Id: id, Retailer: tenant.retailerNames[c.retailer], PurchaseDate: c.date, Points: c.points}
+	i, found := slices.BinarySearchFunc(tenant.ranking, entry, compareLeaderboardEntries)
+	if sign > 0 && !found {
+		tenant.ranking = slices.Insert(tenant.ranking, i, entry)
+	} else if sign < 0 && found {
+		tenant.ranking = slices.Delete(tenant.ranking, i, i+1)
+	}
+}
+
+func compareLeaderboardEntries(a, b LeaderboardEntry) int {
+	if order := cmp.Compare(b.Points, a.Points); order != 0 {
+		return order
+	}
+	return slices.Compare(a.Id[:], b.Id[:])
+}
+
+// calls fn with each day of the tenant's receipts in the range; callers must
+// hold a.mu
+func (a *Aggregates) eachDay(tenant string, dates DateRange, fn func(date string, day *dayAggregate)) {
+	aggregates, ok := a.tenants[tenant]
+	if !ok {
+		return
+	}
+	for date, day := range aggregates.days {
+		if dates.contains(date) {
+			fn(date, day)
+		}
+	}
+}
+
+func (a *Aggregates) Summary(ctx context.Context, dates DateRange) Totals {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	var totals Totals
+	a.eachDay(TenantFromContext(ctx), dates, func(_ string, day *dayAggregate) {
+		totals.Receipts += day.Receipts
+		totals.Points += day.Points
+	})
+	return totals.withAverage()
+}
+
+// returns totals per retailer, most points first
+func (a *Aggregates) ByRetailer(ctx context.Context, dates DateRange) []RetailerTotals {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	tenant := TenantFromContext(ctx)
+	byRetailer := make(map[string]*Totals)
+	a.eachDay(tenant, dates, func(_ string, day *dayAggregate) {
+		for retailer, totals := range day.retailers {
+			if _, ok := byRetailer[retailer]; !ok {
+				byRetailer[retailer] = &Totals{}
+			}
+			byRetailer[retailer].Receipts += totals.Receipts
+			byRetailer[retailer].Points += totals.Points
+		}
+	})
+
+	retailers := []RetailerTotals{}
+	for retailer, totals := range byRetailer {
+		retailers = append(retailers, RetailerTotals{Retailer: a.tenants[tenant].retailerNames[retailer], Totals: totals.withAverage()})
+	}
+	slices.SortFunc(retailers, func(a, b RetailerTotals) int {
+		return cmp.Or(cmp.Compare(b.Points, a.Points), cmp.Compare(a.Retailer, b.Retailer))
+	})
+	return retailers
+}
+
+// returns totals per purchase date, earliest first
+func (a *Aggregates) ByDay(ctx context.Context, dates DateRange) []DayTotals {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	days := []DayTotals{}
+	a.eachDay(TenantFromContext(ctx), dates, func(date string, day *dayAggregate) {
+		days = append(days, DayTotals{Date: date, Totals: day.Totals.withAverage()})
+	})
+	slices.SortFunc(days, func(a, b DayTotals) int { return cmp.Compare(a.Date, b.Date) })
+	return days
+}
+
+// returns how many receipts have each number of items, fewest items first
+func (a *Aggregates) ItemCounts(ctx context.Context, dates DateRange) []ItemCountBucket {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	counts := make(map[int]int)
+	a.eachDay(TenantFromContext(ctx), dates, func(_ string, day *dayAggregate) {
+		for items, receipts := range day.items {
+			counts[items] += receipts
+		}
+	})
+	buckets := []ItemCountBucket{}
+	for _, items := range slices.Sorted(maps.Keys(counts)) {
+		buckets = append(buckets, ItemCountBucket{Items: items, Receipts: counts[items]})
+	}
+	return buckets
+}
+
+// returns up to limit receipts with the most points
+func (a *Aggregates) Leaderboard(ctx context.Context, dates DateRange, limit int) []LeaderboardEntry {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	entries := []LeaderboardEntry{}
+	tenant, ok := a.tenants[TenantFromContext(ctx)]
+	if !ok {
+		return entries
+	}
+	for _, entry := range tenant.ranking {
+		if len(entries) == limit {
+			break
+		}
+		if dates.contains(entry.PurchaseDate) {
+			entries = append(entries, entry)
+		}
+	}
+	return entries
+}
+
+func parseDateRange(query url.Values) (DateRange, error) {
+	var dates DateRange
+	for name, target := range map[string]*string{"purchasedFrom": &dates.From, "purchasedTo": &dates.To} {
+		if value := query.Get(name); value != "" {
+			if _, err := time.Parse(time.DateOnly, value); err != nil {
+				return DateRange{}, fmt.Errorf("%w: %s must be a date like 2022-03-01", ErrInvalidStatsQuery, name)
+			}
+			*target = value
+		}
+	}
+	return dates, nil
+}
+
+// used to serve the /stats routes, each of which takes an optional
+// purchasedFrom and purchasedTo
+func (rs *ReceiptServer) statsHandler(stats func(r *http.Request, dates DateRange) (any, error)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		dates, err := parseDateRange(r.URL.Query())
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		response, err := stats(r, dates)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		w.Header().Set("Content-Type", jsonContentType)
+		if err := json.NewEncoder(w).Encode(response); err != nil {
+			log.Println(err)
+		}
+	}
+}
+
+func (rs *ReceiptServer) summaryStats(r *http.Request, dates DateRange) (any, error) {
+	return rs.aggregates.Summary(r.Context(), dates), nil
+}
+
+func (rs *ReceiptServer) retailerStats(r *http.Request, dates DateRange) (any, error) {
+	return rs.aggregates.ByRetailer(r.Context(), dates), nil
+}
+
+func (rs *ReceiptServer) dailyStats(r *http.Request, dates DateRange) (any, error) {
+	return rs.aggregates.ByDay(r.Context(), dates), nil
+}
+
+func (rs *ReceiptServer) itemCountStats(r *http.Request, dates DateRange) (any, error) {
+	return rs.aggregates.ItemCounts(r.Context(), dates), nil
+}
+
+func (rs *ReceiptServer) leaderboard(r *http.Request, dates DateRange) (any, error) {
+	limit := defaultLeaderboardLimit
+	if value := r.URL.Query().Get("limit"); value != "" {
+		var err error
+		limit, err = strconv.Atoi(value)
+		if err != nil || limit < 1 || limit > maxLeaderboardLimit {
+			return nil, fmt.Errorf("%w: limit must be between 1 and %d", ErrInvalidStatsQuery, maxLeaderboardLimit)
+		}
+	}
+	return rs.aggregates.Leaderboard(r.Context(), dates, limit), nil
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"github.com/google/uuid"
+)
+
+func TestAggregates(t *testing.T) {
+	ctx := context.Background()
+	aggregates := NewAggregates()
+	target := aggregateScore("Target", "2022-03-01", 20, 2)
+	otherTarget := aggregateScore("target ", "2022-03-02", 40, 1)
+	walgreens := aggregateScore("Walgreens", "2022-04-01", 30, 2)
+	for _, score := range []ReceiptScore{target, otherTarget, walgreens} {
+		aggregates.Record(ctx, score, true)
+	}
+
+	t.Run("totals every receipt", func(t *testing.T) {
+		got := aggregates.Summary(ctx, DateRange{})
+		want := Totals{Receipts: 3, Points: 90, AveragePoints: 30}
+		if got != want {
+			t.Errorf("expected %+v but got %+v", want, got)
+		}
+	})
+
+	t.Run("groups retailers by normalized name", func(t *testing.T) {
+		got := aggregates.ByRetailer(ctx, DateRange{})
+		want := []RetailerTotals{
+			{Retailer: "Target", Totals: Totals{Receipts: 2, Points: 60, AveragePoints: 30}},
+			{Retailer: "Walgreens", Totals: Totals{Receipts: 1, Points: 30, AveragePoints: 30}},
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("expected %+v but got %+v", want, got)
+		}
+	})
+
+	t.Run("filters by purchase date", func(t *testing.T) {
+		march := DateRange{From: "2022-03-01", To: "2022-03-31"}
+		days := aggregates.ByDay(ctx, march)
+		if len(days) != 2 || days[0].Date != "2022-03-01" || days[1].Date != "2022-03-02" {
+			t.Errorf("expected the two days in March but got %+v", days)
+		}
+		items := aggregates.ItemCounts(ctx, march)
+		want := []ItemCountBucket{{Items: 1, Receipts: 1}, {Items: 2, Receipts: 1}}
+		if !reflect.DeepEqual(items, want) {
+			t.Errorf("expected %+v but got %+v", want, items)
+		}
+	})
+
+	t.Run("ranks receipts by points", func(t *testing.T) {
+		entries := aggregates.Leaderboard(ctx, DateRange{}, 2)
+		if len(entries) != 2 || entries[0].Id != otherTarget.Id || entries[1].Id != walgreens.Id {
+			t.Errorf("expected the two highest scoring receipts but got %+v", entries)
+		}
+	})
+
+	t.Run("replaces a receipt's previous contribution", func(t *testing.T) {
+		corrected := walgreens
+		corrected.Points = 50
+		aggregates.Record(ctx, corrected, true)
+		aggregates.Record(ctx, target, false)
+
+		got := aggregates.Summary(ctx, DateRange{})
+		want := Totals{Receipts: 2, Points: 90, AveragePoints: 45}
+		if got != want {
+			t.Errorf("expected %+v but got %+v", want, got)
+		}
+		if entries := aggregates.Leaderboard(ctx, DateRange{}, 10); entries[0].Id != walgreens.Id || len(entries) != 2 {
+			t.Errorf("expected the corrected receipt to lead but got %+v", entries)
+		}
+	})
+
+	t.Run("keeps tenants apart", func(t *testing.T) {
+		got := aggregates.Summary(WithTenant(ctx, "globex"), DateRange{})
+		if got != (Totals{}) {
+			t.Errorf("expected no receipts for another tenant but got %+v", got)
+		}
+	})
+}
+
+func TestStatsEndpoints(t *testing.T) {
+	store := NewReceiptStore(WithRetention(RetentionPolicy{MaxReceipts: 1}))
+	server := NewReceiptServer(store)
+	postReceipt(t, server, walgreensReceipt)
+	corner := postReceipt(t, server, cornerMarketReceipt)
+
+	t.Run("drops evicted receipts", func(t *testing.T) {
+		var summary Totals
+		getJSON(t, server, "/stats/summary", &summary)
+		if summary.Receipts != 1 || summary.Points != 109 {
+			t.Errorf("expected only the remaining receipt but got %+v", summary)
+		}
+	})
+
+	t.Run("serves the leaderboard", func(t *testing.T) {
+		var entries []LeaderboardEntry
+		getJSON(t, server, "/stats/leaderboard?limit=5&purchasedFrom=2022-03-01", &entries)
+		if len(entries) != 1 || entries[0].Id != corner.Id {
+			t.Errorf("expected receipt %v but got %+v", corner.Id, entries)
+		}
+	})
+
+	t.Run("rejects an invalid date", func(t *testing.T) {
+		request, _ := http.NewRequest(http.MethodGet, "/stats/days?purchasedTo=March", nil)
+		response := httptest.NewRecorder()
+		server.ServeHTTP(response, request)
+		assertResponseCode(t, response.Code, http.StatusBadRequest)
+	})
+}
+
+func aggregateScore(retailer, date string, points, items int) ReceiptScore {
+	receipt := Receipt{Retailer: retailer, PurchaseDate: date, PurchaseTime: "12:00", Total: "1.00"}
+	for range items {
+		receipt.Items = append(receipt.Items, Item{ShortDescription: "Gum", Price: "1.00"})
+	}
+	return ReceiptScore{Id: uuid.New(), Receipt: receipt, Points: points}
+}
+
+func getJSON(t testing.TB, server http.Handler, path string, v any) {
+	t.Helper()
+	request, _ := http.NewRequest(http.MethodGet, path, nil)
+	response := httptest.NewRecorder()
+	server.ServeHTTP(response, request)
+	assertResponseCode(t, response.Code, http.StatusOK)
+	err := json.NewDecoder(response.Body).Decode(v)
+	checkDecodeErr(t, response, err)
+}
@@ -0,0 +1,299 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"cmp"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"strconv"
+
+	"github.com/google/uuid"
+)
+
+// most receipts accepted in one POST /receipts/batch request
+const maxBatchSize = 10000
+
+const batchTooLargeMessage = "A batch may contain at most 10000 receipts."
+const batchActor = "batch"
+
+// used to encode the response to POST /receipts/batch
+type BatchResponse struct {
+	Results   []BatchResult `json:"results"`
+	Succeeded int           `json:"succeeded"`
+	Failed    int           `json:"failed"`
+}
+
+type BatchResult struct {
+	Index  int         `json:"index"`
+	Id     *uuid.UUID  `json:"id,omitempty"`
+	Points *int        `json:"points,omitempty"`
+	Error  *BatchError `json:"error,omitempty"`
+}
+
+type BatchError struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+	// set for duplicates, to the receipt already holding the fingerprint
+	OriginalID *uuid.UUID `json:"originalId,omitempty"`
+}
+
+var errBatchAborted = errors.New("not stored because another receipt in the batch failed")
+
+var errBatchTooLarge = errors.New("batch is too large")
+
+func newBatchError(err error) *BatchError {
+	var duplicate *DuplicateError
+	switch {
+	case errors.Is(err, ErrInvalidReceipt):
+		return &BatchError{Code: "invalid_receipt", Message: err.Error()}
+	case errors.As(err, &duplicate):
+		return &BatchError{Code: "duplicate", Message: err.Error(), OriginalID: &duplicate.OriginalID}
+	case errors.Is(err, ErrInvalidMemberID):
+		return &BatchError{Code: "invalid_member", Message: invalidMemberIDMessage}
+	case errors.Is(err, ErrQuotaExceeded):
+		return &BatchError{Code: "quota_exceeded", Message: quotaExceededMessage}
+	case errors.Is(err, ErrSubmissionBlocked):
+		return &BatchError{Code: "blocked", Message: err.Error()}
+	case errors.Is(err, ErrOverCapacity):
+		return &BatchError{Code: "over_capacity", Message: err.Error()}
+	case errors.Is(err, errBatchAborted):
+		return &BatchError{Code: "aborted", Message: err.Error()}
+	}
+	return &BatchError{Code: "internal", Message: internalErrorMessage}
+}
+
+// scores and stores each receipt in a JSON array or NDJSON body independently,
+// or with ?atomic=true stores none of them unless all of them succeed
+func (rs *ReceiptServer) processBatch(w http.ResponseWriter, r *http.Request) {
+	atomic, err := strconv.ParseBool(cmp.Or(r.URL.Query().Get("atomic"), "false"))
+	if err != nil {
+		http.Error(w, "The atomic parameter must be true or false.", http.StatusBadRequest)
+		return
+	}
+	entries, err := readBatch(r)
+	if errors.Is(err, errBatchTooLarge) {
+		http.Error(w, batchTooLargeMessage, http.StatusRequestEntityTooLarge)
+		return
+	}
+	if err != nil {
+		http.Error(w, badRequestMessage, http.StatusBadRequest)
+		log.Println(err)
+		return
+	}
+
+	var response BatchResponse
+	if atomic {
+		response = rs.ingestAtomically(r.Context(), entries, actorFromRequest(r))
+	} else {
+		response = rs.ingestEach(r.Context(), entries, actorFromRequest(r))
+	}
+
+	w.Header().Set("Content-Type", jsonContentType)
+	if atomic && response.Failed > 0 {
+		w.WriteHeader(http.StatusUnprocessableEntity)
+	}
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		log.Println(err)
+	}
+}
+
+func (rs *ReceiptServer) ingestEach(ctx context.Context, entries []json.RawMessage, actor string) BatchResponse {
+	response := BatchResponse{Results: make([]BatchResult, len(entries))}
+	for i, entry := range entries {
+		score, err := rs.ingest(ctx, bytes.NewReader(entry), actor, "")
+		response.record(i, score, err)
+	}
+	return response
+}
+
+func (rs *ReceiptServer) ingestAtomically(ctx context.Context, entries []json.RawMessage, actor string) BatchResponse {
+	response := BatchResponse{Results: make([]BatchResult, len(entries))}
+	prepared := make([]ReceiptScore, 0, len(entries))
+	release := func() {
+		for _, score := range prepared {
+			rs.duplicates.Release(score)
+		}
+	}
+
+	failed := false
+	errs := make([]error, len(entries))
+	for i, entry := range entries {
+		score, err := rs.prepare(ctx, bytes.NewReader(entry), "")
+		if err != nil {
+			errs[i] = err
+			failed = true
+			continue
+		}
+		prepared = append(prepared, score)
+	}
+	if failed {
+		release()
+		return response.abort(errs)
+	}
+
+	rs.commitMu.Lock()
+	defer rs.commitMu.Unlock()
+	committed, err := rs.commitBatchLocked(ctx, prepared, actor, errs)
+	if err != nil {
+		release()
+		return response.abort(errs)
+	}
+	for i, score := range committed {
+		rs.duplicates.Confirm(score)
+		response.record(i, score, nil)
+	}
+	return response
+}
+
+// implemented by stores that can save several receipts at once so that
+// readers see all of them or none
+type batchSaver interface {
+	SaveAll(ctx context.Context, scores []ReceiptScore) error
+}
+
+// commits the submission of every receipt or of none: nothing reaches the
+// journal, the store or the read models until every receipt has been checked,
+// and then all of them do together. On failure the error for the receipt at
+// fault is put in errs. Callers must hold rs.commitMu.
+func (rs *ReceiptServer) commitBatchLocked(ctx context.Context, scores []ReceiptScore, actor string, errs []error) ([]ReceiptScore, error) {
+	staged := make([]stagedCommit, len(scores))
+	for i, score := range scores {
+		rs.applyCaps(ctx, &score)
+		var err error
+		staged[i], err = rs.stage(ctx, score.Id, anyVersion, submissionEvents(score, actor)...)
+		if err != nil {
+			errs[i] = err
+			return nil, err
+		}
+	}
+	room, limited, err := rs.quotaRoom(ctx)
+	if err != nil {
+		errs[0] = err
+		return nil, err
+	}
+	if limited && len(staged) > room {
+		errs[room] = ErrQuotaExceeded
+		return nil, ErrQuotaExceeded
+	}
+
+	committed := make([]ReceiptScore, len(staged))
+	var events []ReceiptEvent
+	for i, commit := range staged {
+		committed[i] = commit.current
+		events = append(events, commit.events...)
+	}
+	if err := rs.saveAll(ctx, committed); err != nil {
+		errs[0] = err
+		return nil, err
+	}
+	if err := rs.journal.Append(ctx, events...); err != nil {
+		rs.unsave(context.WithoutCancel(ctx), committed)
+		errs[0] = err
+		return nil, err
+	}
+	for _, commit := range staged {
+		rs.record(ctx, commit)
+	}
+	return committed, nil
+}
+
+// saves the receipts in one step if the store can, or one at a time, taking
+// back those already saved if one fails
+func (rs *ReceiptServer) saveAll(ctx context.Context, scores []ReceiptScore) error {
+	if saver, ok := rs.store.(batchSaver); ok {
+		return saver.SaveAll(ctx, scores)
+	}
+	for i, score := range scores {
+		if err := rs.store.Save(ctx, score); err != nil {
+			rs.unsave(context.WithoutCancel(ctx), scores[:i])
+			return err
+		}
+	}
+	return nil
+}
+
+// deletes newly saved receipts whose events could not be recorded
+func (rs *ReceiptServer) unsave(ctx context.Context, scores []ReceiptScore) {
+	for _, score := range scores {
+		if err := rs.store.Delete(ctx, score.Id); err != nil && !errors.Is(err, ErrReceiptNotFound) {
+			log.Println(err)
+		}
+	}
+}
+
+func (b *BatchResponse) record(index int, score ReceiptScore, err error) {
+	b.Results[index] = BatchResult{Index: index}
+	if err != nil {
+		log.Println(err)
+		b.Results[index].Error = newBatchError(err)
+		b.Failed++
+		return
+	}
+	points := score.Points
+	b.Results[index].Id = &score.Id
+	b.Results[index].Points = &points
+	b.Succeeded++
+}
+
+// marks every entry without an error of its own as aborted
+func (b BatchResponse) abort(errs []error) BatchResponse {
+	for i, err := range errs {
+		if err == nil {
+			err = errBatchAborted
+		}
+		b.record(i, ReceiptScore{}, err)
+	}
+	return b
+}
+
+// splits a JSON array or, for an NDJSON content type, a body of one receipt
+// per line into the raw receipts
+func readBatch(r *http.Request) ([]json.RawMessage, error) {
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	var entries []json.RawMessage
+	if mediaType == ndjsonContentType {
+		scanner := bufio.NewScanner(r.Body)
+		scanner.Buffer(make([]byte, 0, 64*1024), maxImportLineSize)
+		for scanner.Scan() {
+			line := bytes.TrimSpace(scanner.Bytes())
+			if len(line) == 0 {
+				continue
+			}
+			if len(entries) == maxBatchSize {
+				return nil, errBatchTooLarge
+			}
+			entries = append(entries, json.RawMessage(bytes.Clone(line)))
+		}
+		return entries, scanner.Err()
+	}
+
+	decoder := json.NewDecoder(r.Body)
+	token, err := decoder.Token()
+	if err != nil {
+		return nil, err
+	}
+	if token != json.Delim('[') {
+		return nil, fmt.Errorf("expected a JSON array of receipts")
+	}
+	for decoder.More() {
+		if len(entries) == maxBatchSize {
+			return nil, errBatchTooLarge
+		}
+		var entry json.RawMessage
+		if err := decoder.Decode(&entry); err != nil {
+			return nil, err
+		}
+		entries = append(entries, entry)
+	}
+	if _, err := decoder.Token(); err != nil && err != io.EOF {
+		return nil, err
+	}
+	return entries, nil
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestBatchSubmission(t *testing.T) {
+	t.Run("scores each receipt independently", func(t *testing.T) {
+		store := NewReceiptStore()
+		server := NewReceiptServer(store)
+		body := "[" + walgreensReceipt + `, {"retailer": "Target"}, ` + cornerMarketReceipt + ", " + reorderedWalgreensReceipt + "]"
+
+		response := postBatch(t, server, "", jsonContentType, body)
+
+		assertResponseCode(t, response.Code, http.StatusOK)
+		batch := decodeBatch(t, response)
+		if batch.Succeeded != 2 || batch.Failed != 2 {
+			t.Fatalf("expected 2 successes and 2 failures but got %+v", batch)
+		}
+		assertBatchPoints(t, batch.Results[0], 15)
+		assertBatchError(t, batch.Results[1], "invalid_receipt")
+		assertBatchPoints(t, batch.Results[2], 109)
+		assertBatchError(t, batch.Results[3], "duplicate")
+		if *batch.Results[3].Error.OriginalID != *batch.Results[0].Id {
+			t.Errorf("expected duplicate of %v but got %v", *batch.Results[0].Id, *batch.Results[3].Error.OriginalID)
+		}
+		if count, _ := store.Count(context.Background()); count != 2 {
+			t.Errorf("expected 2 stored receipts but got %d", count)
+		}
+	})
+
+	t.Run("accepts NDJSON", func(t *testing.T) {
+		server := NewReceiptServer(NewReceiptStore())
+		body := compactJSON(t, walgreensReceipt) + "\n\n" + compactJSON(t, cornerMarketReceipt) + "\n"
+
+		response := postBatch(t, server, "", ndjsonContentType, body)
+
+		assertResponseCode(t, response.Code, http.StatusOK)
+		batch := decodeBatch(t, response)
+		assertBatchPoints(t, batch.Results[0], 15)
+		assertBatchPoints(t, batch.Results[1], 109)
+	})
+
+	t.Run("stores nothing when an atomic batch has a failure", func(t *testing.T) {
+		store := NewReceiptStore()
+		server := NewReceiptServer(store)
+		body := "[" + walgreensReceipt + `, {"retailer": "Target"}]`
+
+		response := postBatch(t, server, "atomic=true", jsonContentType, body)
+
+		assertResponseCode(t, response.Code, http.StatusUnprocessableEntity)
+		batch := decodeBatch(t, response)
+		assertBatchError(t, batch.Results[0], "aborted")
+		assertBatchError(t, batch.Results[1], "invalid_receipt")
+		if count, _ := store.Count(context.Background()); count != 0 {
+			t.Errorf("expected no stored receipts but got %d", count)
+		}
+
+		// the aborted receipt's fingerprint must not be left claimed
+		postReceipt(t, server, walgreensReceipt)
+	})
+
+	t.Run("records nothing for an atomic batch that exceeds the quota", func(t *testing.T) {
+		tenants, err := NewTenantRegistry(TenantConfig{ID: "globex", MaxReceipts: 1})
+		assertNoError(t, err)
+		store := NewReceiptStore()
+		server := NewReceiptServer(store, WithTenants(tenants))
+		request := newBatchRequest("atomic=true", jsonContentType, "["+walgreensReceipt+", "+cornerMarketReceipt+"]")
+		request.Header.Set(tenantHeader, "globex")
+		response := httptest.NewRecorder()
+
+		server.ServeHTTP(response, request)
+
+		assertResponseCode(t, response.Code, http.StatusUnprocessableEntity)
+		batch := decodeBatch(t, response)
+		assertBatchError(t, batch.Results[0], "aborted")
+		assertBatchError(t, batch.Results[1], "quota_exceeded")
+		if count, _ := store.Count(WithTenant(context.Background(), "globex")); count != 0 {
+			t.Errorf("expected no stored receipts but got %d", count)
+		}
+		if journal := server.journal.(*InMemoryEventJournal); len(journal.events) != 0 {
+			t.Errorf("expected no history but got %d receipts' worth", len(journal.events))
+		}
+	})
+
+	t.Run("refuses an atomic batch that would evict its own receipts", func(t *testing.T) {
+		store := NewReceiptStore(WithRetention(RetentionPolicy{MaxReceipts: 1}))
+		server := NewReceiptServer(store)
+
+		response := postBatch(t, server, "atomic=true", jsonContentType, "["+walgreensReceipt+", "+cornerMarketReceipt+"]")
+
+		assertResponseCode(t, response.Code, http.StatusUnprocessableEntity)
+		batch := decodeBatch(t, response)
+		assertBatchError(t, batch.Results[0], "over_capacity")
+		assertBatchError(t, batch.Results[1], "aborted")
+		if count, _ := store.Count(context.Background()); count != 0 {
+			t.Errorf("expected no stored receipts but got %d", count)
+		}
+		if journal := server.journal.(*InMemoryEventJournal); len(journal.events) != 0 {
+			t.Errorf("expected no history but got %d receipts' worth", len(journal.events))
+		}
+		assertExpectedPoints(t, store.Stats().Evicted, 0)
+	})
+
+	t.Run("rejects a body that is not a list of receipts", func(t *testing.T) {
+		server := NewReceiptServer(NewReceiptStore())
+		response := postBatch(t, server, "", jsonContentType, walgreensReceipt)
+		assertResponseCode(t, response.Code, http.StatusBadRequest)
+	})
+}
+
+func newBatchRequest(query, contentType, body string) *http.Request {
+	request, _ := http.NewRequest(http.MethodPost, "/receipts/batch?"+query, strings.NewReader(body))
+	request.Header.Set("Content-Type", contentType)
+	return request
+}
+
+func postBatch(t testing.TB, server http.Handler, query, contentType, body string) *httptest.ResponseRecorder {
+	t.Helper()
+	response := httptest.NewRecorder()
+	server.ServeHTTP(response, newBatchRequest(query, contentType, body))
+	return response
+}
+
+func decodeBatch(t testing.TB, response *httptest.ResponseRecorder) BatchResponse {
+	t.Helper()
+	var batch BatchResponse
+	err := json.NewDecoder(response.Body).Decode(&batch)
+	checkDecodeErr(t, response, err)
+	return batch
+}
+
+func compactJSON(t testing.TB, body string) string {
+	t.Helper()
+	var receipt Receipt
+	assertNoError(t, json.Unmarshal([]byte(body), &receipt))
+	line, err := json.Marshal(receipt)
+	assertNoError(t, err)
+	return string(line)
+}
+
+func assertBatchPoints(t testing.TB, result BatchResult, want int) {
+	t.Helper()
+	if result.Error != nil || result.Points == nil {
+		t.Fatalf("expected entry %d to succeed but got %+v", result.Index, result.Error)
+	}
+	assertExpectedPoints(t, *result.Points, want)
+}
+
+func assertBatchError(t testing.TB, result BatchResult, code string) {
+	t.Helper()
+	if result.Error == nil || result.Error.Code != code {
+		t.Fatalf("expected entry %d to fail with %q but got %+v", result.Index, code, result.Error)
+	}
+}
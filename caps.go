@@ -0,0 +1,114 @@
+package main
+
+import (
+	"context"
+
+	"github.com/google/uuid"
+)
+
+// the most points a member can earn per calendar day and month (UTC) of when
+// their receipts were scored; zero means no cap
+type EarningCaps struct {
+	Daily   int
+	Monthly int
+}
+
+func WithEarningCaps(caps EarningCaps) MemberOption {
+	return func(m *MemberRegistry) {
+		m.caps = caps
+	}
+}
+
+// used to show in GET /receipts/{id} how a receipt's points were arrived at
+type PointsBreakdown struct {
+	// the points from the scoring rules and the member's tier
+	RawPoints int    `json:"rawPoints"`
+	Tier      string `json:"tier,omitempty"`
+	// what the member's earning caps kept back
+	Withheld int `json:"withheld"`
+	// what is kept back while the receipt is in review, or for good once it
+	// is rejected
+	Held   int `json:"held"`
+	Points int `json:"points"`
+}
+
+func newPointsBreakdown(score ReceiptScore) PointsBreakdown {
+	if score.held() {
+		return PointsBreakdown{RawPoints: score.RawPoints, Tier: score.Tier, Held: score.RawPoints}
+	}
+	return PointsBreakdown{
+		RawPoints: score.RawPoints,
+		Tier:      score.Tier,
+		Withheld:  max(score.RawPoints-score.Points, 0),
+		Points:    score.Points,
+	}
+}
+
+// returns how many more points the receipt may earn its member without going
+// over a cap on the day and month it was first scored, and false if no cap
+// applies; callers must hold the server's commitMu so that no other receipt
+// uses up the same allowance before this one is committed
+func (m *MemberRegistry) Allowance(ctx context.Context, memberID string, receiptID uuid.UUID) (int, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.caps.Daily <= 0 && m.caps.Monthly <= 0 {
+		return 0, false
+	}
+	earnings := m.earnings[memberKey(TenantFromContext(ctx), memberID)]
+	at := m.now().UTC()
+	if own, ok := earnings[receiptID]; ok {
+		at = own.at.UTC()
+	}
+
+	day, month := 0, 0
+	for id, earning := range earnings {
+		if id == receiptID {
+			continue
+		}
+		earnedAt := earning.at.UTC()
+		if earnedAt.Year() != at.Year() || earnedAt.Month() != at.Month() {
+			continue
+		}
+		month += earning.points
+		if earnedAt.Day() == at.Day() {
+			day += earning.points
+		}
+	}
+
+	allowance := -1
+	if m.caps.Daily > 0 {
+		allowance = max(m.caps.Daily-day, 0)
+	}
+	if m.caps.Monthly > 0 {
+		remaining := max(m.caps.Monthly-month, 0)
+		if allowance < 0 || remaining < allowance {
+			allowance = remaining
+		}
+	}
+	return allowance, true
+}
+
+// caps a member's receipt's points, or holds all of them while the receipt is
+// in review, keeping what it would otherwise have earned as its raw points;
+// callers must hold rs.commitMu
+func (rs *ReceiptServer) applyCaps(ctx context.Context, score *ReceiptScore) {
+	score.RawPoints = score.Points
+	if score.held() {
+		score.Points = 0
+		return
+	}
+	if score.MemberID == "" {
+		return
+	}
+	if allowance, capped := rs.members.Allowance(ctx, score.MemberID, score.Id); capped && score.Points > allowance {
+		score.Points = allowance
+	}
+}
+
+// caps a new receipt's points and commits its submission
+func (rs *ReceiptServer) commitSubmission(ctx context.Context, score ReceiptScore, actor string) (ReceiptScore, error) {
+	rs.commitMu.Lock()
+	defer rs.commitMu.Unlock()
+	rs.applyCaps(ctx, &score)
+	return rs.commitLocked(ctx, score.Id, anyVersion, submissionEvents(score, actor)...)
+}
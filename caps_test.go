@@ -0,0 +1,101 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestEarningCaps(t *testing.T) {
+	newServer := func(clock *fakeClock, options ...ServerOption) *ReceiptServer {
+		members := NewMemberRegistry(
+			WithMemberClock(clock.now),
+			WithEarningCaps(EarningCaps{Daily: 100, Monthly: 150}),
+			WithChallenges(nil),
+		)
+		return NewReceiptServer(NewReceiptStore(), append(options, WithMembers(members))...)
+	}
+
+	t.Run("withholds points over the daily and monthly caps", func(t *testing.T) {
+		clock := &fakeClock{current: time.Date(2022, 3, 1, 12, 0, 0, 0, time.UTC)}
+		server := newServer(clock)
+
+		corner := postMemberReceipt(t, server, "alice", cornerMarketReceipt)
+		assertBreakdown(t, server, corner, PointsBreakdown{RawPoints: 109, Tier: "bronze", Withheld: 9, Points: 100})
+		walgreens := postMemberReceipt(t, server, "alice", walgreensReceipt)
+		assertBreakdown(t, server, walgreens, PointsBreakdown{RawPoints: 15, Tier: "bronze", Withheld: 15, Points: 0})
+
+		clock.advance(24 * time.Hour)
+		postMemberReceipt(t, server, "alice", walgreensOn("2022-01-04"))
+		postMemberReceipt(t, server, "alice", walgreensOn("2022-01-06"))
+		later := postMemberReceipt(t, server, "alice", walgreensOn("2022-01-08"))
+		assertBreakdown(t, server, later, PointsBreakdown{RawPoints: 15, Tier: "bronze", Withheld: 0, Points: 15})
+		last := postMemberReceipt(t, server, "alice", walgreensOn("2022-01-10"))
+		assertBreakdown(t, server, last, PointsBreakdown{RawPoints: 15, Tier: "bronze", Withheld: 10, Points: 5})
+
+		if member := getMember(t, server, "alice"); member.Balance != 150 {
+			t.Errorf("expected a balance of 150 but got %d", member.Balance)
+		}
+	})
+
+	t.Run("caps a corrected receipt against the day it was first scored", func(t *testing.T) {
+		clock := &fakeClock{current: time.Date(2022, 3, 1, 12, 0, 0, 0, time.UTC)}
+		server := newServer(clock)
+		corner := postMemberReceipt(t, server, "alice", cornerMarketReceipt)
+		clock.advance(24 * time.Hour)
+		postMemberReceipt(t, server, "alice", walgreensReceipt)
+
+		response := sendCorrection(server, http.MethodPatch, corner.Id, "", `{"retailer": "M&M Corner Market and Deli"}`)
+		assertResponseCode(t, response.Code, http.StatusOK)
+
+		details := decodeDetails(t, response)
+		if details.Breakdown.RawPoints != 116 || details.Points != 100 {
+			t.Errorf("expected 116 raw points capped to 100 but got %+v", details.Breakdown)
+		}
+	})
+
+	t.Run("caps an imported receipt", func(t *testing.T) {
+		source := NewReceiptServer(NewReceiptStore(), WithStaff(testAdmin))
+		corner := postMemberReceipt(t, source, "alice", cornerMarketReceipt)
+		response := sendAdminRequest(source, http.MethodGet, "/admin/export", "")
+		assertResponseCode(t, response.Code, http.StatusOK)
+
+		server := newServer(&fakeClock{current: time.Date(2022, 3, 1, 12, 0, 0, 0, time.UTC)}, WithStaff(testAdmin))
+		importNDJSON(t, server, "", response.Body.String())
+
+		assertBreakdown(t, server, corner, PointsBreakdown{RawPoints: 109, Tier: "bronze", Withheld: 9, Points: 100})
+		if member := getMember(t, server, "alice"); member.Balance != 100 {
+			t.Errorf("expected a balance of 100 but got %d", member.Balance)
+		}
+	})
+
+	t.Run("never exceeds a cap under concurrent submissions", func(t *testing.T) {
+		clock := &fakeClock{current: time.Date(2022, 3, 1, 12, 0, 0, 0, time.UTC)}
+		server := newServer(clock, WithDuplicatePolicy(DuplicatePolicy{Exact: AllowDuplicates, Near: AllowDuplicates}))
+		var wg sync.WaitGroup
+		for range 10 {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				server.ServeHTTP(httptest.NewRecorder(), newMemberReceiptRequest("alice", cornerMarketReceipt))
+			}()
+		}
+		wg.Wait()
+
+		if member := getMember(t, server, "alice"); member.Balance != 100 {
+			t.Errorf("expected a balance of 100 but got %d", member.Balance)
+		}
+	})
+}
+
+func assertBreakdown(t testing.TB, server http.Handler, id ID, want PointsBreakdown) {
+	t.Helper()
+	response := httptest.NewRecorder()
+	server.ServeHTTP(response, newGetReceiptRequest(id.Id))
+	assertResponseCode(t, response.Code, http.StatusOK)
+	if got := decodeDetails(t, response).Breakdown; got != want {
+		t.Errorf("expected breakdown %+v but got %+v", want, got)
+	}
+}
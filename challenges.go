@@ -0,0 +1,259 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"slices"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+const bonusAccount = "points:bonus"
+
+type ChallengeKind string
+
+const (
+	// a number of receipts from the same retailer within a number of days
+	ChallengeSameRetailer ChallengeKind = "sameRetailer"
+	// at least one receipt in each of a number of consecutive weeks
+	ChallengeWeeklyStreak ChallengeKind = "weeklyStreak"
+)
+
+// a goal a member completes across several receipts, each awarding its bonus
+// to a member at most once
+type Challenge struct {
+	Id       string        `json:"id"`
+	Name     string        `json:"name"`
+	Kind     ChallengeKind `json:"kind"`
+	Receipts int           `json:"receipts,omitempty"`
+	Days     int           `json:"days,omitempty"`
+	Weeks    int           `json:"weeks,omitempty"`
+	Bonus    int           `json:"bonus"`
+}
+
+// a set of challenges to start from; registries have none unless given some
+// with WithChallenges
+func DefaultChallenges() []Challenge {
+	return []Challenge{
+		{Id: "regular", Name: "3 receipts from the same retailer within 7 days", Kind: ChallengeSameRetailer, Receipts: 3, Days: 7, Bonus: 100},
+		{Id: "streak", Name: "A receipt every week for 4 weeks", Kind: ChallengeWeeklyStreak, Weeks: 4, Bonus: 100},
+	}
+}
+
+func WithChallenges(challenges []Challenge) MemberOption {
+	return func(m *MemberRegistry) {
+		m.challenges = challenges
+	}
+}
+
+func ValidateChallenges(challenges []Challenge) error {
+	ids := make(map[string]bool)
+	for _, challenge := range challenges {
+		if challenge.Id == "" || ids[challenge.Id] {
+			return fmt.Errorf("challenge IDs must be present and unique, got %q", challenge.Id)
+		}
+		ids[challenge.Id] = true
+		if challenge.Bonus <= 0 {
+			return fmt.Errorf("challenge %q must award a positive bonus", challenge.Id)
+		}
+		switch challenge.Kind {
+		case ChallengeSameRetailer:
+			if challenge.Receipts < 1 || challenge.Days < 1 {
+				return fmt.Errorf("challenge %q needs positive receipts and days", challenge.Id)
+			}
+		case ChallengeWeeklyStreak:
+			if challenge.Weeks < 1 {
+				return fmt.Errorf("challenge %q needs positive weeks", challenge.Id)
+			}
+		default:
+			return fmt.Errorf("challenge %q has unknown kind %q", challenge.Id, challenge.Kind)
+		}
+	}
+	return nil
+}
+
+func LoadChallenges(path string) ([]Challenge, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var challenges []Challenge
+	if err := json.Unmarshal(data, &challenges); err != nil {
+		return nil, fmt.Errorf("parsing %s: %w", path, err)
+	}
+	if err := ValidateChallenges(challenges); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return challenges, nil
+}
+
+// what challenges look at in each of a member's stored receipts
+type visit struct {
+	retailer    string
+	purchasedAt time.Time
+}
+
+// returns how far the member has got: the most receipts from one retailer
+// within the window, or the longest run of consecutive weeks with a receipt
+func (c Challenge) progress(visits map[uuid.UUID]visit) int {
+	switch c.Kind {
+	case ChallengeSameRetailer:
+		byRetailer := make(map[string][]time.Time)
+		for _, visit := range visits {
+			byRetailer[visit.retailer] = append(byRetailer[visit.retailer], visit.purchasedAt)
+		}
+		best := 0
+		window := time.Duration(c.Days) * 24 * time.Hour
+		for _, times := range byRetailer {
+			slices.SortFunc(times, time.Time.Compare)
+			start := 0
+			for end := range times {
+				for times[end].Sub(times[start]) >= window {
+					start++
+				}
+				best = max(best, end-start+1)
+			}
+		}
+		return min(best, c.Receipts)
+	case ChallengeWeeklyStreak:
+		weeks := make(map[time.Time]bool)
+		for _, visit := range visits {
+			weeks[weekOf(visit.purchasedAt)] = true
+		}
+		best := 0
+		for week := range weeks {
+			if weeks[week.AddDate(0, 0, -7)] {
+				continue
+			}
+			run := 0
+			for weeks[week.AddDate(0, 0, 7*run)] {
+				run++
+			}
+			best = max(best, run)
+		}
+		return min(best, c.Weeks)
+	}
+	return 0
+}
+
+func (c Challenge) target() int {
+	if c.Kind == ChallengeWeeklyStreak {
+		return c.Weeks
+	}
+	return c.Receipts
+}
+
+// returns midnight on the Monday starting the week of t
+func weekOf(t time.Time) time.Time {
+	day := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+	return day.AddDate(0, 0, -((int(day.Weekday()) + 6) % 7))
+}
+
+// records a member's receipt for their challenges and awards the bonus of any
+// challenge it completes; callers must hold m.mu, which is what keeps a bonus
+// from being awarded twice when receipts arrive together
+func (m *MemberRegistry) recordVisit(tenant, memberID string, score ReceiptScore) {
+	key := memberKey(tenant, memberID)
+	purchasedAt, err := purchaseTime(score.Receipt)
+	if err != nil {
+		return
+	}
+	if _, ok := m.visits[key]; !ok {
+		m.visits[key] = make(map[uuid.UUID]visit)
+		m.awards[key] = make(map[string]LedgerTransaction)
+	}
+	m.visits[key][score.Id] = visit{retailer: NormalizeRetailer(score.Receipt.Retailer), purchasedAt: purchasedAt}
+
+	for _, challenge := range m.challenges {
+		if _, awarded := m.awards[key][challenge.Id]; awarded {
+			continue
+		}
+		if challenge.progress(m.visits[key]) < challenge.target() {
+			continue
+		}
+		m.awards[key][challenge.Id] = m.ledger.award(tenant, memberID, challenge.Bonus, "completed challenge "+challenge.Id, m.now(), m.expiry.expiresFrom(m.now()))
+	}
+}
+
+// drops a receipt that no longer counts towards the member's challenges, such
+// as one deleted, rejected or returned in full, and takes back the bonus of any
+// challenge the member no longer completes without it; callers must hold m.mu
+func (m *MemberRegistry) forgetVisit(tenant, memberID string, id uuid.UUID) {
+	key := memberKey(tenant, memberID)
+	if _, ok := m.visits[key][id]; !ok {
+		return
+	}
+	delete(m.visits[key], id)
+	for _, challenge := range m.challenges {
+		award, awarded := m.awards[key][challenge.Id]
+		if !awarded || challenge.progress(m.visits[key]) >= challenge.target() {
+			continue
+		}
+		m.reclaim(award.Id, -award.Postings[0].Amount)
+		m.ledger.revoke(tenant, memberID, award, "challenge "+challenge.Id+" no longer completed", m.now())
+		delete(m.awards[key], challenge.Id)
+	}
+}
+
+// credits bonus points from the bonus account as a lot of their own, kept
+// under the award's transaction ID
+func (l *Ledger) award(tenant, memberID string, points int, reason string, at, expiresAt time.Time) LedgerTransaction {
+	transaction := l.post(tenant, LedgerTransaction{Type: TransactionBonus, At: at, MemberID: memberID, Reason: reason, Postings: []Posting{
+		{Account: bonusAccount, Amount: -points},
+		{Account: memberAccount(memberID), Amount: points},
+	}})
+	l.lot(tenant, memberID, transaction.Id, expiresAt).remaining += points
+	return transaction
+}
+
+// takes an awarded bonus back into the bonus account
+func (l *Ledger) revoke(tenant, memberID string, award LedgerTransaction, reason string, at time.Time) {
+	points := -award.Postings[0].Amount
+	l.post(tenant, LedgerTransaction{Type: TransactionReversed, At: at, MemberID: memberID, Reason: reason, Postings: l.takeBack(tenant, memberID, award.Id, bonusAccount, points)})
+}
+
+// used to encode the response to GET /members/{id}/challenges
+type ChallengeProgress struct {
+	Challenge
+	Progress  int        `json:"progress"`
+	Target    int        `json:"target"`
+	Completed bool       `json:"completed"`
+	AwardedAt *time.Time `json:"awardedAt,omitempty"`
+}
+
+func (m *MemberRegistry) Challenges(ctx context.Context, memberID string) ([]ChallengeProgress, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	key := memberKey(TenantFromContext(ctx), memberID)
+	if _, ok := m.members[key]; !ok {
+		return nil, ErrMemberNotFound
+	}
+	progress := []ChallengeProgress{}
+	for _, challenge := range m.challenges {
+		entry := ChallengeProgress{Challenge: challenge, Progress: challenge.progress(m.visits[key]), Target: challenge.target()}
+		if award, ok := m.awards[key][challenge.Id]; ok {
+			entry.Progress = entry.Target
+			entry.Completed = true
+			entry.AwardedAt = &award.At
+		}
+		progress = append(progress, entry)
+	}
+	return progress, nil
+}
+
+func (rs *ReceiptServer) getMemberChallenges(w http.ResponseWriter, r *http.Request) {
+	progress, err := rs.members.Challenges(r.Context(), r.PathValue("id"))
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", jsonContentType)
+	if err := json.NewEncoder(w).Encode(progress); err != nil {
+		log.Println(err)
+	}
+}
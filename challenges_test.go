@@ -0,0 +1,152 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestChallenges(t *testing.T) {
+	t.Run("awards a bonus for repeat visits to a retailer", func(t *testing.T) {
+		server := newChallengeServer()
+		postMemberReceipt(t, server, "alice", walgreensOn("2022-01-02"))
+		postMemberReceipt(t, server, "alice", walgreensOn("2022-01-04"))
+
+		regular := challengeProgress(t, server, "alice", "regular")
+		if regular.Progress != 2 || regular.Completed {
+			t.Errorf("expected 2 of 3 receipts but got %+v", regular)
+		}
+
+		postMemberReceipt(t, server, "alice", walgreensOn("2022-01-06"))
+
+		regular = challengeProgress(t, server, "alice", "regular")
+		if !regular.Completed || regular.AwardedAt == nil {
+			t.Errorf("expected the challenge to be completed but got %+v", regular)
+		}
+		if member := getMember(t, server, "alice"); member.Balance != 3*15+100 {
+			t.Errorf("expected a balance of %d but got %d", 3*15+100, member.Balance)
+		}
+	})
+
+	t.Run("awards a streak bonus for consecutive weeks", func(t *testing.T) {
+		server := newChallengeServer()
+		for _, date := range []string{"2022-01-03", "2022-01-10", "2022-01-17"} {
+			postMemberReceipt(t, server, "alice", walgreensOn(date))
+		}
+		if streak := challengeProgress(t, server, "alice", "streak"); streak.Progress != 3 || streak.Completed {
+			t.Errorf("expected a 3 week streak but got %+v", streak)
+		}
+
+		postMemberReceipt(t, server, "alice", walgreensOn("2022-01-24"))
+
+		if streak := challengeProgress(t, server, "alice", "streak"); !streak.Completed {
+			t.Errorf("expected the streak to be completed but got %+v", streak)
+		}
+		if regular := challengeProgress(t, server, "alice", "regular"); regular.Completed {
+			t.Errorf("expected receipts a week apart not to count as repeat visits but got %+v", regular)
+		}
+	})
+
+	t.Run("awards a bonus exactly once under concurrent submissions", func(t *testing.T) {
+		server := NewReceiptServer(NewReceiptStore(),
+			WithDuplicatePolicy(DuplicatePolicy{Exact: AllowDuplicates, Near: AllowDuplicates}),
+			WithMembers(NewMemberRegistry(WithChallenges(DefaultChallenges()))),
+		)
+		var wg sync.WaitGroup
+		for range 10 {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				server.ServeHTTP(httptest.NewRecorder(), newMemberReceiptRequest("alice", walgreensReceipt))
+			}()
+		}
+		wg.Wait()
+
+		var transactions []LedgerTransaction
+		getJSON(t, server, "/members/alice/ledger", &transactions)
+		bonuses := 0
+		for _, transaction := range transactions {
+			if transaction.Type == TransactionBonus {
+				bonuses++
+			}
+		}
+		if bonuses != 1 {
+			t.Errorf("expected 1 bonus but got %d", bonuses)
+		}
+	})
+
+	t.Run("takes back a bonus when a receipt it needed is deleted", func(t *testing.T) {
+		server := newChallengeServer()
+		first := postMemberReceipt(t, server, "alice", walgreensOn("2022-01-02"))
+		postMemberReceipt(t, server, "alice", walgreensOn("2022-01-04"))
+		postMemberReceipt(t, server, "alice", walgreensOn("2022-01-06"))
+
+		response := sendRequest(server, http.MethodDelete, "/receipts/"+first.Id.String(), "")
+		assertResponseCode(t, response.Code, http.StatusNoContent)
+
+		if regular := challengeProgress(t, server, "alice", "regular"); regular.Completed {
+			t.Errorf("expected the challenge to be incomplete but got %+v", regular)
+		}
+		if member := getMember(t, server, "alice"); member.Balance != 2*15 {
+			t.Errorf("expected a balance of %d but got %d", 2*15, member.Balance)
+		}
+	})
+
+	t.Run("takes back a bonus when a receipt it needed is returned in full", func(t *testing.T) {
+		server := newChallengeServer()
+		first := postMemberReceipt(t, server, "alice", walgreensOn("2022-01-02"))
+		postMemberReceipt(t, server, "alice", walgreensOn("2022-01-04"))
+		postMemberReceipt(t, server, "alice", walgreensOn("2022-01-06"))
+
+		response := sendRefund(server, first.Id, "Walgreens", `{"shortDescription": "Pepsi - 12-oz", "price": "1.25"}`, `{"shortDescription": "Dasani", "price": "1.40"}`)
+		assertResponseCode(t, response.Code, http.StatusCreated)
+
+		if regular := challengeProgress(t, server, "alice", "regular"); regular.Completed {
+			t.Errorf("expected the challenge to be incomplete but got %+v", regular)
+		}
+		if member := getMember(t, server, "alice"); member.Balance != 2*15 {
+			t.Errorf("expected a balance of %d but got %d", 2*15, member.Balance)
+		}
+	})
+
+	t.Run("has no challenges unless configured", func(t *testing.T) {
+		server := NewReceiptServer(NewReceiptStore())
+		postMemberReceipt(t, server, "alice", walgreensReceipt)
+
+		var progress []ChallengeProgress
+		getJSON(t, server, "/members/alice/challenges", &progress)
+		if len(progress) != 0 {
+			t.Errorf("expected no challenges but got %+v", progress)
+		}
+	})
+
+	t.Run("rejects a challenge without a bonus", func(t *testing.T) {
+		err := ValidateChallenges([]Challenge{{Id: "free", Kind: ChallengeWeeklyStreak, Weeks: 2}})
+		if err == nil {
+			t.Errorf("expected an error for a challenge without a bonus")
+		}
+	})
+}
+
+func newChallengeServer() *ReceiptServer {
+	return NewReceiptServer(NewReceiptStore(), WithMembers(NewMemberRegistry(WithChallenges(DefaultChallenges()))))
+}
+
+func walgreensOn(date string) string {
+	return strings.Replace(walgreensReceipt, "2022-01-02", date, 1)
+}
+
+func challengeProgress(t testing.TB, server *ReceiptServer, member, id string) ChallengeProgress {
+	t.Helper()
+	var progress []ChallengeProgress
+	getJSON(t, server, "/members/"+member+"/challenges", &progress)
+	for _, challenge := range progress {
+		if challenge.Id == id {
+			return challenge
+		}
+	}
+	t.Fatalf("no progress for challenge %q in %+v", id, progress)
+	return ChallengeProgress{}
+}
@@ -0,0 +1,264 @@
+package main
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/google/uuid"
+)
+
+// passed to commitIf when any version of the receipt may be changed
+const anyVersion = -1
+
+const versionMismatchMessage = "The receipt has changed since it was fetched."
+const notDeletedMessage = "Only a soft-deleted receipt can be restored."
+
+var ErrVersionMismatch = errors.New("receipt version does not match If-Match")
+var ErrNotDeleted = errors.New("receipt is not soft-deleted")
+
+func etag(score ReceiptScore) string {
+	return strconv.Quote(strconv.Itoa(score.Version))
+}
+
+// returns the version required by an If-Match header, or anyVersion when
+// the header is absent or "*"
+func ifMatchVersion(r *http.Request) (int, error) {
+	value := strings.TrimSpace(r.Header.Get("If-Match"))
+	if value == "" || value == "*" {
+		return anyVersion, nil
+	}
+	unquoted, err := strconv.Unquote(strings.TrimPrefix(value, "W/"))
+	if err != nil {
+		return 0, ErrVersionMismatch
+	}
+	version, err := strconv.Atoi(unquoted)
+	if err != nil {
+		return 0, ErrVersionMismatch
+	}
+	return version, nil
+}
+
+// replaces a receipt with the one in the body
+func (rs *ReceiptServer) replaceReceipt(w http.ResponseWriter, r *http.Request) {
+	rs.correctReceipt(w, r, func(Receipt) (io.Reader, error) {
+		return r.Body, nil
+	})
+}
+
+// applies a JSON Merge Patch (RFC 7386) in the body to a receipt
+func (rs *ReceiptServer) patchReceipt(w http.ResponseWriter, r *http.Request) {
+	rs.correctReceipt(w, r, func(current Receipt) (io.Reader, error) {
+		var patch any
+		if err := json.NewDecoder(r.Body).Decode(&patch); err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrInvalidReceipt, err)
+		}
+		var document any
+		original, _ := json.Marshal(current)
+		json.Unmarshal(original, &document)
+		patched, err := json.Marshal(mergePatch(document, patch))
+		if err != nil {
+			return nil, err
+		}
+		return bytes.NewReader(patched), nil
+	})
+}
+
+// revalidates and rescores a corrected receipt through the same path as a new
+// submission, then records it as rescored provided nobody else changed it first
+func (rs *ReceiptServer) correctReceipt(w http.ResponseWriter, r *http.Request, corrected func(Receipt) (io.Reader, error)) {
+	ctx := r.Context()
+	id, err := uuid.Parse(r.PathValue("id"))
+	if err != nil {
+		http.Error(w, notFoundMessage, http.StatusNotFound)
+		log.Println(err)
+		return
+	}
+	current, err := rs.currentVersion(ctx, r, id)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	body, err := corrected(current.Receipt)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	rescored, err := rs.processor.Process(id, body, rs.tenantConfig(ctx).Rules)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	rescored.Tenant = current.Tenant
+	rescored.MemberID = current.MemberID
+	rescored.Status = current.Status
+	rescored.Review = current.Review
+	// items already returned earn nothing however the receipt is corrected
+	if len(current.Refunds) > 0 {
+		remaining, err := remainingItems(ReceiptScore{Receipt: rescored.Receipt, Refunds: current.Refunds}, nil)
+		if err != nil {
+			writeError(w, fmt.Errorf("%w: %v", ErrInvalidReceipt, err))
+			return
+		}
+		rescored.Points = 0
+		if len(remaining) > 0 {
+			rescored.Points = rs.tenantConfig(ctx).Rules.Points(keptReceipt(rescored.Receipt, remaining))
+		}
+	}
+	rs.reapplyTier(&rescored, current.Tier)
+	// a correction can put an accepted receipt up for review, but only a
+	// reviewer takes one out
+	var held []string
+	if current.Status == ReceiptAccepted {
+		if held = rs.reviews.policy.risks(rescored.Receipt); len(held) > 0 {
+			rescored.Status = ReceiptPendingReview
+			rescored.Review = &Review{Reasons: held}
+		}
+	}
+	if err := rs.duplicates.Claim(ctx, rs.store, &rescored); err != nil {
+		writeError(w, err)
+		return
+	}
+
+	rs.commitMu.Lock()
+	rs.applyCaps(ctx, &rescored)
+	points, rawPoints := rescored.Points, rescored.RawPoints
+	event := ReceiptEvent{
+		ReceiptID:      id,
+		Type:           EventRescored,
+		At:             rescored.ProcessedAt,
+		Actor:          actorFromRequest(r),
+		Receipt:        &rescored.Receipt,
+		Points:         &points,
+		RawPoints:      &rawPoints,
+		Tier:           rescored.Tier,
+		ReviewReasons:  held,
+		Fingerprint:    rescored.Fingerprint,
+		DuplicateOf:    rescored.DuplicateOf,
+		DuplicateMatch: rescored.DuplicateMatch,
+	}
+	if len(held) > 0 {
+		event.Status = ReceiptPendingReview
+	}
+	committed, err := rs.commitLocked(ctx, id, current.Version, event)
+	rs.commitMu.Unlock()
+	if err != nil {
+		rs.duplicates.ReleaseExcept(rescored, current)
+		writeError(w, err)
+		return
+	}
+	rs.duplicates.ReleaseExcept(current, committed)
+	rs.duplicates.Confirm(committed)
+
+	writeReceiptDetails(w, committed)
+}
+
+// deletes a receipt, keeping its history so that a soft delete can be undone
+func (rs *ReceiptServer) deleteReceipt(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	id, err := uuid.Parse(r.PathValue("id"))
+	if err != nil {
+		http.Error(w, notFoundMessage, http.StatusNotFound)
+		log.Println(err)
+		return
+	}
+	soft, err := strconv.ParseBool(cmp.Or(r.URL.Query().Get("soft"), "false"))
+	if err != nil {
+		http.Error(w, "The soft parameter must be true or false.", http.StatusBadRequest)
+		return
+	}
+	current, err := rs.currentVersion(ctx, r, id)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	event := ReceiptEvent{ReceiptID: id, Type: EventDeleted, At: rs.processor.now(), Actor: actorFromRequest(r), Soft: soft}
+	if _, err := rs.commitIf(ctx, id, current.Version, event); err != nil {
+		writeError(w, err)
+		return
+	}
+	rs.duplicates.Release(current)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (rs *ReceiptServer) restoreReceipt(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	id, err := uuid.Parse(r.PathValue("id"))
+	if err != nil {
+		http.Error(w, notFoundMessage, http.StatusNotFound)
+		log.Println(err)
+		return
+	}
+	history, err := rs.journal.History(ctx, id)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	if !softDeleted(history) {
+		writeError(w, ErrNotDeleted)
+		return
+	}
+
+	event := ReceiptEvent{ReceiptID: id, Type: EventRestored, At: rs.processor.now(), Actor: actorFromRequest(r)}
+	restored, err := rs.commitIf(ctx, id, len(history), event)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	rs.duplicates.Register(restored)
+	writeReceiptDetails(w, restored)
+}
+
+// fetches a receipt and checks it against any If-Match header
+func (rs *ReceiptServer) currentVersion(ctx context.Context, r *http.Request, id uuid.UUID) (ReceiptScore, error) {
+	expected, err := ifMatchVersion(r)
+	if err != nil {
+		return ReceiptScore{}, err
+	}
+	current, err := rs.store.Get(ctx, id)
+	if err != nil {
+		return ReceiptScore{}, err
+	}
+	if expected != anyVersion && expected != current.Version {
+		return ReceiptScore{}, ErrVersionMismatch
+	}
+	return current, nil
+}
+
+func writeReceiptDetails(w http.ResponseWriter, score ReceiptScore) {
+	w.Header().Set("Content-Type", jsonContentType)
+	w.Header().Set("ETag", etag(score))
+	if err := json.NewEncoder(w).Encode(newReceiptDetails(score)); err != nil {
+		log.Println(err)
+	}
+}
+
+// applies an RFC 7386 merge patch to a decoded JSON document
+func mergePatch(target, patch any) any {
+	patchObject, ok := patch.(map[string]any)
+	if !ok {
+		return patch
+	}
+	targetObject, ok := target.(map[string]any)
+	if !ok {
+		targetObject = make(map[string]any)
+	}
+	for name, value := range patchObject {
+		if value == nil {
+			delete(targetObject, name)
+		} else {
+			targetObject[name] = mergePatch(targetObject[name], value)
+		}
+	}
+	return targetObject
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+func TestCorrectingReceipts(t *testing.T) {
+	t.Run("PUT replaces and rescores a receipt", func(t *testing.T) {
+		server := NewReceiptServer(NewReceiptStore())
+		id := postReceipt(t, server, walgreensReceipt)
+
+		response := sendCorrection(server, http.MethodPut, id.Id, `"3"`, cornerMarketReceipt)
+
+		assertResponseCode(t, response.Code, http.StatusOK)
+		if response.Header().Get("ETag") != `"4"` {
+			t.Errorf("expected ETag %q but got %q", `"4"`, response.Header().Get("ETag"))
+		}
+		details := decodeDetails(t, response)
+		assertExpectedPoints(t, details.Points, 109)
+		if details.Retailer != "M&M Corner Market" {
+			t.Errorf("expected the receipt to be replaced but got %+v", details)
+		}
+	})
+
+	t.Run("PATCH merges changes into the receipt", func(t *testing.T) {
+		server := NewReceiptServer(NewReceiptStore())
+		id := postReceipt(t, server, walgreensReceipt)
+
+		response := sendCorrection(server, http.MethodPatch, id.Id, "", `{"total": "3.00", "purchaseTime": "14:30"}`)
+
+		assertResponseCode(t, response.Code, http.StatusOK)
+		details := decodeDetails(t, response)
+		assertExpectedPoints(t, details.Points, 100)
+		if len(details.Items) != 2 || details.PurchaseDate != "2022-01-02" {
+			t.Errorf("expected untouched fields to be kept but got %+v", details)
+		}
+	})
+
+	t.Run("rejects a correction that fails validation", func(t *testing.T) {
+		server := NewReceiptServer(NewReceiptStore())
+		id := postReceipt(t, server, walgreensReceipt)
+
+		response := sendCorrection(server, http.MethodPatch, id.Id, "", `{"items": null}`)
+
+		assertResponseCode(t, response.Code, http.StatusBadRequest)
+	})
+
+	t.Run("rejects a stale If-Match", func(t *testing.T) {
+		server := NewReceiptServer(NewReceiptStore())
+		id := postReceipt(t, server, walgreensReceipt)
+
+		response := sendCorrection(server, http.MethodPatch, id.Id, `"2"`, `{"total": "3.00"}`)
+
+		assertResponseCode(t, response.Code, http.StatusPreconditionFailed)
+	})
+
+	t.Run("lets only one of several concurrent editors win", func(t *testing.T) {
+		server := NewReceiptServer(NewReceiptStore())
+		id := postReceipt(t, server, walgreensReceipt)
+		var wg sync.WaitGroup
+		codes := make(chan int, 5)
+		for n := range 5 {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				patch := `{"purchaseTime": "1` + string(rune('0'+n)) + `:00"}`
+				codes <- sendCorrection(server, http.MethodPatch, id.Id, `"3"`, patch).Code
+			}()
+		}
+		wg.Wait()
+		close(codes)
+
+		succeeded := 0
+		for code := range codes {
+			if code == http.StatusOK {
+				succeeded++
+			}
+		}
+		assertExpectedPoints(t, succeeded, 1)
+	})
+
+	t.Run("a corrected receipt can be resubmitted once it expires", func(t *testing.T) {
+		clock := &fakeClock{current: time.Now()}
+		server := NewReceiptServer(NewReceiptStore(WithStoreClock(clock.now), WithRetention(RetentionPolicy{TTL: time.Hour})))
+		id := postReceipt(t, server, walgreensReceipt)
+
+		response := sendCorrection(server, http.MethodPatch, id.Id, "", `{"purchaseTime": "14:30"}`)
+		assertResponseCode(t, response.Code, http.StatusOK)
+
+		clock.advance(2 * time.Hour)
+		response = sendRequest(server, http.MethodPost, "/receipts/process", strings.Replace(walgreensReceipt, "08:13", "14:30", 1))
+
+		assertResponseCode(t, response.Code, http.StatusOK)
+	})
+}
+
+func TestDeletingReceipts(t *testing.T) {
+	t.Run("a soft-deleted receipt can be restored", func(t *testing.T) {
+		server := NewReceiptServer(NewReceiptStore())
+		id := postReceipt(t, server, walgreensReceipt)
+
+		response := sendRequest(server, http.MethodDelete, "/receipts/"+id.Id.String()+"?soft=true", "")
+		assertResponseCode(t, response.Code, http.StatusNoContent)
+		response = sendRequest(server, http.MethodGet, "/receipts/"+id.Id.String()+"/points", "")
+		assertResponseCode(t, response.Code, http.StatusNotFound)
+
+		response = sendRequest(server, http.MethodPost, "/receipts/"+id.Id.String()+"/restore", "")
+		assertResponseCode(t, response.Code, http.StatusOK)
+		response = sendRequest(server, http.MethodGet, "/receipts/"+id.Id.String()+"/points", "")
+		assertPointTotalInResponse(t, response, 15)
+	})
+
+	t.Run("a hard-deleted receipt cannot be restored", func(t *testing.T) {
+		server := NewReceiptServer(NewReceiptStore())
+		id := postReceipt(t, server, walgreensReceipt)
+
+		response := sendRequest(server, http.MethodDelete, "/receipts/"+id.Id.String(), "")
+		assertResponseCode(t, response.Code, http.StatusNoContent)
+
+		response = sendRequest(server, http.MethodPost, "/receipts/"+id.Id.String()+"/restore", "")
+		assertResponseCode(t, response.Code, http.StatusConflict)
+		response = sendRequest(server, http.MethodGet, "/receipts/"+id.Id.String()+"/history", "")
+		assertResponseCode(t, response.Code, http.StatusOK)
+	})
+
+	t.Run("deleting an unknown receipt is not found", func(t *testing.T) {
+		server := NewReceiptServer(NewReceiptStore())
+
+		response := sendRequest(server, http.MethodDelete, "/receipts/"+uuid.NewString(), "")
+
+		assertResponseCode(t, response.Code, http.StatusNotFound)
+	})
+}
+
+func TestMergePatch(t *testing.T) {
+	var target, patch any
+	json.Unmarshal([]byte(`{"a": "b", "c": {"d": "e", "f": "g"}}`), &target)
+	json.Unmarshal([]byte(`{"a": "z", "c": {"f": null}}`), &patch)
+
+	merged, _ := json.Marshal(mergePatch(target, patch))
+
+	assertResponseBody(t, string(merged), `{"a":"z","c":{"d":"e"}}`)
+}
+
+func sendCorrection(server http.Handler, method string, id uuid.UUID, ifMatch, body string) *httptest.ResponseRecorder {
+	request := httptest.NewRequest(method, "/receipts/"+id.String(), strings.NewReader(body))
+	if ifMatch != "" {
+		request.Header.Set("If-Match", ifMatch)
+	}
+	response := httptest.NewRecorder()
+	server.ServeHTTP(response, request)
+	return response
+}
+
+func sendRequest(server http.Handler, method, path, body string) *httptest.ResponseRecorder {
+	response := httptest.NewRecorder()
+	server.ServeHTTP(response, httptest.NewRequest(method, path, strings.NewReader(body)))
+	return response
+}
+
+func decodeDetails(t testing.TB, response *httptest.ResponseRecorder) ReceiptDetails {
+	t.Helper()
+	var details ReceiptDetails
+	err := json.NewDecoder(response.Body).Decode(&details)
+	checkDecodeErr(t, response, err)
+	return details
+}
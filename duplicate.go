@@ -0,0 +1,242 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/google/uuid"
+)
+
+type DuplicateAction int
+
+const (
+	AllowDuplicates DuplicateAction = iota
+	FlagDuplicates
+	RejectDuplicates
+)
+
+const (
+	exactDuplicate = "exact"
+	nearDuplicate  = "near"
+)
+
+// Exact applies to receipts with the same canonical fingerprint, Near to
+// receipts from the same retailer, date and total whose items only differ in
+// order or case
+type DuplicatePolicy struct {
+	Exact DuplicateAction
+	Near  DuplicateAction
+}
+
+func DefaultDuplicatePolicy() DuplicatePolicy {
+	return DuplicatePolicy{Exact: RejectDuplicates, Near: FlagDuplicates}
+}
+
+func ParseDuplicateAction(s string) (DuplicateAction, error) {
+	switch s {
+	case "allow":
+		return AllowDuplicates, nil
+	case "flag":
+		return FlagDuplicates, nil
+	case "reject":
+		return RejectDuplicates, nil
+	}
+	return 0, fmt.Errorf("unknown duplicate action %q", s)
+}
+
+type DuplicateError struct {
+	OriginalID uuid.UUID
+	Match      string
+}
+
+func (e *DuplicateError) Error() string {
+	return fmt.Sprintf("%s duplicate of receipt %v", e.Match, e.OriginalID)
+}
+
+type Fingerprints struct {
+	Exact string
+	Near  string
+}
+
+func FingerprintReceipt(receipt Receipt) Fingerprints {
+	exactItems := make([]string, 0, len(receipt.Items))
+	nearItems := make([]string, 0, len(receipt.Items))
+	for _, item := range receipt.Items {
+		description := strings.Join(strings.Fields(item.ShortDescription), " ")
+		exactItems = append(exactItems, description+"|"+item.Price)
+		nearItems = append(nearItems, strings.ToLower(description)+"|"+item.Price)
+	}
+	sort.Strings(exactItems)
+	sort.Strings(nearItems)
+
+	retailer := NormalizeRetailer(receipt.Retailer)
+	exact := []string{retailer, receipt.PurchaseDate, receipt.PurchaseTime, receipt.Total}
+	near := []string{retailer, receipt.PurchaseDate, receipt.Total}
+	return Fingerprints{
+		Exact: hashFields(append(exact, exactItems...)),
+		Near:  hashFields(append(near, nearItems...)),
+	}
+}
+
+func hashFields(fields []string) string {
+	sum := sha256.Sum256([]byte(strings.Join(fields, "\n")))
+	return hex.EncodeToString(sum[:])
+}
+
+type fingerprintClaim struct {
+	id uuid.UUID
+	// unconfirmed claims belong to receipts that are still being saved
+	confirmed bool
+}
+
+// used to remember which receipt first claimed each fingerprint so that later
+// submissions of the same receipt can be rejected or flagged
+type DuplicateDetector struct {
+	policy DuplicatePolicy
+	mu     sync.Mutex
+	exact  map[string]fingerprintClaim
+	near   map[string]fingerprintClaim
+}
+
+func NewDuplicateDetector(policy DuplicatePolicy) *DuplicateDetector {
+	return &DuplicateDetector{
+		policy: policy,
+		exact:  make(map[string]fingerprintClaim),
+		near:   make(map[string]fingerprintClaim),
+	}
+}
+
+// checks score against earlier receipts, returning a *DuplicateError if the
+// policy rejects it and otherwise flagging it and claiming its fingerprints.
+// Callers must Confirm the claim once the receipt is saved or Release it.
+func (d *DuplicateDetector) Claim(ctx context.Context, store ReceiptStore, score *ReceiptScore) error {
+	fingerprints := FingerprintReceipt(score.Receipt)
+	score.Fingerprint = fingerprints.Exact
+	exactKey := claimKey(score.Tenant, fingerprints.Exact)
+	nearKey := claimKey(score.Tenant, fingerprints.Near)
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	matches := []struct {
+		kind   string
+		claims map[string]fingerprintClaim
+		key    string
+		action DuplicateAction
+	}{
+		{exactDuplicate, d.exact, exactKey, d.policy.Exact},
+		{nearDuplicate, d.near, nearKey, d.policy.Near},
+	}
+	for _, match := range matches {
+		original, ok, err := d.live(ctx, store, match.claims, match.key)
+		if err != nil {
+			return err
+		}
+		if !ok || original == score.Id {
+			continue
+		}
+		switch match.action {
+		case RejectDuplicates:
+			return &DuplicateError{OriginalID: original, Match: match.kind}
+		case FlagDuplicates:
+			score.DuplicateOf = &original
+			score.DuplicateMatch = match.kind
+		}
+		// an exact match is always a near match too, so stop at the strongest
+		break
+	}
+
+	for _, match := range matches {
+		if _, ok := match.claims[match.key]; !ok {
+			match.claims[match.key] = fingerprintClaim{id: score.Id}
+		}
+	}
+	return nil
+}
+
+// records the fingerprints of an already stored receipt, such as an imported
+// one, without applying the policy to it
+func (d *DuplicateDetector) Register(score ReceiptScore) {
+	d.each(score, func(claims map[string]fingerprintClaim, key string) {
+		if _, ok := claims[key]; !ok {
+			claims[key] = fingerprintClaim{id: score.Id, confirmed: true}
+		}
+	})
+}
+
+func (d *DuplicateDetector) Confirm(score ReceiptScore) {
+	d.each(score, func(claims map[string]fingerprintClaim, key string) {
+		if claim, ok := claims[key]; ok && claim.id == score.Id {
+			claims[key] = fingerprintClaim{id: score.Id, confirmed: true}
+		}
+	})
+}
+
+func (d *DuplicateDetector) Release(score ReceiptScore) {
+	d.each(score, func(claims map[string]fingerprintClaim, key string) {
+		if claim, ok := claims[key]; ok && claim.id == score.Id {
+			delete(claims, key)
+		}
+	})
+}
+
+// releases the claims of score that keep does not share, so that a correction
+// gives up only the fingerprints it claimed or left behind and never those the
+// receipt still holds
+func (d *DuplicateDetector) ReleaseExcept(score, keep ReceiptScore) {
+	kept := FingerprintReceipt(keep.Receipt)
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	fingerprints := FingerprintReceipt(score.Receipt)
+	for _, match := range []struct {
+		claims    map[string]fingerprintClaim
+		key, kept string
+	}{
+		{d.exact, claimKey(score.Tenant, fingerprints.Exact), claimKey(keep.Tenant, kept.Exact)},
+		{d.near, claimKey(score.Tenant, fingerprints.Near), claimKey(keep.Tenant, kept.Near)},
+	} {
+		if claim, ok := match.claims[match.key]; ok && claim.id == score.Id && match.key != match.kept {
+			delete(match.claims, match.key)
+		}
+	}
+}
+
+func (d *DuplicateDetector) each(score ReceiptScore, fn func(map[string]fingerprintClaim, string)) {
+	fingerprints := FingerprintReceipt(score.Receipt)
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	fn(d.exact, claimKey(score.Tenant, fingerprints.Exact))
+	fn(d.near, claimKey(score.Tenant, fingerprints.Near))
+}
+
+// receipts only duplicate receipts belonging to the same tenant
+func claimKey(tenant, fingerprint string) string {
+	return tenant + ":" + fingerprint
+}
+
+// returns the receipt holding a claim, dropping claims whose receipt has since
+// been deleted, expired or evicted; callers must hold d.mu
+func (d *DuplicateDetector) live(ctx context.Context, store ReceiptStore, claims map[string]fingerprintClaim, key string) (uuid.UUID, bool, error) {
+	claim, ok := claims[key]
+	if !ok {
+		return uuid.Nil, false, nil
+	}
+	if !claim.confirmed {
+		return claim.id, true, nil
+	}
+	_, err := store.Get(ctx, claim.id)
+	if errors.Is(err, ErrReceiptNotFound) || errors.Is(err, ErrReceiptExpired) {
+		delete(claims, key)
+		return uuid.Nil, false, nil
+	}
+	if err != nil {
+		return uuid.Nil, false, err
+	}
+	return claim.id, true, nil
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+)
+
+const walgreensReceipt = `{
+	"retailer": "Walgreens",
+	"purchaseDate": "2022-01-02",
+	"purchaseTime": "08:13",
+	"total": "2.65",
+	"items": [
+		{"shortDescription": "Pepsi - 12-oz", "price": "1.25"},
+		{"shortDescription": "Dasani", "price": "1.40"}
+	]
+}`
+
+const reorderedWalgreensReceipt = `{
+	"retailer": "walgreens ",
+	"purchaseDate": "2022-01-02",
+	"purchaseTime": "08:13",
+	"total": "2.65",
+	"items": [
+		{"shortDescription": "Dasani", "price": "1.40"},
+		{"shortDescription": "Pepsi - 12-oz", "price": "1.25"}
+	]
+}`
+
+const recasedWalgreensReceipt = `{
+	"retailer": "Walgreens",
+	"purchaseDate": "2022-01-02",
+	"purchaseTime": "09:45",
+	"total": "2.65",
+	"items": [
+		{"shortDescription": "DASANI", "price": "1.40"},
+		{"shortDescription": "pepsi - 12-oz", "price": "1.25"}
+	]
+}`
+
+func TestFingerprintReceipt(t *testing.T) {
+	original := fingerprint(t, walgreensReceipt)
+
+	t.Run("ignores item order and retailer formatting", func(t *testing.T) {
+		if fingerprint(t, reorderedWalgreensReceipt) != original {
+			t.Errorf("expected reordered receipt to share a fingerprint")
+		}
+	})
+
+	t.Run("matches re-cased items only as a near duplicate", func(t *testing.T) {
+		recased := fingerprint(t, recasedWalgreensReceipt)
+		if recased.Exact == original.Exact {
+			t.Errorf("expected re-cased receipt to have a different exact fingerprint")
+		}
+		if recased.Near != original.Near {
+			t.Errorf("expected re-cased receipt to share a near fingerprint")
+		}
+	})
+}
+
+func TestDuplicateSubmissions(t *testing.T) {
+	t.Run("rejects an exact duplicate with the original ID", func(t *testing.T) {
+		server := NewReceiptServer(NewReceiptStore())
+		original := postReceipt(t, server, walgreensReceipt)
+
+		response := httptest.NewRecorder()
+		server.ServeHTTP(response, newPostReceiptRequest(reorderedWalgreensReceipt))
+
+		assertResponseCode(t, response.Code, http.StatusConflict)
+		var id ID
+		err := json.NewDecoder(response.Body).Decode(&id)
+		checkDecodeErr(t, response, err)
+		if id.Id != original.Id {
+			t.Errorf("expected original ID %v but got %v", original.Id, id.Id)
+		}
+	})
+
+	t.Run("flags a near duplicate", func(t *testing.T) {
+		store := NewReceiptStore()
+		server := NewReceiptServer(store)
+		original := postReceipt(t, server, walgreensReceipt)
+		flagged := postReceipt(t, server, recasedWalgreensReceipt)
+
+		score, err := store.Get(context.Background(), flagged.Id)
+		assertNoError(t, err)
+		if score.DuplicateOf == nil || *score.DuplicateOf != original.Id || score.DuplicateMatch != nearDuplicate {
+			t.Errorf("expected receipt to be flagged as a near duplicate of %v but got %+v", original.Id, score)
+		}
+	})
+
+	t.Run("accepts a resubmission once the original is deleted", func(t *testing.T) {
+		store := NewReceiptStore()
+		server := NewReceiptServer(store)
+		original := postReceipt(t, server, walgreensReceipt)
+		assertNoError(t, store.Delete(context.Background(), original.Id))
+
+		postReceipt(t, server, walgreensReceipt)
+	})
+
+	t.Run("accepts only one of many concurrent duplicates", func(t *testing.T) {
+		server := NewReceiptServer(NewReceiptStore())
+		var wg sync.WaitGroup
+		codes := make(chan int, 10)
+		for range 10 {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				response := httptest.NewRecorder()
+				server.ServeHTTP(response, newPostReceiptRequest(walgreensReceipt))
+				codes <- response.Code
+			}()
+		}
+		wg.Wait()
+		close(codes)
+
+		accepted := 0
+		for code := range codes {
+			if code == http.StatusOK {
+				accepted++
+			}
+		}
+		assertExpectedPoints(t, accepted, 1)
+	})
+}
+
+func fingerprint(t testing.TB, body string) Fingerprints {
+	t.Helper()
+	var receipt Receipt
+	err := json.Unmarshal([]byte(body), &receipt)
+	assertNoError(t, err)
+	return FingerprintReceipt(receipt)
+}
+
+func postReceipt(t testing.TB, server http.Handler, body string) ID {
+	t.Helper()
+	response := httptest.NewRecorder()
+	server.ServeHTTP(response, newPostReceiptRequest(body))
+	assertResponseCode(t, response.Code, http.StatusOK)
+	return decodeID(t, response)
+}
+
+func decodeID(t testing.TB, response *httptest.ResponseRecorder) ID {
+	t.Helper()
+	var id ID
+	err := json.NewDecoder(response.Body).Decode(&id)
+	checkDecodeErr(t, response, err)
+	return id
+}
@@ -0,0 +1,227 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+const actorHeader = "X-Actor"
+const defaultActor = "api"
+
+var ErrNoHistory = errors.New("no history for receipt")
+
+type EventType string
+
+const (
+	EventSubmitted EventType = "submitted"
+	EventValidated EventType = "validated"
+	EventScored    EventType = "scored"
+	EventRescored  EventType = "rescored"
+	EventAdjusted  EventType = "adjusted"
+	EventRefunded  EventType = "refunded"
+	EventApproved  EventType = "approved"
+	EventRejected  EventType = "rejected"
+	EventDeleted   EventType = "deleted"
+	EventRestored  EventType = "restored"
+)
+
+// an immutable record of one change to a receipt; which fields are set
+// depends on the event type
+type ReceiptEvent struct {
+	ReceiptID uuid.UUID `json:"receiptId"`
+	Sequence  int       `json:"sequence"`
+	Type      EventType `json:"type"`
+	At        time.Time `json:"at"`
+	Actor     string    `json:"actor"`
+	Reason    string    `json:"reason,omitempty"`
+	// the tenant that owns the receipt and the member it was submitted for,
+	// set on submitted
+	Tenant   string `json:"tenant,omitempty"`
+	MemberID string `json:"memberId,omitempty"`
+	// set on submitted, and on rescored when the receipt itself was corrected
+	Receipt *Receipt `json:"receipt,omitempty"`
+	// the new total on scored and rescored, the change on adjusted
+	Points *int `json:"points,omitempty"`
+	// the points before earning caps and the member's tier applied on scored
+	// and rescored
+	RawPoints *int   `json:"rawPoints,omitempty"`
+	Tier      string `json:"tier,omitempty"`
+	// set on scored, and on rescored after a correction, when the receipt is
+	// held for review
+	Status        ReceiptStatus `json:"status,omitempty"`
+	ReviewReasons []string      `json:"reviewReasons,omitempty"`
+	// the fraud risk assessed on scored
+	Risk *RiskAssessment `json:"risk,omitempty"`
+	// duplicate detection results recorded on scored
+	Fingerprint    string     `json:"fingerprint,omitempty"`
+	DuplicateOf    *uuid.UUID `json:"duplicateOf,omitempty"`
+	DuplicateMatch string     `json:"duplicateMatch,omitempty"`
+	// the refund receipt on refunded, with the change on Points and the new
+	// RawPoints
+	Refund *Refund `json:"refund,omitempty"`
+	// set on deleted when the receipt can still be restored
+	Soft bool `json:"soft,omitempty"`
+}
+
+// like ReceiptStore, journals are partitioned by the tenant on the context
+type EventJournal interface {
+	Append(ctx context.Context, events ...ReceiptEvent) error
+	History(ctx context.Context, id uuid.UUID) ([]ReceiptEvent, error)
+}
+
+type InMemoryEventJournal struct {
+	mu     sync.Mutex
+	events map[uuid.UUID][]ReceiptEvent
+}
+
+func NewEventJournal() *InMemoryEventJournal {
+	return &InMemoryEventJournal{events: make(map[uuid.UUID][]ReceiptEvent)}
+}
+
+// appends events in order, numbering each within its receipt's history
+func (j *InMemoryEventJournal) Append(ctx context.Context, events ...ReceiptEvent) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	for _, event := range events {
+		event.Sequence = len(j.events[event.ReceiptID]) + 1
+		j.events[event.ReceiptID] = append(j.events[event.ReceiptID], event)
+	}
+	return nil
+}
+
+func (j *InMemoryEventJournal) History(ctx context.Context, id uuid.UUID) ([]ReceiptEvent, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	events, ok := j.events[id]
+	if !ok || events[0].Tenant != TenantFromContext(ctx) {
+		return nil, ErrNoHistory
+	}
+	return append([]ReceiptEvent(nil), events...), nil
+}
+
+// drops the history of a receipt the store no longer retains
+func (j *InMemoryEventJournal) Forget(id uuid.UUID) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	delete(j.events, id)
+}
+
+// derives the current state of a receipt from its history, returning false if
+// the receipt has been deleted
+func foldEvents(events []ReceiptEvent) (ReceiptScore, bool) {
+	var score ReceiptScore
+	exists := false
+	for _, event := range events {
+		switch event.Type {
+		case EventSubmitted:
+			score = ReceiptScore{Id: event.ReceiptID, Tenant: event.Tenant, MemberID: event.MemberID, Receipt: *event.Receipt, ProcessedAt: event.At, Status: ReceiptAccepted}
+			exists = true
+		case EventScored, EventRescored:
+			if event.Receipt != nil {
+				score.Receipt = *event.Receipt
+			}
+			score.Points = *event.Points
+			score.RawPoints = *event.Points
+			if event.RawPoints != nil {
+				score.RawPoints = *event.RawPoints
+			}
+			score.Tier = event.Tier
+			if event.Risk != nil {
+				score.Risk = event.Risk
+			}
+			if event.Status != "" {
+				score.Status = event.Status
+				score.Review = &Review{Reasons: event.ReviewReasons}
+			}
+			if event.Fingerprint != "" {
+				score.Fingerprint = event.Fingerprint
+				score.DuplicateOf = event.DuplicateOf
+				score.DuplicateMatch = event.DuplicateMatch
+			}
+		case EventAdjusted:
+			score.Points += *event.Points
+			score.RawPoints += *event.Points
+		case EventRefunded:
+			score.Points += *event.Points
+			score.RawPoints = *event.RawPoints
+			score.Refunds = append(score.Refunds, *event.Refund)
+		case EventApproved, EventRejected:
+			score.Status = ReceiptRejected
+			if event.Type == EventApproved {
+				score.Status = ReceiptAccepted
+				score.Points = *event.Points
+			}
+			review := Review{Reviewer: event.Actor, Reason: event.Reason, ReviewedAt: &event.At}
+			if score.Review != nil {
+				review.Reasons = score.Review.Reasons
+			}
+			score.Review = &review
+		case EventDeleted:
+			exists = false
+		case EventRestored:
+			exists = true
+		}
+		score.Version = event.Sequence
+	}
+	return score, exists
+}
+
+// reports whether the last event in a history is a soft delete
+func softDeleted(events []ReceiptEvent) bool {
+	return len(events) > 0 && events[len(events)-1].Type == EventDeleted && events[len(events)-1].Soft
+}
+
+// the events recording a newly processed receipt
+func submissionEvents(score ReceiptScore, actor string) []ReceiptEvent {
+	receipt := score.Receipt
+	points, rawPoints := score.Points, score.RawPoints
+	return []ReceiptEvent{
+		{ReceiptID: score.Id, Type: EventSubmitted, At: score.ProcessedAt, Actor: actor, Tenant: score.Tenant, MemberID: score.MemberID, Receipt: &receipt},
+		{ReceiptID: score.Id, Type: EventValidated, At: score.ProcessedAt, Actor: actor},
+		{
+			ReceiptID:      score.Id,
+			Type:           EventScored,
+			At:             score.ProcessedAt,
+			Actor:          actor,
+			Points:         &points,
+			RawPoints:      &rawPoints,
+			Tier:           score.Tier,
+			Status:         score.Status,
+			ReviewReasons:  reviewReasons(score),
+			Risk:           score.Risk,
+			Fingerprint:    score.Fingerprint,
+			DuplicateOf:    score.DuplicateOf,
+			DuplicateMatch: score.DuplicateMatch,
+		},
+	}
+}
+
+func reviewReasons(score ReceiptScore) []string {
+	if score.Review == nil {
+		return nil
+	}
+	return score.Review.Reasons
+}
+
+// returns the name of the staff member sending the request, or else the
+// X-Actor header
+func actorFromRequest(r *http.Request) string {
+	if staff, ok := StaffFromContext(r.Context()); ok {
+		return staff.Name
+	}
+	if actor := r.Header.Get(actorHeader); actor != "" {
+		return actor
+	}
+	return defaultActor
+}
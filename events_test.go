@@ -0,0 +1,103 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+func TestFoldEvents(t *testing.T) {
+	id := uuid.New()
+	at := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	receipt := Receipt{Retailer: "Target"}
+	points := func(n int) *int { return &n }
+	events := []ReceiptEvent{
+		{ReceiptID: id, Sequence: 1, Type: EventSubmitted, At: at, Receipt: &receipt},
+		{ReceiptID: id, Sequence: 2, Type: EventValidated, At: at},
+		{ReceiptID: id, Sequence: 3, Type: EventScored, At: at, Points: points(28)},
+		{ReceiptID: id, Sequence: 4, Type: EventAdjusted, At: at.Add(time.Hour), Points: points(-8)},
+	}
+
+	t.Run("derives the current score", func(t *testing.T) {
+		score, exists := foldEvents(events)
+		if !exists {
+			t.Fatalf("expected the receipt to exist")
+		}
+		assertExpectedPoints(t, score.Points, 20)
+		assertExpectedPoints(t, score.Version, 4)
+		if !score.ProcessedAt.Equal(at) || score.Receipt.Retailer != "Target" {
+			t.Errorf("expected the submitted receipt and time but got %+v", score)
+		}
+	})
+
+	t.Run("a deleted receipt no longer exists", func(t *testing.T) {
+		deleted := append(events, ReceiptEvent{ReceiptID: id, Sequence: 5, Type: EventDeleted})
+		_, exists := foldEvents(deleted)
+		if exists {
+			t.Errorf("expected the receipt to be deleted")
+		}
+	})
+}
+
+func TestReceiptHistory(t *testing.T) {
+	store := NewReceiptStore()
+	server := NewReceiptServer(store)
+	request := newPostReceiptRequest(walgreensReceipt)
+	request.Header.Set(actorHeader, "support@example.com")
+	response := httptest.NewRecorder()
+	server.ServeHTTP(response, request)
+	var id ID
+	checkDecodeErr(t, response, json.NewDecoder(response.Body).Decode(&id))
+
+	t.Run("lists every event for a receipt", func(t *testing.T) {
+		response := httptest.NewRecorder()
+		server.ServeHTTP(response, newGetHistoryRequest(id.Id))
+
+		assertResponseCode(t, response.Code, http.StatusOK)
+		var events []ReceiptEvent
+		checkDecodeErr(t, response, json.NewDecoder(response.Body).Decode(&events))
+		want := []EventType{EventSubmitted, EventValidated, EventScored}
+		if len(events) != len(want) {
+			t.Fatalf("expected %d events but got %d", len(want), len(events))
+		}
+		for i, event := range events {
+			if event.Type != want[i] || event.Sequence != i+1 || event.Actor != "support@example.com" {
+				t.Errorf("unexpected event %+v", event)
+			}
+		}
+	})
+
+	t.Run("stores the folded state", func(t *testing.T) {
+		score, err := store.Get(context.Background(), id.Id)
+		assertNoError(t, err)
+		assertExpectedPoints(t, score.Points, 15)
+		assertExpectedPoints(t, score.Version, 3)
+	})
+
+	t.Run("returns not found for an unknown receipt", func(t *testing.T) {
+		response := httptest.NewRecorder()
+		server.ServeHTTP(response, newGetHistoryRequest(uuid.New()))
+
+		assertResponseCode(t, response.Code, http.StatusNotFound)
+	})
+
+	t.Run("forgets the history of evicted receipts", func(t *testing.T) {
+		store := NewReceiptStore(WithRetention(RetentionPolicy{MaxReceipts: 1}))
+		server := NewReceiptServer(store)
+		evicted := postReceipt(t, server, walgreensReceipt)
+		postReceipt(t, server, recasedWalgreensReceipt)
+
+		_, err := server.journal.History(context.Background(), evicted.Id)
+		assertErrorIs(t, err, ErrNoHistory)
+	})
+}
+
+func newGetHistoryRequest(id uuid.UUID) *http.Request {
+	req, _ := http.NewRequest(http.MethodGet, "/receipts/"+id.String()+"/history", nil)
+	return req
+}
@@ -0,0 +1,276 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"slices"
+	"strconv"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// zero Months means points never expire
+type PointsExpiry struct {
+	Months int
+	Basis  TTLBasis
+}
+
+// points expire 12 months after the receipt that earned them was processed
+func DefaultPointsExpiry() PointsExpiry {
+	return PointsExpiry{Months: 12, Basis: TTLFromProcessedAt}
+}
+
+func WithPointsExpiry(expiry PointsExpiry) MemberOption {
+	return func(m *MemberRegistry) {
+		m.expiry = expiry
+	}
+}
+
+// returns when the points a receipt earns expire, or the zero time if never
+func (p PointsExpiry) expiresAt(score ReceiptScore) time.Time {
+	start := score.ProcessedAt
+	if p.Basis == TTLFromPurchaseDate {
+		purchasedAt, err := purchaseTime(score.Receipt)
+		if err == nil {
+			start = purchasedAt
+		}
+	}
+	return p.expiresFrom(start)
+}
+
+// returns when points earned at start expire, or the zero time if never
+func (p PointsExpiry) expiresFrom(start time.Time) time.Time {
+	if p.Months <= 0 {
+		return time.Time{}
+	}
+	return start.AddDate(0, p.Months, 0)
+}
+
+// the points one receipt earned a member, which expire together
+type pointsLot struct {
+	receiptID uuid.UUID
+	expiresAt time.Time
+	remaining int
+	expired   int
+}
+
+type memberLots struct {
+	tenant   string
+	memberID string
+	// soonest to expire first, with points that never expire last
+	lots []*pointsLot
+}
+
+func compareExpiry(a, b time.Time) int {
+	switch {
+	case a.Equal(b):
+		return 0
+	case a.IsZero():
+		return 1
+	case b.IsZero():
+		return -1
+	}
+	return a.Compare(b)
+}
+
+// returns the receipt's lot, adding an empty one behind any that expire at
+// the same time if it has none yet
+func (l *Ledger) lot(tenant, memberID string, receiptID uuid.UUID, expiresAt time.Time) *pointsLot {
+	if lot, ok := l.lotsByReceipt[receiptID]; ok {
+		return lot
+	}
+	key := memberKey(tenant, memberID)
+	member, ok := l.lots[key]
+	if !ok {
+		member = &memberLots{tenant: tenant, memberID: memberID}
+		l.lots[key] = member
+	}
+	lot := &pointsLot{receiptID: receiptID, expiresAt: expiresAt}
+	i, _ := slices.BinarySearchFunc(member.lots, expiresAt, func(existing *pointsLot, target time.Time) int {
+		if compareExpiry(existing.expiresAt, target) <= 0 {
+			return -1
+		}
+		return 1
+	})
+	member.lots = slices.Insert(member.lots, i, lot)
+	l.lotsByReceipt[receiptID] = lot
+	return lot
+}
+
+// takes up to points from the member's lots, soonest to expire first, and
+// returns how many were taken
+func (l *Ledger) consume(tenant, memberID string, points int) int {
+	taken := 0
+	for _, share := range l.take(tenant, memberID, points) {
+		taken += share.points
+	}
+	return taken
+}
+
+// points taken from a lot, kept so they can be put back
+type lotShare struct {
+	lot    *pointsLot
+	points int
+}
+
+// takes up to points from the member's lots, soonest to expire first, and
+// returns what was taken from each
+func (l *Ledger) take(tenant, memberID string, points int) []lotShare {
+	shares := []lotShare{}
+	member, ok := l.lots[memberKey(tenant, memberID)]
+	if !ok {
+		return shares
+	}
+	taken := 0
+	for _, lot := range member.lots {
+		if taken == points {
+			break
+		}
+		take := min(points-taken, lot.remaining)
+		if take == 0 {
+			continue
+		}
+		lot.remaining -= take
+		taken += take
+		shares = append(shares, lotShare{lot: lot, points: take})
+	}
+	return shares
+}
+
+// posts an expiry for every lot of the member's that expired by now
+func (l *Ledger) expire(tenant, memberID string, now time.Time) int {
+	member, ok := l.lots[memberKey(tenant, memberID)]
+	if !ok {
+		return 0
+	}
+	expired := 0
+	for _, lot := range member.lots {
+		if lot.expiresAt.IsZero() || now.Before(lot.expiresAt) {
+			break
+		}
+		if lot.remaining == 0 {
+			continue
+		}
+		points := lot.remaining
+		lot.remaining = 0
+		lot.expired += points
+		expired += points
+		receiptID := lot.receiptID
+		l.post(tenant, LedgerTransaction{Type: TransactionExpired, At: now, MemberID: memberID, ReceiptID: &receiptID, Reason: "points expired", Postings: []Posting{
+			{Account: memberAccount(memberID), Amount: -points},
+			{Account: expiredAccount, Amount: points},
+		}})
+	}
+	return expired
+}
+
+// posts every expiry that is due and returns how many points expired
+func (m *MemberRegistry) ExpirePoints() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	expired := 0
+	for _, member := range m.ledger.lots {
+		expired += m.ledger.expire(member.tenant, member.memberID, m.now())
+	}
+	return expired
+}
+
+// starts a background goroutine that posts due expiries and releases timed out
+// reservations every interval until Close is called
+func (m *MemberRegistry) StartExpiry(interval time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.stop != nil {
+		return
+	}
+	m.stop = make(chan struct{})
+	m.done = make(chan struct{})
+	go func(stop <-chan struct{}, done chan<- struct{}) {
+		defer close(done)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				if expired := m.ExpirePoints(); expired > 0 {
+					log.Printf("expired %d points", expired)
+				}
+				if released := m.ReleaseReservations(); released > 0 {
+					log.Printf("released %d timed out reservations", released)
+				}
+			case <-stop:
+				return
+			}
+		}
+	}(m.stop, m.done)
+}
+
+// stops the expiry job, waiting for an in-progress run to finish
+func (m *MemberRegistry) Close() error {
+	m.mu.Lock()
+	stop, done := m.stop, m.done
+	m.stop, m.done = nil, nil
+	m.mu.Unlock()
+	if stop != nil {
+		close(stop)
+		<-done
+	}
+	return nil
+}
+
+// used to encode the response to GET /members/{id}/expirations
+type Expiration struct {
+	ReceiptID uuid.UUID `json:"receiptId"`
+	Points    int       `json:"points"`
+	ExpiresAt time.Time `json:"expiresAt"`
+}
+
+// returns the member's points that expire before the given time, soonest
+// first, or all of them if before is zero
+func (m *MemberRegistry) Expirations(ctx context.Context, memberID string, before time.Time) ([]Expiration, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	tenant := TenantFromContext(ctx)
+	if _, ok := m.members[memberKey(tenant, memberID)]; !ok {
+		return nil, ErrMemberNotFound
+	}
+	m.ledger.expire(tenant, memberID, m.now())
+	expirations := []Expiration{}
+	member, ok := m.ledger.lots[memberKey(tenant, memberID)]
+	if !ok {
+		return expirations, nil
+	}
+	for _, lot := range member.lots {
+		if lot.expiresAt.IsZero() || (!before.IsZero() && !lot.expiresAt.Before(before)) {
+			break
+		}
+		if lot.remaining > 0 {
+			expirations = append(expirations, Expiration{ReceiptID: lot.receiptID, Points: lot.remaining, ExpiresAt: lot.expiresAt})
+		}
+	}
+	return expirations, nil
+}
+
+func (rs *ReceiptServer) getMemberExpirations(w http.ResponseWriter, r *http.Request) {
+	var before time.Time
+	if value := r.URL.Query().Get("days"); value != "" {
+		days, err := strconv.Atoi(value)
+		if err != nil || days < 1 {
+			http.Error(w, "The days parameter must be a positive whole number.", http.StatusBadRequest)
+			return
+		}
+		before = rs.members.now().AddDate(0, 0, days)
+	}
+	expirations, err := rs.members.Expirations(r.Context(), r.PathValue("id"), before)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", jsonContentType)
+	if err := json.NewEncoder(w).Encode(expirations); err != nil {
+		log.Println(err)
+	}
+}
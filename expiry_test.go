@@ -0,0 +1,76 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestPointsExpiry(t *testing.T) {
+	newServer := func(clock *fakeClock) *ReceiptServer {
+		members := NewMemberRegistry(
+			WithPointsExpiry(PointsExpiry{Months: 12, Basis: TTLFromPurchaseDate}),
+			WithMemberClock(clock.now),
+		)
+		return NewReceiptServer(NewReceiptStore(), WithMembers(members), WithStaff(testAdmin))
+	}
+
+	t.Run("spends and expires the oldest points first", func(t *testing.T) {
+		clock := &fakeClock{current: time.Date(2022, 12, 1, 0, 0, 0, 0, time.UTC)}
+		server := newServer(clock)
+		walgreens := postMemberReceipt(t, server, "alice", walgreensReceipt)
+		corner := postMemberReceipt(t, server, "alice", cornerMarketReceipt)
+
+		var expirations []Expiration
+		getJSON(t, server, "/members/alice/expirations?days=60", &expirations)
+		if len(expirations) != 1 || expirations[0].ReceiptID != walgreens.Id || expirations[0].Points != 15 {
+			t.Errorf("expected only the Walgreens points to expire within 60 days but got %+v", expirations)
+		}
+
+		assertResponseCode(t, redeem(server, "alice", `{"points": 20}`).Code, http.StatusCreated)
+		getJSON(t, server, "/members/alice/expirations", &expirations)
+		if len(expirations) != 1 || expirations[0].ReceiptID != corner.Id || expirations[0].Points != 104 {
+			t.Errorf("expected the redemption to use up the Walgreens points first but got %+v", expirations)
+		}
+
+		clock.current = time.Date(2023, 2, 1, 0, 0, 0, 0, time.UTC)
+		if expired := server.members.ExpirePoints(); expired != 0 {
+			t.Errorf("expected no points left to expire but %d did", expired)
+		}
+		clock.current = time.Date(2023, 4, 1, 0, 0, 0, 0, time.UTC)
+		if expired := server.members.ExpirePoints(); expired != 104 {
+			t.Errorf("expected 104 points to expire but %d did", expired)
+		}
+		if member := getMember(t, server, "alice"); member.Balance != 0 {
+			t.Errorf("expected a balance of 0 but got %d", member.Balance)
+		}
+	})
+
+	t.Run("does not take back expired points twice", func(t *testing.T) {
+		clock := &fakeClock{current: time.Date(2023, 2, 1, 0, 0, 0, 0, time.UTC)}
+		server := newServer(clock)
+		walgreens := postMemberReceipt(t, server, "alice", walgreensReceipt)
+		postMemberReceipt(t, server, "alice", cornerMarketReceipt)
+		server.members.ExpirePoints()
+
+		response := sendRequest(server, http.MethodDelete, "/receipts/"+walgreens.Id.String(), "")
+		assertResponseCode(t, response.Code, http.StatusNoContent)
+
+		if member := getMember(t, server, "alice"); member.Balance != 109 {
+			t.Errorf("expected a balance of 109 but got %d", member.Balance)
+		}
+		var reconciliation Reconciliation
+		getAdminJSON(t, server, "/admin/reconcile", &reconciliation)
+		if !reconciliation.Balanced {
+			t.Errorf("expected a balanced ledger but got %+v", reconciliation)
+		}
+	})
+
+	t.Run("expires due points before a redemption", func(t *testing.T) {
+		clock := &fakeClock{current: time.Date(2023, 2, 1, 0, 0, 0, 0, time.UTC)}
+		server := newServer(clock)
+		postMemberReceipt(t, server, "alice", walgreensReceipt)
+
+		assertResponseCode(t, redeem(server, "alice", `{"points": 10}`).Code, http.StatusUnprocessableEntity)
+	})
+}
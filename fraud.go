@@ -0,0 +1,280 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+const clientIDHeader = "X-Client-ID"
+const blockedMessage = "The receipt was refused as likely fraud."
+
+var ErrSubmissionBlocked = errors.New("submission blocked as likely fraud")
+
+// how much each signal adds to a receipt's risk score, which is capped at 100
+const (
+	velocityRisk       = 25
+	repeatedTotalRisk  = 20
+	quarterPricingRisk = 15
+	roundDollarRisk    = 10
+	paddingRisk        = 10
+	maxPaddingRisk     = 30
+	maxRiskScore       = 100
+)
+
+// how likely a receipt is to be fraudulent, from 0 to 100, and why
+type RiskAssessment struct {
+	Score   int      `json:"score"`
+	Reasons []string `json:"reasons"`
+}
+
+// who sent a submission, as far as the server can tell
+type Submitter struct {
+	// the host of the remote address, which the client cannot choose
+	Address string
+	// the X-Client-ID header, which the client can
+	ClientID string
+	APIKey   string
+}
+
+type submitterContextKey struct{}
+
+func WithSubmitter(ctx context.Context, submitter Submitter) context.Context {
+	return context.WithValue(ctx, submitterContextKey{}, submitter)
+}
+
+func SubmitterFromContext(ctx context.Context) Submitter {
+	submitter, _ := ctx.Value(submitterContextKey{}).(Submitter)
+	return submitter
+}
+
+// used to put the Submitter of each request on its context
+func submitterMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		address := r.RemoteAddr
+		if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+			address = host
+		}
+		submitter := Submitter{Address: address, ClientID: r.Header.Get(clientIDHeader), APIKey: r.Header.Get(apiKeyHeader)}
+		next.ServeHTTP(w, r.WithContext(WithSubmitter(r.Context(), submitter)))
+	})
+}
+
+// the limits the fraud signals are judged by
+type FraudPolicy struct {
+	// more than this many submissions from one address, client ID, API key or
+	// member within the window counts against each receipt, 0 to ignore
+	// velocity
+	MaxSubmissions int `json:"maxSubmissions,omitempty"`
+	WindowMinutes  int `json:"windowMinutes,omitempty"`
+	// this many or more receipts with the same total from one member, or
+	// from one address without a member, within the days counts against each
+	// of them, 0 to ignore repeated totals
+	MaxRepeatedTotals  int `json:"maxRepeatedTotals,omitempty"`
+	RepeatedTotalsDays int `json:"repeatedTotalsDays,omitempty"`
+	// submissions scoring at least this are refused, 0 to never refuse
+	BlockAt int `json:"blockAt,omitempty"`
+}
+
+// counts more than 30 submissions in 10 minutes or 3 receipts with one total
+// in a week against a receipt, without ever refusing one
+func DefaultFraudPolicy() FraudPolicy {
+	return FraudPolicy{MaxSubmissions: 30, WindowMinutes: 10, MaxRepeatedTotals: 3, RepeatedTotalsDays: 7}
+}
+
+func (p FraudPolicy) Validate() error {
+	if p.MaxSubmissions < 0 || p.WindowMinutes < 0 || p.MaxRepeatedTotals < 0 || p.RepeatedTotalsDays < 0 {
+		return errors.New("fraud limits must not be negative")
+	}
+	if p.MaxSubmissions > 0 && p.WindowMinutes == 0 {
+		return errors.New("fraud maxSubmissions needs a windowMinutes")
+	}
+	if p.MaxRepeatedTotals > 0 && p.RepeatedTotalsDays == 0 {
+		return errors.New("fraud maxRepeatedTotals needs a repeatedTotalsDays")
+	}
+	if p.BlockAt < 0 || p.BlockAt > maxRiskScore {
+		return fmt.Errorf("fraud blockAt must be between 0 and %d", maxRiskScore)
+	}
+	return nil
+}
+
+func LoadFraudPolicy(path string) (FraudPolicy, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return FraudPolicy{}, err
+	}
+	var policy FraudPolicy
+	if err := json.Unmarshal(data, &policy); err != nil {
+		return FraudPolicy{}, fmt.Errorf("parsing %s: %w", path, err)
+	}
+	if err := policy.Validate(); err != nil {
+		return FraudPolicy{}, fmt.Errorf("%s: %w", path, err)
+	}
+	return policy, nil
+}
+
+type totalSeen struct {
+	at    time.Time
+	total string
+}
+
+// used to score each submission for fraud, keeping the recent submissions of
+// every address, client ID, API key and member the velocity and repeated total
+// signals need
+type FraudDetector struct {
+	mu     sync.Mutex
+	now    func() time.Time
+	policy FraudPolicy
+	// submission times and totals by tenant and submitter
+	submissions map[string][]time.Time
+	totals      map[string][]totalSeen
+	// the sizes at which each map is next swept
+	sweepSubmissions, sweepTotals int
+}
+
+func NewFraudDetector(policy FraudPolicy) *FraudDetector {
+	return &FraudDetector{
+		now:         time.Now,
+		policy:      policy,
+		submissions: make(map[string][]time.Time),
+		totals:      make(map[string][]totalSeen),
+	}
+}
+
+// counts a new submission against its submitter and scores it
+func (d *FraudDetector) Assess(ctx context.Context, score ReceiptScore) RiskAssessment {
+	assessment := RiskAssessment{Reasons: []string{}}
+	add := func(risk int, reason string, args ...any) {
+		assessment.Score = min(assessment.Score+risk, maxRiskScore)
+		assessment.Reasons = append(assessment.Reasons, fmt.Sprintf(reason, args...))
+	}
+	receipt := score.Receipt
+	if allPricedInQuarters(receipt.Items) && multiplesOfQuartersPoints(receipt.Total) > 0 {
+		add(quarterPricingRisk, "every item is priced in quarters for a total of %s", receipt.Total)
+		if roundDollarPoints(receipt.Total) > 0 {
+			add(roundDollarRisk, "the items add up to a round dollar total")
+		}
+	}
+	padded := 0
+	for _, item := range receipt.Items {
+		if padded < maxPaddingRisk && paddedDescription(item.ShortDescription) {
+			padded += paddingRisk
+			add(paddingRisk, "description %q is padded to a multiple of 3 characters", item.ShortDescription)
+		}
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	tenant := TenantFromContext(ctx)
+	submitter := SubmitterFromContext(ctx)
+	now := d.now()
+	if d.policy.MaxSubmissions > 0 {
+		since := now.Add(-time.Duration(d.policy.WindowMinutes) * time.Minute)
+		for _, source := range []struct{ kind, id, name string }{
+			{"address", submitter.Address, "address " + submitter.Address},
+			{"client", submitter.ClientID, "client " + submitter.ClientID},
+			{"key", submitter.APIKey, "this API key"},
+			{"member", score.MemberID, "member " + score.MemberID},
+		} {
+			if source.id == "" {
+				continue
+			}
+			key := memberKey(tenant, source.kind+":"+source.id)
+			recent := slices.DeleteFunc(d.submissions[key], func(at time.Time) bool {
+				return !at.After(since)
+			})
+			recent = append(recent, now)
+			d.submissions[key] = recent
+			if len(recent) > d.policy.MaxSubmissions {
+				add(velocityRisk, "%d submissions from %s within %d minutes", len(recent), source.name, d.policy.WindowMinutes)
+			}
+		}
+		sweepWindows(d.submissions, since, func(at time.Time) time.Time { return at }, &d.sweepSubmissions)
+	}
+	if d.policy.MaxRepeatedTotals > 0 && (score.MemberID != "" || submitter.Address != "") {
+		key := memberKey(tenant, "address:"+submitter.Address)
+		if score.MemberID != "" {
+			key = memberKey(tenant, "member:"+score.MemberID)
+		}
+		since := now.AddDate(0, 0, -d.policy.RepeatedTotalsDays)
+		recent := slices.DeleteFunc(d.totals[key], func(seen totalSeen) bool {
+			return !seen.at.After(since)
+		})
+		recent = append(recent, totalSeen{at: now, total: receipt.Total})
+		d.totals[key] = recent
+		repeats := 0
+		for _, seen := range recent {
+			if seen.total == receipt.Total {
+				repeats++
+			}
+		}
+		if repeats >= d.policy.MaxRepeatedTotals {
+			add(repeatedTotalRisk, "%d receipts totalling %s within %d days", repeats, receipt.Total, d.policy.RepeatedTotalsDays)
+		}
+		sweepWindows(d.totals, since, func(seen totalSeen) time.Time { return seen.at }, &d.sweepTotals)
+	}
+	return assessment
+}
+
+// the fewest windows kept before any are swept
+const minWindowSweep = 64
+
+// drops every window whose newest entry is no later than since once there are
+// twice as many windows as were left by the last sweep, so that submitters
+// who stop sending are forgotten without scanning the map on every submission
+func sweepWindows[T any](windows map[string][]T, since time.Time, at func(T) time.Time, next *int) {
+	if len(windows) < *next {
+		return
+	}
+	for key, window := range windows {
+		if len(window) == 0 || !at(window[len(window)-1]).After(since) {
+			delete(windows, key)
+		}
+	}
+	*next = max(2*len(windows), minWindowSweep)
+}
+
+// reports whether every one of several items costs a whole number of quarters,
+// which puts the total on a multiple of 0.25 however they are combined
+func allPricedInQuarters(items []Item) bool {
+	if len(items) < 2 {
+		return false
+	}
+	for _, item := range items {
+		cents, err := parseCents(item.Price)
+		if err != nil || cents%25 != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// reports whether a description only has a length that is a multiple of 3, as
+// itemDescriptionPoints rewards, because of repeated spaces or leading and
+// trailing hyphens and underscores
+func paddedDescription(description string) bool {
+	trimmed := strings.Trim(description, " ")
+	if len(trimmed)%3 != 0 {
+		return false
+	}
+	natural := strings.Trim(strings.Join(strings.Fields(trimmed), " "), "-_")
+	return len(natural)%3 != 0
+}
+
+// scores a new submission for fraud and refuses it if the policy says to
+func (rs *ReceiptServer) assessFraud(ctx context.Context, score *ReceiptScore) error {
+	risk := rs.fraud.Assess(ctx, *score)
+	score.Risk = &risk
+	if blockAt := rs.fraud.policy.BlockAt; blockAt > 0 && risk.Score >= blockAt {
+		return fmt.Errorf("%w: risk score %d: %s", ErrSubmissionBlocked, risk.Score, strings.Join(risk.Reasons, "; "))
+	}
+	return nil
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPaddedDescription(t *testing.T) {
+	cases := map[string]bool{
+		"Dasani":        false,
+		"Ginger Ale":    false,
+		"Ginger   Ale":  true,
+		"Fanta-":        true,
+		"  Fanta  ":     false,
+		"Coke    Zero":  false,
+		"Pepsi - 12-oz": false,
+	}
+	for description, want := range cases {
+		if got := paddedDescription(description); got != want {
+			t.Errorf("expected %q padded to be %v but got %v", description, want, got)
+		}
+	}
+}
+
+func TestFraudDetection(t *testing.T) {
+	newServer := func(policy FraudPolicy, options ...ServerOption) *ReceiptServer {
+		return NewReceiptServer(NewReceiptStore(), append(options, WithFraudDetector(NewFraudDetector(policy)))...)
+	}
+
+	t.Run("stores the risk of items priced to earn points", func(t *testing.T) {
+		server := newServer(FraudPolicy{})
+		corner := postReceipt(t, server, cornerMarketReceipt)
+		walgreens := postReceipt(t, server, walgreensReceipt)
+
+		assertRisk(t, server, corner, 25)
+		assertRisk(t, server, walgreens, 0)
+	})
+
+	t.Run("scores the velocity of each address whatever client ID it sends", func(t *testing.T) {
+		server := newServer(FraudPolicy{MaxSubmissions: 2, WindowMinutes: 10})
+		postClientReceipt(t, server, "203.0.113.7:4001", "kiosk-1", walgreensOn("2022-01-04"))
+		postClientReceipt(t, server, "203.0.113.7:4002", "kiosk-2", walgreensOn("2022-01-06"))
+		third := postClientReceipt(t, server, "203.0.113.7:4003", "kiosk-3", walgreensOn("2022-01-08"))
+		other := postClientReceipt(t, server, "198.51.100.2:4001", "kiosk-1", walgreensOn("2022-01-10"))
+
+		assertRisk(t, server, third, velocityRisk)
+		assertRisk(t, server, other, 0)
+	})
+
+	t.Run("forgets submitters once their window is empty", func(t *testing.T) {
+		clock := &fakeClock{current: time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC)}
+		detector := NewFraudDetector(FraudPolicy{MaxSubmissions: 2, WindowMinutes: 10})
+		detector.now = clock.now
+		assess := func(from int) {
+			for i := range 100 {
+				ctx := WithSubmitter(context.Background(), Submitter{Address: fmt.Sprintf("client-%d", from+i)})
+				detector.Assess(ctx, ReceiptScore{Receipt: Receipt{Total: "1.00"}})
+			}
+		}
+		assess(0)
+		clock.advance(time.Hour)
+		assess(100)
+
+		if len(detector.submissions) != 100 {
+			t.Errorf("expected only the 100 recent submitters to be kept but got %d", len(detector.submissions))
+		}
+	})
+
+	t.Run("scores repeated totals from a member", func(t *testing.T) {
+		server := newServer(FraudPolicy{MaxRepeatedTotals: 2, RepeatedTotalsDays: 7})
+		first := postMemberReceipt(t, server, "alice", walgreensOn("2022-01-04"))
+		second := postMemberReceipt(t, server, "alice", walgreensOn("2022-01-06"))
+
+		assertRisk(t, server, first, 0)
+		assertRisk(t, server, second, repeatedTotalRisk)
+	})
+
+	t.Run("refuses receipts at the blocking threshold", func(t *testing.T) {
+		server := newServer(FraudPolicy{BlockAt: 25})
+		response := httptest.NewRecorder()
+		server.ServeHTTP(response, newPostReceiptRequest(cornerMarketReceipt))
+		assertResponseCode(t, response.Code, http.StatusForbidden)
+		assertResponseBody(t, response.Body.String(), blockedMessage+"\n")
+
+		response = postBatch(t, server, "", jsonContentType, "["+cornerMarketReceipt+","+walgreensReceipt+"]")
+		batch := decodeBatch(t, response)
+		assertBatchError(t, batch.Results[0], "blocked")
+		assertBatchPoints(t, batch.Results[1], 15)
+	})
+
+	t.Run("holds risky receipts for review", func(t *testing.T) {
+		server := newServer(FraudPolicy{}, WithReviews(NewReviewQueue(ReviewPolicy{RiskScore: 20})))
+		corner := postReceipt(t, server, cornerMarketReceipt)
+
+		assertPointsStatus(t, server, corner, Points{0, ReceiptPendingReview})
+	})
+}
+
+func postClientReceipt(t testing.TB, server http.Handler, address, client, body string) ID {
+	t.Helper()
+	request, _ := http.NewRequest(http.MethodPost, "/receipts/process", strings.NewReader(body))
+	request.RemoteAddr = address
+	request.Header.Set(clientIDHeader, client)
+	response := httptest.NewRecorder()
+	server.ServeHTTP(response, request)
+	assertResponseCode(t, response.Code, http.StatusOK)
+	return decodeID(t, response)
+}
+
+func assertRisk(t testing.TB, server http.Handler, id ID, want int) {
+	t.Helper()
+	response := httptest.NewRecorder()
+	server.ServeHTTP(response, newGetReceiptRequest(id.Id))
+	details := decodeDetails(t, response)
+	if details.Risk == nil || details.Risk.Score != want {
+		t.Errorf("expected a risk score of %d but got %+v", want, details.Risk)
+	}
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"bytes"
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const idempotencyKeyHeader = "Idempotency-Key"
+const idempotencyMismatchMessage = "That Idempotency-Key was already used with a different request."
+const DefaultIdempotencyWindow = 24 * time.Hour
+
+type idempotentResponse struct {
+	key         string
+	requestHash string
+	// closed once the first request with this key has finished
+	done        chan struct{}
+	completed   bool
+	status      int
+	contentType string
+	body        []byte
+	expiresAt   time.Time
+}
+
+// used to remember responses by Idempotency-Key so that retried requests are
+// replayed rather than processed again
+type IdempotencyStore struct {
+	window    time.Duration
+	now       func() time.Time
+	mu        sync.Mutex
+	responses map[string]*idempotentResponse
+	// completed responses in the order they expire
+	expiry *list.List
+}
+
+func NewIdempotencyStore(window time.Duration) *IdempotencyStore {
+	return &IdempotencyStore{
+		window:    window,
+		now:       time.Now,
+		responses: make(map[string]*idempotentResponse),
+		expiry:    list.New(),
+	}
+}
+
+// returns the response recorded for key, or registers a new in-flight one
+// when started is true
+func (s *IdempotencyStore) begin(key, requestHash string) (response *idempotentResponse, started bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.prune()
+	if response, ok := s.responses[key]; ok {
+		return response, false
+	}
+	response = &idempotentResponse{key: key, requestHash: requestHash, done: make(chan struct{})}
+	s.responses[key] = response
+	return response, true
+}
+
+// records the outcome of an in-flight response, or forgets it when the
+// outcome should not be replayed
+func (s *IdempotencyStore) finish(response *idempotentResponse, status int, contentType string, body []byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if status >= http.StatusInternalServerError {
+		delete(s.responses, response.key)
+	} else {
+		response.completed = true
+		response.status = status
+		response.contentType = contentType
+		response.body = body
+		response.expiresAt = s.now().Add(s.window)
+		s.expiry.PushBack(response)
+	}
+	close(response.done)
+}
+
+// callers must hold s.mu
+func (s *IdempotencyStore) prune() {
+	now := s.now()
+	for s.expiry.Len() > 0 {
+		front := s.expiry.Front()
+		response := front.Value.(*idempotentResponse)
+		if now.Before(response.expiresAt) {
+			return
+		}
+		s.expiry.Remove(front)
+		delete(s.responses, response.key)
+	}
+}
+
+// used to make a handler replay its first response for requests that repeat an
+// Idempotency-Key, serializing concurrent requests with the same key
+func (s *IdempotencyStore) Middleware(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		key := r.Header.Get(idempotencyKeyHeader)
+		if key == "" {
+			next(w, r)
+			return
+		}
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, badRequestMessage, http.StatusBadRequest)
+			log.Println(err)
+			return
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+		sum := sha256.Sum256(body)
+		requestHash := hex.EncodeToString(sum[:])
+		scopedKey := TenantFromContext(r.Context()) + " " + r.Method + " " + r.URL.Path + " " + key
+
+		for {
+			response, started := s.begin(scopedKey, requestHash)
+			if response.requestHash != requestHash {
+				http.Error(w, idempotencyMismatchMessage, http.StatusUnprocessableEntity)
+				return
+			}
+			if started {
+				recorder := &responseRecorder{ResponseWriter: w, status: http.StatusOK}
+				next(recorder, r)
+				s.finish(response, recorder.status, recorder.Header().Get("Content-Type"), recorder.body.Bytes())
+				return
+			}
+			select {
+			case <-response.done:
+			case <-r.Context().Done():
+				return
+			}
+			if !response.completed {
+				// the first attempt failed without a replayable response, so try again
+				continue
+			}
+			w.Header().Set("Content-Type", response.contentType)
+			w.Header().Set("Idempotent-Replayed", "true")
+			w.WriteHeader(response.status)
+			w.Write(response.body)
+			return
+		}
+	}
+}
+
+// used to capture a response while still writing it through to the client
+type responseRecorder struct {
+	http.ResponseWriter
+	status      int
+	wroteHeader bool
+	body        bytes.Buffer
+}
+
+func (r *responseRecorder) WriteHeader(status int) {
+	if !r.wroteHeader {
+		r.status = status
+		r.wroteHeader = true
+	}
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *responseRecorder) Write(b []byte) (int, error) {
+	r.wroteHeader = true
+	r.body.Write(b)
+	return r.ResponseWriter.Write(b)
+}
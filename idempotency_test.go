@@ -0,0 +1,89 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestIdempotencyKey(t *testing.T) {
+	t.Run("replays the first response for a retry", func(t *testing.T) {
+		server := NewReceiptServer(NewReceiptStore())
+		first := postIdempotentReceipt(t, server, "key-1", walgreensReceipt)
+		assertResponseCode(t, first.Code, http.StatusOK)
+
+		retry := postIdempotentReceipt(t, server, "key-1", walgreensReceipt)
+		assertResponseCode(t, retry.Code, http.StatusOK)
+		if retry.Header().Get("Idempotent-Replayed") != "true" {
+			t.Errorf("expected the retry to be marked as replayed")
+		}
+		assertSameID(t, first, retry)
+	})
+
+	t.Run("rejects a retry with a different body", func(t *testing.T) {
+		server := NewReceiptServer(NewReceiptStore())
+		postIdempotentReceipt(t, server, "key-1", walgreensReceipt)
+
+		response := postIdempotentReceipt(t, server, "key-1", recasedWalgreensReceipt)
+
+		assertResponseCode(t, response.Code, http.StatusUnprocessableEntity)
+		assertResponseBody(t, response.Body.String(), idempotencyMismatchMessage+"\n")
+	})
+
+	t.Run("serializes concurrent requests with the same key", func(t *testing.T) {
+		server := NewReceiptServer(NewReceiptStore())
+		responses := make([]*httptest.ResponseRecorder, 10)
+		var wg sync.WaitGroup
+		for i := range responses {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				responses[i] = postIdempotentReceipt(t, server, "key-1", walgreensReceipt)
+			}()
+		}
+		wg.Wait()
+
+		for _, response := range responses {
+			assertResponseCode(t, response.Code, http.StatusOK)
+			assertSameID(t, responses[0], response)
+		}
+	})
+
+	t.Run("forgets responses once the window has passed", func(t *testing.T) {
+		clock := &fakeClock{current: time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)}
+		server := NewReceiptServer(NewReceiptStore(), WithIdempotencyWindow(time.Hour))
+		server.idempotency.now = clock.now
+		postIdempotentReceipt(t, server, "key-1", walgreensReceipt)
+
+		clock.advance(time.Hour)
+		response := postIdempotentReceipt(t, server, "key-1", recasedWalgreensReceipt)
+
+		assertResponseCode(t, response.Code, http.StatusOK)
+	})
+}
+
+func postIdempotentReceipt(t testing.TB, server http.Handler, key, body string) *httptest.ResponseRecorder {
+	t.Helper()
+	request := newPostReceiptRequest(body)
+	request.Header.Set(idempotencyKeyHeader, key)
+	response := httptest.NewRecorder()
+	server.ServeHTTP(response, request)
+	return response
+}
+
+func assertSameID(t testing.TB, first, second *httptest.ResponseRecorder) {
+	t.Helper()
+	var firstID, secondID ID
+	if err := json.Unmarshal(first.Body.Bytes(), &firstID); err != nil {
+		t.Fatalf("Unable to parse response into ID. resp: %q, err: %v", first.Body, err)
+	}
+	if err := json.Unmarshal(second.Body.Bytes(), &secondID); err != nil {
+		t.Fatalf("Unable to parse response into ID. resp: %q, err: %v", second.Body, err)
+	}
+	if firstID.Id != secondID.Id {
+		t.Errorf("expected the same ID %v but got %v", firstID.Id, secondID.Id)
+	}
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"sort"
+	"strings"
+
+	"github.com/google/uuid"
+)
+
+// dates are compared as strings, which works because PurchaseDate is
+// validated as YYYY-MM-DD and so sorts lexically in chronological order
+type ReceiptQuery struct {
+	Retailer      string
+	PurchasedFrom string
+	PurchasedTo   string
+}
+
+// implemented by stores that can answer queries without scanning every receipt
+type ReceiptQuerier interface {
+	Query(ctx context.Context, query ReceiptQuery) ([]ReceiptScore, error)
+}
+
+func NormalizeRetailer(name string) string {
+	return strings.ToLower(strings.Join(strings.Fields(name), " "))
+}
+
+func (q ReceiptQuery) Matches(score ReceiptScore) bool {
+	if q.Retailer != "" && NormalizeRetailer(score.Receipt.Retailer) != NormalizeRetailer(q.Retailer) {
+		return false
+	}
+	if q.PurchasedFrom != "" && score.Receipt.PurchaseDate < q.PurchasedFrom {
+		return false
+	}
+	if q.PurchasedTo != "" && score.Receipt.PurchaseDate > q.PurchasedTo {
+		return false
+	}
+	return true
+}
+
+type dateEntry struct {
+	date string
+	id   uuid.UUID
+}
+
+func (e dateEntry) less(other dateEntry) bool {
+	if e.date != other.date {
+		return e.date < other.date
+	}
+	return bytes.Compare(e.id[:], other.id[:]) < 0
+}
+
+// used by InMemoryReceiptStore, which keeps it in step with receipts under its mutex
+type receiptIndex struct {
+	// maps each tenant and normalized retailer to its receipt IDs and their
+	// purchase dates
+	byRetailer map[string]map[uuid.UUID]string
+	byDate     []dateEntry
+}
+
+func newReceiptIndex() *receiptIndex {
+	return &receiptIndex{byRetailer: make(map[string]map[uuid.UUID]string)}
+}
+
+func retailerKey(tenant, retailer string) string {
+	return tenant + "\x00" + NormalizeRetailer(retailer)
+}
+
+func (x *receiptIndex) add(score ReceiptScore) {
+	retailer := retailerKey(score.Tenant, score.Receipt.Retailer)
+	ids, ok := x.byRetailer[retailer]
+	if !ok {
+		ids = make(map[uuid.UUID]string)
+		x.byRetailer[retailer] = ids
+	}
+	ids[score.Id] = score.Receipt.PurchaseDate
+
+	entry := dateEntry{score.Receipt.PurchaseDate, score.Id}
+	position := sort.Search(len(x.byDate), func(i int) bool { return !x.byDate[i].less(entry) })
+	x.byDate = append(x.byDate, dateEntry{})
+	copy(x.byDate[position+1:], x.byDate[position:])
+	x.byDate[position] = entry
+}
+
+func (x *receiptIndex) remove(score ReceiptScore) {
+	retailer := retailerKey(score.Tenant, score.Receipt.Retailer)
+	if ids, ok := x.byRetailer[retailer]; ok {
+		delete(ids, score.Id)
+		if len(ids) == 0 {
+			delete(x.byRetailer, retailer)
+		}
+	}
+
+	entry := dateEntry{score.Receipt.PurchaseDate, score.Id}
+	position := sort.Search(len(x.byDate), func(i int) bool { return !x.byDate[i].less(entry) })
+	if position < len(x.byDate) && x.byDate[position] == entry {
+		x.byDate = append(x.byDate[:position], x.byDate[position+1:]...)
+	}
+}
+
+// returns the half-open range of byDate that falls within the query's dates
+func (x *receiptIndex) dateRange(query ReceiptQuery) (int, int) {
+	start, end := 0, len(x.byDate)
+	if query.PurchasedFrom != "" {
+		start = sort.Search(len(x.byDate), func(i int) bool { return x.byDate[i].date >= query.PurchasedFrom })
+	}
+	if query.PurchasedTo != "" {
+		end = sort.Search(len(x.byDate), func(i int) bool { return x.byDate[i].date > query.PurchasedTo })
+	}
+	return start, max(start, end)
+}
+
+// returns the candidate IDs for a query from whichever index is narrower,
+// ordered by purchase date; candidates from the date index may belong to
+// other tenants
+func (x *receiptIndex) candidates(tenant string, query ReceiptQuery) []uuid.UUID {
+	start, end := x.dateRange(query)
+	if query.Retailer != "" {
+		ids := x.byRetailer[retailerKey(tenant, query.Retailer)]
+		if len(ids) < end-start {
+			entries := make([]dateEntry, 0, len(ids))
+			for id, date := range ids {
+				entries = append(entries, dateEntry{date, id})
+			}
+			sort.Slice(entries, func(i, j int) bool { return entries[i].less(entries[j]) })
+			candidates := make([]uuid.UUID, 0, len(entries))
+			for _, entry := range entries {
+				candidates = append(candidates, entry.id)
+			}
+			return candidates
+		}
+	}
+	candidates := make([]uuid.UUID, 0, end-start)
+	for _, entry := range x.byDate[start:end] {
+		candidates = append(candidates, entry.id)
+	}
+	return candidates
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"testing"
+
+	"github.com/google/uuid"
+)
+
+func TestReceiptQueries(t *testing.T) {
+	ctx := context.Background()
+	store := NewReceiptStore()
+	save := func(retailer, date string) uuid.UUID {
+		id := uuid.New()
+		assertNoError(t, store.Save(ctx, ReceiptScore{Id: id, Receipt: Receipt{Retailer: retailer, PurchaseDate: date}}))
+		return id
+	}
+	marchTarget := save("Target", "2022-03-20")
+	save("Walgreens", "2022-03-02")
+	save("  target ", "2022-04-01")
+	earlyMarchTarget := save("TARGET", "2022-03-01")
+
+	t.Run("finds receipts by normalized retailer and date range", func(t *testing.T) {
+		scores, err := store.Query(ctx, ReceiptQuery{Retailer: "target", PurchasedFrom: "2022-03-01", PurchasedTo: "2022-03-31"})
+		assertNoError(t, err)
+		assertIDs(t, scores, earlyMarchTarget, marchTarget)
+	})
+
+	t.Run("finds receipts by date range alone", func(t *testing.T) {
+		scores, err := store.Query(ctx, ReceiptQuery{PurchasedFrom: "2022-03-02", PurchasedTo: "2022-03-31"})
+		assertNoError(t, err)
+		if len(scores) != 2 {
+			t.Errorf("expected 2 receipts but got %d", len(scores))
+		}
+	})
+
+	t.Run("reflects overwrites and deletes", func(t *testing.T) {
+		assertNoError(t, store.Save(ctx, ReceiptScore{Id: marchTarget, Receipt: Receipt{Retailer: "Walgreens", PurchaseDate: "2022-03-20"}}))
+		assertNoError(t, store.Delete(ctx, earlyMarchTarget))
+
+		scores, err := store.Query(ctx, ReceiptQuery{Retailer: "Target", PurchasedTo: "2022-03-31"})
+		assertNoError(t, err)
+		assertIDs(t, scores)
+	})
+}
+
+func TestReceiptIndexUnderConcurrentWrites(t *testing.T) {
+	ctx := context.Background()
+	store := NewReceiptStore()
+	var wg sync.WaitGroup
+	for n := range 50 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			id := uuid.New()
+			score := ReceiptScore{Id: id, Receipt: Receipt{Retailer: "Target", PurchaseDate: "2022-03-15"}}
+			if err := store.Save(ctx, score); err != nil {
+				t.Errorf("save failed: %v", err)
+			}
+			if n%2 == 0 {
+				if err := store.Delete(ctx, id); err != nil {
+					t.Errorf("delete failed: %v", err)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	scores, err := store.Query(ctx, ReceiptQuery{Retailer: "target"})
+	assertNoError(t, err)
+	assertExpectedPoints(t, len(scores), 25)
+	assertExpectedPoints(t, len(store.index.byDate), 25)
+}
+
+func assertIDs(t testing.TB, scores []ReceiptScore, want ...uuid.UUID) {
+	t.Helper()
+	if len(scores) != len(want) {
+		t.Fatalf("expected %d receipts but got %d", len(want), len(scores))
+	}
+	for i, score := range scores {
+		if score.Id != want[i] {
+			t.Errorf("expected receipt %d to be %v but got %v", i, want[i], score.Id)
+		}
+	}
+}
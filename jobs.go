@@ -0,0 +1,227 @@
+package main
+
+import (
+	"bytes"
+	"container/list"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+const jobNotFoundMessage = "No job found for that ID."
+const queueFullMessage = "Too many receipts are waiting to be processed, try again shortly."
+const queueFullRetryAfter = "1"
+
+const DefaultJobWorkers = 4
+const DefaultJobQueueDepth = 1000
+
+// how long finished jobs can still be polled
+const DefaultJobRetention = time.Hour
+
+var ErrJobNotFound = errors.New("job not found")
+var ErrQueueFull = errors.New("job queue is full")
+var ErrQueueClosed = errors.New("job queue is shut down")
+
+type JobStatus string
+
+const (
+	JobPending JobStatus = "pending"
+	JobDone    JobStatus = "done"
+	JobFailed  JobStatus = "failed"
+)
+
+// used to encode the response to GET /jobs/{id}
+type Job struct {
+	Id          uuid.UUID   `json:"id"`
+	Status      JobStatus   `json:"status"`
+	ReceiptID   *uuid.UUID  `json:"receiptId,omitempty"`
+	Points      *int        `json:"points,omitempty"`
+	Error       *BatchError `json:"error,omitempty"`
+	SubmittedAt time.Time   `json:"submittedAt"`
+	FinishedAt  *time.Time  `json:"finishedAt,omitempty"`
+	tenant      string
+}
+
+type jobTask struct {
+	id  uuid.UUID
+	ctx context.Context
+	run func(context.Context) (ReceiptScore, error)
+}
+
+// used to process submissions on a bounded pool of workers, rejecting new jobs
+// rather than queueing without limit
+type JobQueue struct {
+	workers   int
+	tasks     chan jobTask
+	retention time.Duration
+	now       func() time.Time
+	start     sync.Once
+	running   sync.WaitGroup
+	mu        sync.Mutex
+	jobs      map[uuid.UUID]*Job
+	// finished jobs in the order they finished
+	finished *list.List
+	closed   bool
+}
+
+func NewJobQueue(workers, depth int) *JobQueue {
+	return &JobQueue{
+		workers:   max(workers, 1),
+		tasks:     make(chan jobTask, max(depth, 1)),
+		retention: DefaultJobRetention,
+		now:       time.Now,
+		jobs:      make(map[uuid.UUID]*Job),
+		finished:  list.New(),
+	}
+}
+
+// queues run as a new job for the tenant on ctx; ctx stays in use after the
+// request that submitted the job has finished, so it must not be cancelled with it
+func (q *JobQueue) Submit(ctx context.Context, run func(context.Context) (ReceiptScore, error)) (Job, error) {
+	q.start.Do(func() {
+		for range q.workers {
+			q.running.Add(1)
+			go q.work()
+		}
+	})
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.closed {
+		return Job{}, ErrQueueClosed
+	}
+	q.prune()
+	job := &Job{Id: uuid.New(), Status: JobPending, SubmittedAt: q.now(), tenant: TenantFromContext(ctx)}
+	select {
+	case q.tasks <- jobTask{id: job.Id, ctx: ctx, run: run}:
+	default:
+		return Job{}, ErrQueueFull
+	}
+	q.jobs[job.Id] = job
+	return *job, nil
+}
+
+func (q *JobQueue) Get(ctx context.Context, id uuid.UUID) (Job, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	job, ok := q.jobs[id]
+	if !ok || job.tenant != TenantFromContext(ctx) {
+		return Job{}, ErrJobNotFound
+	}
+	return *job, nil
+}
+
+// stops accepting jobs and waits until those already queued have finished or
+// ctx is done
+func (q *JobQueue) Close(ctx context.Context) error {
+	q.mu.Lock()
+	if !q.closed {
+		q.closed = true
+		close(q.tasks)
+	}
+	q.mu.Unlock()
+
+	drained := make(chan struct{})
+	go func() {
+		q.running.Wait()
+		close(drained)
+	}()
+	select {
+	case <-drained:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (q *JobQueue) work() {
+	defer q.running.Done()
+	for task := range q.tasks {
+		score, err := task.run(task.ctx)
+		q.finish(task.id, score, err)
+	}
+}
+
+func (q *JobQueue) finish(id uuid.UUID, score ReceiptScore, err error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	job := q.jobs[id]
+	finishedAt := q.now()
+	job.FinishedAt = &finishedAt
+	if err != nil {
+		log.Println(err)
+		job.Status = JobFailed
+		job.Error = newBatchError(err)
+	} else {
+		points := score.Points
+		job.Status = JobDone
+		job.ReceiptID = &score.Id
+		job.Points = &points
+	}
+	q.finished.PushBack(job)
+}
+
+// callers must hold q.mu
+func (q *JobQueue) prune() {
+	now := q.now()
+	for q.finished.Len() > 0 {
+		front := q.finished.Front()
+		job := front.Value.(*Job)
+		if now.Before(job.FinishedAt.Add(q.retention)) {
+			return
+		}
+		q.finished.Remove(front)
+		delete(q.jobs, job.Id)
+	}
+}
+
+// queues a submitted receipt to be processed by the job queue and responds
+// with 202 and the job to poll
+func (rs *ReceiptServer) enqueueReceipt(w http.ResponseWriter, r *http.Request) {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, badRequestMessage, http.StatusBadRequest)
+		log.Println(err)
+		return
+	}
+	actor, memberID := actorFromRequest(r), r.URL.Query().Get(memberIDParam)
+	job, err := rs.jobs.Submit(context.WithoutCancel(r.Context()), func(ctx context.Context) (ReceiptScore, error) {
+		return rs.ingest(ctx, bytes.NewReader(body), actor, memberID)
+	})
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", jsonContentType)
+	w.Header().Set("Location", "/jobs/"+job.Id.String())
+	w.WriteHeader(http.StatusAccepted)
+	if err := json.NewEncoder(w).Encode(job); err != nil {
+		log.Println(err)
+	}
+}
+
+func (rs *ReceiptServer) getJob(w http.ResponseWriter, r *http.Request) {
+	id, err := uuid.Parse(r.PathValue("id"))
+	if err != nil {
+		http.Error(w, jobNotFoundMessage, http.StatusNotFound)
+		log.Println(err)
+		return
+	}
+	job, err := rs.jobs.Get(r.Context(), id)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", jsonContentType)
+	if err := json.NewEncoder(w).Encode(job); err != nil {
+		log.Println(err)
+	}
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/google/uuid"
+)
+
+func TestAsyncSubmission(t *testing.T) {
+	t.Run("processes a receipt in the background", func(t *testing.T) {
+		server := NewReceiptServer(NewReceiptStore())
+		pending := postAsyncReceipt(t, server, walgreensReceipt)
+		if pending.Status != JobPending {
+			t.Errorf("expected a pending job but got %q", pending.Status)
+		}
+
+		assertNoError(t, server.Shutdown(context.Background()))
+
+		job := getJob(t, server, pending.Id)
+		if job.Status != JobDone || job.ReceiptID == nil {
+			t.Fatalf("expected a finished job but got %+v", job)
+		}
+		response := httptest.NewRecorder()
+		server.ServeHTTP(response, newGetPointsRequest(*job.ReceiptID))
+		assertPointTotalInResponse(t, response, 15)
+	})
+
+	t.Run("reports an invalid receipt as a failed job", func(t *testing.T) {
+		server := NewReceiptServer(NewReceiptStore())
+		pending := postAsyncReceipt(t, server, `{"retailer": "Target"}`)
+
+		assertNoError(t, server.Shutdown(context.Background()))
+
+		job := getJob(t, server, pending.Id)
+		if job.Status != JobFailed || job.Error == nil || job.Error.Code != "invalid_receipt" {
+			t.Errorf("expected a failed job but got %+v", job)
+		}
+	})
+
+	t.Run("hides jobs from other tenants", func(t *testing.T) {
+		server := NewReceiptServer(NewReceiptStore())
+		pending := postAsyncReceipt(t, server, walgreensReceipt)
+
+		request, _ := http.NewRequest(http.MethodGet, "/jobs/"+pending.Id.String(), nil)
+		request.Header.Set(tenantHeader, "globex")
+		response := httptest.NewRecorder()
+		server.ServeHTTP(response, request)
+
+		assertResponseCode(t, response.Code, http.StatusNotFound)
+	})
+
+	t.Run("rejects submissions once shut down", func(t *testing.T) {
+		server := NewReceiptServer(NewReceiptStore())
+		assertNoError(t, server.Shutdown(context.Background()))
+
+		response := httptest.NewRecorder()
+		server.ServeHTTP(response, newAsyncReceiptRequest(walgreensReceipt))
+
+		assertResponseCode(t, response.Code, http.StatusServiceUnavailable)
+	})
+}
+
+func TestJobQueue(t *testing.T) {
+	t.Run("applies backpressure when full", func(t *testing.T) {
+		queue := NewJobQueue(1, 1)
+		release := make(chan struct{})
+		started := make(chan struct{})
+		blocked := func(ctx context.Context) (ReceiptScore, error) {
+			started <- struct{}{}
+			<-release
+			return ReceiptScore{}, nil
+		}
+		ctx := context.Background()
+
+		_, err := queue.Submit(ctx, blocked)
+		assertNoError(t, err)
+		<-started
+		_, err = queue.Submit(ctx, blocked)
+		assertNoError(t, err)
+		_, err = queue.Submit(ctx, blocked)
+		assertErrorIs(t, err, ErrQueueFull)
+
+		close(release)
+		<-started
+		assertNoError(t, queue.Close(ctx))
+	})
+
+	t.Run("drains queued jobs on close", func(t *testing.T) {
+		queue := NewJobQueue(1, 10)
+		ctx := context.Background()
+		ids := []uuid.UUID{}
+		for range 5 {
+			job, err := queue.Submit(ctx, func(ctx context.Context) (ReceiptScore, error) {
+				return ReceiptScore{Id: uuid.New(), Points: 1}, nil
+			})
+			assertNoError(t, err)
+			ids = append(ids, job.Id)
+		}
+
+		assertNoError(t, queue.Close(ctx))
+
+		for _, id := range ids {
+			job, err := queue.Get(ctx, id)
+			assertNoError(t, err)
+			if job.Status != JobDone {
+				t.Errorf("expected job %v to be done but it is %q", id, job.Status)
+			}
+		}
+	})
+}
+
+func newAsyncReceiptRequest(receipt string) *http.Request {
+	request := newPostReceiptRequest(receipt)
+	request.URL.RawQuery = "async=true"
+	return request
+}
+
+func postAsyncReceipt(t testing.TB, server http.Handler, body string) Job {
+	t.Helper()
+	response := httptest.NewRecorder()
+	server.ServeHTTP(response, newAsyncReceiptRequest(body))
+	assertResponseCode(t, response.Code, http.StatusAccepted)
+	var job Job
+	err := json.NewDecoder(response.Body).Decode(&job)
+	checkDecodeErr(t, response, err)
+	return job
+}
+
+func getJob(t testing.TB, server http.Handler, id uuid.UUID) Job {
+	t.Helper()
+	request, _ := http.NewRequest(http.MethodGet, "/jobs/"+id.String(), nil)
+	response := httptest.NewRecorder()
+	server.ServeHTTP(response, request)
+	assertResponseCode(t, response.Code, http.StatusOK)
+	var job Job
+	err := json.NewDecoder(response.Body).Decode(&job)
+	checkDecodeErr(t, response, err)
+	return job
+}
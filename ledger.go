@@ -0,0 +1,330 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+const insufficientPointsMessage = "The member does not have enough points."
+const invalidRedemptionMessage = "A redemption must be for a positive number of points."
+
+var ErrInsufficientPoints = errors.New("insufficient points")
+var ErrInvalidRedemption = errors.New("invalid redemption")
+
+// the accounts points move between besides each member's own
+const (
+	issuedAccount     = "points:issued"
+	redeemedAccount   = "points:redeemed"
+	expiredAccount    = "points:expired"
+	writtenOffAccount = "points:written-off"
+)
+
+func memberAccount(id string) string {
+	return "member:" + id
+}
+
+type TransactionType string
+
+const (
+	TransactionEarned   TransactionType = "earned"
+	TransactionAdjusted TransactionType = "adjusted"
+	TransactionReversed TransactionType = "reversed"
+	TransactionRedeemed TransactionType = "redeemed"
+	TransactionExpired  TransactionType = "expired"
+	TransactionBonus    TransactionType = "bonus"
+)
+
+type Posting struct {
+	Account string `json:"account"`
+	Amount  int    `json:"amount"`
+}
+
+// an immutable movement of points whose postings always add up to zero
+type LedgerTransaction struct {
+	Id        uuid.UUID       `json:"id"`
+	Sequence  int             `json:"sequence"`
+	Type      TransactionType `json:"type"`
+	At        time.Time       `json:"at"`
+	MemberID  string          `json:"memberId"`
+	ReceiptID *uuid.UUID      `json:"receiptId,omitempty"`
+	Reason    string          `json:"reason,omitempty"`
+	Postings  []Posting       `json:"postings"`
+}
+
+// used to record every movement of points as balanced postings between
+// accounts; it is guarded by the MemberRegistry that owns it
+type Ledger struct {
+	// every transaction by tenant, in the order they were posted
+	transactions map[string][]LedgerTransaction
+	// by tenant and account
+	balances map[string]int
+	// positions in transactions by tenant and member
+	byMember map[string][]int
+	// the points issued for each receipt, net of corrections and reversals
+	issued map[uuid.UUID]int
+	// the points making up each member's balance by the receipt that earned
+	// them, by tenant and member
+	lots          map[string]*memberLots
+	lotsByReceipt map[uuid.UUID]*pointsLot
+}
+
+func NewLedger() *Ledger {
+	return &Ledger{
+		transactions:  make(map[string][]LedgerTransaction),
+		balances:      make(map[string]int),
+		byMember:      make(map[string][]int),
+		issued:        make(map[uuid.UUID]int),
+		lots:          make(map[string]*memberLots),
+		lotsByReceipt: make(map[uuid.UUID]*pointsLot),
+	}
+}
+
+func (l *Ledger) post(tenant string, transaction LedgerTransaction) LedgerTransaction {
+	transaction.Id = uuid.New()
+	transaction.Sequence = len(l.transactions[tenant]) + 1
+	for _, posting := range transaction.Postings {
+		l.balances[memberKey(tenant, posting.Account)] += posting.Amount
+		if posting.Account == issuedAccount && transaction.ReceiptID != nil {
+			l.issued[*transaction.ReceiptID] -= posting.Amount
+		}
+	}
+	key := memberKey(tenant, transaction.MemberID)
+	l.byMember[key] = append(l.byMember[key], len(l.transactions[tenant]))
+	l.transactions[tenant] = append(l.transactions[tenant], transaction)
+	return transaction
+}
+
+func (l *Ledger) balance(tenant, account string) int {
+	return l.balances[memberKey(tenant, account)]
+}
+
+// moves points for a receipt between the issued account and the member's
+func (l *Ledger) credit(tenant, memberID string, receiptID uuid.UUID, kind TransactionType, points int, reason string, at, expiresAt time.Time) {
+	if points == 0 {
+		return
+	}
+	if points > 0 {
+		l.lot(tenant, memberID, receiptID, expiresAt).remaining += points
+		l.post(tenant, LedgerTransaction{Type: kind, At: at, MemberID: memberID, ReceiptID: &receiptID, Reason: reason, Postings: []Posting{
+			{Account: issuedAccount, Amount: -points},
+			{Account: memberAccount(memberID), Amount: points},
+		}})
+		return
+	}
+	l.post(tenant, LedgerTransaction{Type: kind, At: at, MemberID: memberID, ReceiptID: &receiptID, Reason: reason, Postings: l.takeBack(tenant, memberID, receiptID, issuedAccount, -points)})
+}
+
+// returns the postings that move points from the member back to the account
+// they came from. They come from what is left of the lot they were credited
+// to, then from what expired of it, then from the member's other points;
+// whatever the member has already redeemed beyond that is written off rather
+// than overdrawing them
+func (l *Ledger) takeBack(tenant, memberID string, lotID uuid.UUID, source string, points int) []Posting {
+	outstanding := points
+	postings := []Posting{{Account: source, Amount: outstanding}}
+	fromMember := 0
+	if lot, ok := l.lotsByReceipt[lotID]; ok {
+		own := min(outstanding, lot.remaining)
+		lot.remaining -= own
+		fromMember += own
+		outstanding -= own
+
+		expired := min(outstanding, lot.expired)
+		lot.expired -= expired
+		outstanding -= expired
+		if expired > 0 {
+			postings = append(postings, Posting{Account: expiredAccount, Amount: -expired})
+		}
+	}
+	other := l.consume(tenant, memberID, outstanding)
+	fromMember += other
+	outstanding -= other
+	if fromMember > 0 {
+		postings = append(postings, Posting{Account: memberAccount(memberID), Amount: -fromMember})
+	}
+	if outstanding > 0 {
+		postings = append(postings, Posting{Account: writtenOffAccount, Amount: -outstanding})
+	}
+	return postings
+}
+
+// used to decode the body of POST /members/{id}/redemptions
+type RedemptionRequest struct {
+	Points int    `json:"points"`
+	Reason string `json:"reason"`
+}
+
+// debits points from a member, failing rather than letting their balance go
+// below zero
+func (m *MemberRegistry) Redeem(ctx context.Context, memberID string, redemption RedemptionRequest) (LedgerTransaction, error) {
+	if redemption.Points <= 0 {
+		return LedgerTransaction{}, ErrInvalidRedemption
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	tenant := TenantFromContext(ctx)
+	if _, ok := m.members[memberKey(tenant, memberID)]; !ok {
+		return LedgerTransaction{}, ErrMemberNotFound
+	}
+	account := memberAccount(memberID)
+	m.ledger.expire(tenant, memberID, m.now())
+	if available := m.ledger.balance(tenant, account); available < redemption.Points {
+		return LedgerTransaction{}, fmt.Errorf("%w: %d available, %d requested", ErrInsufficientPoints, available, redemption.Points)
+	}
+	m.ledger.consume(tenant, memberID, redemption.Points)
+	return m.ledger.post(tenant, LedgerTransaction{
+		Type:     TransactionRedeemed,
+		At:       m.now(),
+		MemberID: memberID,
+		Reason:   redemption.Reason,
+		Postings: []Posting{{Account: account, Amount: -redemption.Points}, {Account: redeemedAccount, Amount: redemption.Points}},
+	}), nil
+}
+
+// returns the member's transactions, oldest first
+func (m *MemberRegistry) Transactions(ctx context.Context, memberID string) ([]LedgerTransaction, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	tenant := TenantFromContext(ctx)
+	if _, ok := m.members[memberKey(tenant, memberID)]; !ok {
+		return nil, ErrMemberNotFound
+	}
+	m.ledger.expire(tenant, memberID, m.now())
+	transactions := []LedgerTransaction{}
+	for _, i := range m.ledger.byMember[memberKey(tenant, memberID)] {
+		transactions = append(transactions, m.ledger.transactions[tenant][i])
+	}
+	return transactions, nil
+}
+
+// used to encode the response to GET /admin/reconcile
+type Reconciliation struct {
+	Receipts         int                      `json:"receipts"`
+	Transactions     int                      `json:"transactions"`
+	Balanced         bool                     `json:"balanced"`
+	Mismatches       []ReconciliationMismatch `json:"mismatches"`
+	Unbalanced       []uuid.UUID              `json:"unbalancedTransactions"`
+	NegativeBalances []string                 `json:"negativeBalances"`
+}
+
+type ReconciliationMismatch struct {
+	ReceiptID    uuid.UUID `json:"receiptId"`
+	StoredPoints int       `json:"storedPoints"`
+	LedgerPoints int       `json:"ledgerPoints"`
+}
+
+// checks the tenant's ledger against the stored receipts: every receipt's
+// points must have been issued to its member exactly once, every transaction
+// must balance and no member may be overdrawn
+func (m *MemberRegistry) Reconcile(ctx context.Context, scores []ReceiptScore) Reconciliation {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	tenant := TenantFromContext(ctx)
+	reconciliation := Reconciliation{
+		Transactions:     len(m.ledger.transactions[tenant]),
+		Mismatches:       []ReconciliationMismatch{},
+		Unbalanced:       []uuid.UUID{},
+		NegativeBalances: []string{},
+	}
+
+	stored := make(map[uuid.UUID]int)
+	for _, score := range scores {
+		if score.MemberID == "" {
+			continue
+		}
+		reconciliation.Receipts++
+		stored[score.Id] = score.Points
+	}
+	receipts := make(map[uuid.UUID]bool)
+	for _, transaction := range m.ledger.transactions[tenant] {
+		sum := 0
+		for _, posting := range transaction.Postings {
+			sum += posting.Amount
+		}
+		if sum != 0 {
+			reconciliation.Unbalanced = append(reconciliation.Unbalanced, transaction.Id)
+		}
+		if transaction.ReceiptID != nil {
+			receipts[*transaction.ReceiptID] = true
+		}
+	}
+	for id := range stored {
+		receipts[id] = true
+	}
+	for id, contribution := range m.contributions {
+		if contribution.evicted && contribution.tenant == tenant {
+			if _, ok := stored[id]; !ok {
+				stored[id] = contribution.points
+			}
+		}
+	}
+	for id := range receipts {
+		if stored[id] != m.ledger.issued[id] {
+			reconciliation.Mismatches = append(reconciliation.Mismatches, ReconciliationMismatch{ReceiptID: id, StoredPoints: stored[id], LedgerPoints: m.ledger.issued[id]})
+		}
+	}
+	for key, member := range m.members {
+		if key == memberKey(tenant, member.Id) && m.ledger.balance(tenant, memberAccount(member.Id)) < 0 {
+			reconciliation.NegativeBalances = append(reconciliation.NegativeBalances, member.Id)
+		}
+	}
+	reconciliation.Balanced = len(reconciliation.Mismatches) == 0 && len(reconciliation.Unbalanced) == 0 && len(reconciliation.NegativeBalances) == 0
+	return reconciliation
+}
+
+func (rs *ReceiptServer) redeemPoints(w http.ResponseWriter, r *http.Request) {
+	var redemption RedemptionRequest
+	if err := json.NewDecoder(r.Body).Decode(&redemption); err != nil {
+		http.Error(w, invalidRedemptionMessage, http.StatusBadRequest)
+		log.Println(err)
+		return
+	}
+	transaction, err := rs.members.Redeem(r.Context(), r.PathValue("id"), redemption)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", jsonContentType)
+	w.WriteHeader(http.StatusCreated)
+	if err := json.NewEncoder(w).Encode(transaction); err != nil {
+		log.Println(err)
+	}
+}
+
+func (rs *ReceiptServer) getMemberLedger(w http.ResponseWriter, r *http.Request) {
+	transactions, err := rs.members.Transactions(r.Context(), r.PathValue("id"))
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", jsonContentType)
+	if err := json.NewEncoder(w).Encode(transactions); err != nil {
+		log.Println(err)
+	}
+}
+
+func (rs *ReceiptServer) reconcileLedger(w http.ResponseWriter, r *http.Request) {
+	// hold off commits so the receipts and the ledger are read at the same point
+	rs.commitMu.Lock()
+	scores, err := rs.store.List(r.Context())
+	var reconciliation Reconciliation
+	if err == nil {
+		reconciliation = rs.members.Reconcile(r.Context(), scores)
+	}
+	rs.commitMu.Unlock()
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", jsonContentType)
+	if err := json.NewEncoder(w).Encode(reconciliation); err != nil {
+		log.Println(err)
+	}
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestRedemptions(t *testing.T) {
+	t.Run("debits the member's balance", func(t *testing.T) {
+		server := NewReceiptServer(NewReceiptStore())
+		postMemberReceipt(t, server, "alice", cornerMarketReceipt)
+
+		response := redeem(server, "alice", `{"points": 100, "reason": "free coffee"}`)
+
+		assertResponseCode(t, response.Code, http.StatusCreated)
+		if member := getMember(t, server, "alice"); member.Balance != 9 {
+			t.Errorf("expected a balance of 9 but got %d", member.Balance)
+		}
+	})
+
+	t.Run("refuses to overdraw the balance", func(t *testing.T) {
+		server := NewReceiptServer(NewReceiptStore())
+		postMemberReceipt(t, server, "alice", walgreensReceipt)
+
+		response := redeem(server, "alice", `{"points": 16}`)
+
+		assertResponseCode(t, response.Code, http.StatusUnprocessableEntity)
+		assertResponseBody(t, response.Body.String(), insufficientPointsMessage+"\n")
+	})
+
+	t.Run("never goes negative under concurrent redemptions", func(t *testing.T) {
+		server := NewReceiptServer(NewReceiptStore())
+		postMemberReceipt(t, server, "alice", cornerMarketReceipt)
+
+		var wg sync.WaitGroup
+		var mu sync.Mutex
+		redeemed := 0
+		for range 20 {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				if redeem(server, "alice", `{"points": 10}`).Code == http.StatusCreated {
+					mu.Lock()
+					redeemed++
+					mu.Unlock()
+				}
+			}()
+		}
+		wg.Wait()
+
+		if redeemed != 10 {
+			t.Errorf("expected 10 redemptions to succeed but %d did", redeemed)
+		}
+		if member := getMember(t, server, "alice"); member.Balance != 9 {
+			t.Errorf("expected a balance of 9 but got %d", member.Balance)
+		}
+	})
+
+	t.Run("rejects a redemption for an unknown member", func(t *testing.T) {
+		server := NewReceiptServer(NewReceiptStore())
+		response := redeem(server, "bob", `{"points": 1}`)
+		assertResponseCode(t, response.Code, http.StatusNotFound)
+	})
+}
+
+func TestLedger(t *testing.T) {
+	server := NewReceiptServer(NewReceiptStore(), WithStaff(testAdmin))
+	walgreens := postMemberReceipt(t, server, "alice", walgreensReceipt)
+	corner := postMemberReceipt(t, server, "alice", cornerMarketReceipt)
+	assertResponseCode(t, redeem(server, "alice", `{"points": 120}`).Code, http.StatusCreated)
+	response := sendCorrection(server, http.MethodPatch, walgreens.Id, "", `{"retailer": "Walgreens Pharmacy"}`)
+	assertResponseCode(t, response.Code, http.StatusOK)
+	response = sendRequest(server, http.MethodDelete, "/receipts/"+corner.Id.String(), "")
+	assertResponseCode(t, response.Code, http.StatusNoContent)
+
+	t.Run("records compensating entries without overdrawing", func(t *testing.T) {
+		var transactions []LedgerTransaction
+		getJSON(t, server, "/members/alice/ledger", &transactions)
+		types := []TransactionType{}
+		for _, transaction := range transactions {
+			types = append(types, transaction.Type)
+		}
+		want := []TransactionType{TransactionEarned, TransactionEarned, TransactionRedeemed, TransactionAdjusted, TransactionReversed}
+		if len(types) != len(want) {
+			t.Fatalf("expected transactions %v but got %v", want, types)
+		}
+		for i := range want {
+			if types[i] != want[i] {
+				t.Fatalf("expected transactions %v but got %v", want, types)
+			}
+		}
+		if member := getMember(t, server, "alice"); member.Balance != 0 {
+			t.Errorf("expected the reversal to empty the balance but got %d", member.Balance)
+		}
+	})
+
+	t.Run("reconciles with the stored receipts", func(t *testing.T) {
+		var reconciliation Reconciliation
+		getAdminJSON(t, server, "/admin/reconcile", &reconciliation)
+		if !reconciliation.Balanced || reconciliation.Receipts != 1 || reconciliation.Transactions != 5 {
+			t.Errorf("expected a balanced ledger but got %+v", reconciliation)
+		}
+	})
+}
+
+func redeem(server http.Handler, member, body string) *httptest.ResponseRecorder {
+	request, _ := http.NewRequest(http.MethodPost, "/members/"+member+"/redemptions", strings.NewReader(body))
+	response := httptest.NewRecorder()
+	server.ServeHTTP(response, request)
+	return response
+}
@@ -0,0 +1,271 @@
+package main
+
+import (
+	"bytes"
+	"cmp"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+const defaultListLimit = 50
+const maxListLimit = 500
+
+var ErrInvalidListQuery = errors.New("invalid list query")
+
+// used to encode the response to GET /receipts
+type ReceiptList struct {
+	Receipts   []ReceiptDetails `json:"receipts"`
+	NextCursor string           `json:"nextCursor,omitempty"`
+}
+
+type ListOptions struct {
+	ReceiptQuery
+	MinPoints       *int
+	MaxPoints       *int
+	ProcessedAfter  time.Time
+	ProcessedBefore time.Time
+	Sort            listSort
+	Limit           int
+	Cursor          *listCursor
+}
+
+type listSort struct {
+	Field      string
+	Descending bool
+}
+
+var listSortFields = map[string]func(a, b ReceiptScore) int{
+	"processedAt": func(a, b ReceiptScore) int { return a.ProcessedAt.Compare(b.ProcessedAt) },
+	"purchaseDate": func(a, b ReceiptScore) int {
+		return cmp.Compare(a.Receipt.PurchaseDate+" "+a.Receipt.PurchaseTime, b.Receipt.PurchaseDate+" "+b.Receipt.PurchaseTime)
+	},
+	"points": func(a, b ReceiptScore) int { return cmp.Compare(a.Points, b.Points) },
+	"retailer": func(a, b ReceiptScore) int {
+		return cmp.Compare(NormalizeRetailer(a.Receipt.Retailer), NormalizeRetailer(b.Receipt.Retailer))
+	},
+}
+
+// orders receipts by the sort field with their IDs breaking ties, so that
+// every receipt has a fixed position a cursor can point at
+func (s listSort) compare(a, b ReceiptScore) int {
+	order := listSortFields[s.Field](a, b)
+	if order == 0 {
+		order = bytes.Compare(a.Id[:], b.Id[:])
+	}
+	if s.Descending {
+		return -order
+	}
+	return order
+}
+
+func (s listSort) String() string {
+	if s.Descending {
+		return "-" + s.Field
+	}
+	return s.Field
+}
+
+// the position after the last receipt of a page, tied to the sort and filters
+// it was issued for
+type listCursor struct {
+	Sort    string    `json:"s"`
+	Filters string    `json:"f"`
+	Last    cursorKey `json:"k"`
+}
+
+type cursorKey struct {
+	Id           uuid.UUID `json:"id"`
+	Points       int       `json:"p"`
+	ProcessedAt  time.Time `json:"t"`
+	Retailer     string    `json:"r"`
+	PurchaseDate string    `json:"d"`
+	PurchaseTime string    `json:"h"`
+}
+
+func newCursorKey(score ReceiptScore) cursorKey {
+	return cursorKey{
+		Id:           score.Id,
+		Points:       score.Points,
+		ProcessedAt:  score.ProcessedAt,
+		Retailer:     score.Receipt.Retailer,
+		PurchaseDate: score.Receipt.PurchaseDate,
+		PurchaseTime: score.Receipt.PurchaseTime,
+	}
+}
+
+func (k cursorKey) score() ReceiptScore {
+	return ReceiptScore{
+		Id:          k.Id,
+		Points:      k.Points,
+		ProcessedAt: k.ProcessedAt,
+		Receipt:     Receipt{Retailer: k.Retailer, PurchaseDate: k.PurchaseDate, PurchaseTime: k.PurchaseTime},
+	}
+}
+
+func encodeCursor(cursor listCursor) string {
+	data, _ := json.Marshal(cursor)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+func decodeCursor(value string) (*listCursor, error) {
+	data, err := base64.RawURLEncoding.DecodeString(value)
+	if err != nil {
+		return nil, err
+	}
+	var cursor listCursor
+	if err := json.Unmarshal(data, &cursor); err != nil {
+		return nil, err
+	}
+	return &cursor, nil
+}
+
+// a digest of every filter parameter, so a cursor cannot be reused with
+// different filters
+func filtersDigest(query url.Values) string {
+	filters := url.Values{}
+	for name, values := range query {
+		if name != "cursor" && name != "limit" {
+			filters[name] = values
+		}
+	}
+	sum := sha256.Sum256([]byte(filters.Encode()))
+	return hex.EncodeToString(sum[:8])
+}
+
+func ParseListOptions(query url.Values) (ListOptions, error) {
+	options := ListOptions{Sort: listSort{Field: "processedAt"}, Limit: defaultListLimit}
+	options.Retailer = query.Get("retailer")
+
+	for name, target := range map[string]*string{"purchasedFrom": &options.PurchasedFrom, "purchasedTo": &options.PurchasedTo} {
+		if value := query.Get(name); value != "" {
+			if _, err := time.Parse(time.DateOnly, value); err != nil {
+				return ListOptions{}, fmt.Errorf("%w: %s must be a date like 2022-03-01", ErrInvalidListQuery, name)
+			}
+			*target = value
+		}
+	}
+	for name, target := range map[string]**int{"minPoints": &options.MinPoints, "maxPoints": &options.MaxPoints} {
+		if value := query.Get(name); value != "" {
+			points, err := strconv.Atoi(value)
+			if err != nil {
+				return ListOptions{}, fmt.Errorf("%w: %s must be a whole number", ErrInvalidListQuery, name)
+			}
+			*target = &points
+		}
+	}
+	for name, target := range map[string]*time.Time{"processedAfter": &options.ProcessedAfter, "processedBefore": &options.ProcessedBefore} {
+		if value := query.Get(name); value != "" {
+			at, err := time.Parse(time.RFC3339, value)
+			if err != nil {
+				return ListOptions{}, fmt.Errorf("%w: %s must be an RFC 3339 time", ErrInvalidListQuery, name)
+			}
+			*target = at
+		}
+	}
+
+	if value := query.Get("sort"); value != "" {
+		field, descending := strings.CutPrefix(value, "-")
+		if _, ok := listSortFields[field]; !ok {
+			return ListOptions{}, fmt.Errorf("%w: unknown sort %q", ErrInvalidListQuery, value)
+		}
+		options.Sort = listSort{Field: field, Descending: descending}
+	}
+	if value := query.Get("limit"); value != "" {
+		limit, err := strconv.Atoi(value)
+		if err != nil || limit < 1 || limit > maxListLimit {
+			return ListOptions{}, fmt.Errorf("%w: limit must be between 1 and %d", ErrInvalidListQuery, maxListLimit)
+		}
+		options.Limit = limit
+	}
+	if value := query.Get("cursor"); value != "" {
+		cursor, err := decodeCursor(value)
+		if err != nil || cursor.Sort != options.Sort.String() || cursor.Filters != filtersDigest(query) {
+			return ListOptions{}, fmt.Errorf("%w: the cursor does not belong to this query", ErrInvalidListQuery)
+		}
+		options.Cursor = cursor
+	}
+	return options, nil
+}
+
+func (o ListOptions) Matches(score ReceiptScore) bool {
+	if !o.ReceiptQuery.Matches(score) {
+		return false
+	}
+	if o.MinPoints != nil && score.Points < *o.MinPoints {
+		return false
+	}
+	if o.MaxPoints != nil && score.Points > *o.MaxPoints {
+		return false
+	}
+	if !o.ProcessedAfter.IsZero() && score.ProcessedAt.Before(o.ProcessedAfter) {
+		return false
+	}
+	if !o.ProcessedBefore.IsZero() && !score.ProcessedAt.Before(o.ProcessedBefore) {
+		return false
+	}
+	return true
+}
+
+func (rs *ReceiptServer) listReceipts(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	options, err := ParseListOptions(query)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	var candidates []ReceiptScore
+	querier, indexed := rs.store.(ReceiptQuerier)
+	if indexed && options.ReceiptQuery != (ReceiptQuery{}) {
+		candidates, err = querier.Query(r.Context(), options.ReceiptQuery)
+	} else {
+		candidates, err = rs.store.List(r.Context())
+	}
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	matches := candidates[:0]
+	for _, score := range candidates {
+		if !options.Matches(score) {
+			continue
+		}
+		if options.Cursor != nil && options.Sort.compare(score, options.Cursor.Last.score()) <= 0 {
+			continue
+		}
+		matches = append(matches, score)
+	}
+	slices.SortFunc(matches, options.Sort.compare)
+
+	list := ReceiptList{Receipts: []ReceiptDetails{}}
+	if len(matches) > options.Limit {
+		matches = matches[:options.Limit]
+		list.NextCursor = encodeCursor(listCursor{
+			Sort:    options.Sort.String(),
+			Filters: filtersDigest(query),
+			Last:    newCursorKey(matches[len(matches)-1]),
+		})
+	}
+	for _, score := range matches {
+		list.Receipts = append(list.Receipts, newReceiptDetails(score))
+	}
+
+	w.Header().Set("Content-Type", jsonContentType)
+	if err := json.NewEncoder(w).Encode(list); err != nil {
+		log.Println(err)
+	}
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+func TestListReceipts(t *testing.T) {
+	ctx := context.Background()
+	store := NewReceiptStore()
+	server := NewReceiptServer(store)
+	processedAt := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	save := func(retailer, date string, points int) uuid.UUID {
+		id := uuid.New()
+		processedAt = processedAt.Add(time.Minute)
+		score := ReceiptScore{Id: id, Receipt: Receipt{Retailer: retailer, PurchaseDate: date, PurchaseTime: "12:00"}, Points: points, ProcessedAt: processedAt}
+		assertNoError(t, store.Save(ctx, score))
+		return id
+	}
+	first := save("Target", "2022-03-01", 10)
+	second := save("Walgreens", "2022-03-15", 30)
+	third := save("Target", "2022-03-20", 20)
+	save("Target", "2022-04-02", 40)
+
+	t.Run("filters by retailer, purchase date and points", func(t *testing.T) {
+		list := listReceipts(t, server, url.Values{"retailer": {"target"}, "purchasedFrom": {"2022-03-01"}, "purchasedTo": {"2022-03-31"}, "minPoints": {"15"}})
+
+		assertListed(t, list, third)
+	})
+
+	t.Run("sorts by points descending", func(t *testing.T) {
+		list := listReceipts(t, server, url.Values{"sort": {"-points"}, "purchasedTo": {"2022-03-31"}})
+
+		assertListed(t, list, second, third, first)
+	})
+
+	t.Run("pages through results without gaps or repeats under concurrent inserts", func(t *testing.T) {
+		query := url.Values{"limit": {"2"}, "purchasedTo": {"2022-03-31"}}
+		page := listReceipts(t, server, query)
+		assertListed(t, page, first, second)
+
+		inserted := save("Target", "2022-03-05", 5)
+		query.Set("cursor", page.NextCursor)
+		page = listReceipts(t, server, query)
+		assertListed(t, page, third, inserted)
+		if page.NextCursor != "" {
+			t.Errorf("expected the last page to have no cursor")
+		}
+	})
+
+	t.Run("rejects a cursor from a different query", func(t *testing.T) {
+		page := listReceipts(t, server, url.Values{"limit": {"1"}})
+
+		response := httptest.NewRecorder()
+		server.ServeHTTP(response, httptest.NewRequest(http.MethodGet, "/receipts?sort=points&cursor="+page.NextCursor, nil))
+
+		assertResponseCode(t, response.Code, http.StatusBadRequest)
+	})
+
+	t.Run("rejects invalid filters", func(t *testing.T) {
+		response := httptest.NewRecorder()
+		server.ServeHTTP(response, httptest.NewRequest(http.MethodGet, "/receipts?purchasedFrom=March", nil))
+
+		assertResponseCode(t, response.Code, http.StatusBadRequest)
+	})
+}
+
+func listReceipts(t testing.TB, server http.Handler, query url.Values) ReceiptList {
+	t.Helper()
+	response := httptest.NewRecorder()
+	server.ServeHTTP(response, httptest.NewRequest(http.MethodGet, "/receipts?"+query.Encode(), nil))
+	assertResponseCode(t, response.Code, http.StatusOK)
+	var list ReceiptList
+	err := json.NewDecoder(response.Body).Decode(&list)
+	checkDecodeErr(t, response, err)
+	return list
+}
+
+func assertListed(t testing.TB, list ReceiptList, want ...uuid.UUID) {
+	t.Helper()
+	if len(list.Receipts) != len(want) {
+		t.Fatalf("expected %d receipts but got %d", len(want), len(list.Receipts))
+	}
+	for i, details := range list.Receipts {
+		if details.Id != want[i] {
+			t.Errorf("expected receipt %d to be %v but got %v", i, want[i], details.Id)
+		}
+	}
+}
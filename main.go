@@ -1,12 +1,172 @@
 package main
 
 import (
+	"context"
+	"errors"
+	"flag"
 	"log"
 	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
 )
 
 func main() {
-	store := NewReceiptStore()
-	handler := NewReceiptServer(store)
-	log.Fatal(http.ListenAndServe(":8080", handler))
+	maxReceipts := flag.Int("max-receipts", 0, "maximum number of receipts to retain, 0 for unlimited")
+	eviction := flag.String("eviction", "oldest", "eviction strategy once max-receipts is reached: oldest or lru")
+	ttl := flag.Duration("ttl", 0, "how long to retain each receipt, 0 to retain forever")
+	ttlBasis := flag.String("ttl-basis", "processed", "what the TTL is measured from: processed or purchase")
+	sweepInterval := flag.Duration("sweep-interval", time.Minute, "how often expired receipts are removed")
+	duplicates := flag.String("duplicates", "reject", "what to do with exact duplicate receipts: reject, flag or allow")
+	nearDuplicates := flag.String("near-duplicates", "flag", "what to do with near duplicate receipts: reject, flag or allow")
+	idempotencyWindow := flag.Duration("idempotency-window", DefaultIdempotencyWindow, "how long responses are replayed for a repeated Idempotency-Key")
+	tenantsFile := flag.String("tenants", "", "JSON file configuring tenants, their API keys, scoring rules and quotas")
+	workers := flag.Int("workers", DefaultJobWorkers, "number of workers processing asynchronous submissions")
+	queueDepth := flag.Int("queue-depth", DefaultJobQueueDepth, "number of asynchronous submissions that can wait for a worker")
+	pointsExpiry := flag.Int("points-expiry-months", 12, "how many months after they are earned points expire, 0 for never")
+	pointsExpiryBasis := flag.String("points-expiry-basis", "processed", "what points expiry is measured from: processed or purchase")
+	expiryInterval := flag.Duration("expiry-interval", time.Hour, "how often expired points are taken from balances")
+	tiersFile := flag.String("tiers", "", "JSON file configuring membership tiers and their multipliers")
+	challengesFile := flag.String("challenges", "", "JSON file configuring the challenges members can complete for bonus points; members have none without it")
+	dailyCap := flag.Int("daily-cap", 0, "most points a member can earn per day, 0 for no cap")
+	monthlyCap := flag.Int("monthly-cap", 0, "most points a member can earn per month, 0 for no cap")
+	rewardsFile := flag.String("rewards", "", "JSON file configuring the rewards catalog")
+	reservationTimeout := flag.Duration("reservation-timeout", DefaultReservationTimeout, "how long a reward reservation holds points before it is released")
+	reviewFile := flag.String("review", "", "JSON file configuring which receipts are held for manual review")
+	fraudFile := flag.String("fraud", "", "JSON file configuring the fraud signals and the risk score that refuses a receipt")
+	staffFile := flag.String("staff", "", "JSON file configuring the staff keys allowed to use the admin and review endpoints")
+	shutdownTimeout := flag.Duration("shutdown-timeout", 30*time.Second, "how long to wait for requests and queued submissions to finish on shutdown")
+	flag.Parse()
+
+	strategy, err := ParseEvictionStrategy(*eviction)
+	if err != nil {
+		log.Fatal(err)
+	}
+	basis, err := ParseTTLBasis(*ttlBasis)
+	if err != nil {
+		log.Fatal(err)
+	}
+	exactAction, err := ParseDuplicateAction(*duplicates)
+	if err != nil {
+		log.Fatal(err)
+	}
+	nearAction, err := ParseDuplicateAction(*nearDuplicates)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	expiryBasis, err := ParseTTLBasis(*pointsExpiryBasis)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	tenants, err := NewTenantRegistry()
+	if *tenantsFile != "" {
+		tenants, err = LoadTenantRegistry(*tenantsFile)
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	store := NewReceiptStore(WithRetention(RetentionPolicy{
+		MaxReceipts: *maxReceipts,
+		Eviction:    strategy,
+		TTL:         *ttl,
+		TTLBasis:    basis,
+	}))
+	if *ttl > 0 {
+		store.StartSweeper(*sweepInterval)
+	}
+
+	tiers := DefaultTierPolicy()
+	if *tiersFile != "" {
+		tiers, err = LoadTierPolicy(*tiersFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	var challenges []Challenge
+	if *challengesFile != "" {
+		challenges, err = LoadChallenges(*challengesFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	var rewards []Reward
+	if *rewardsFile != "" {
+		rewards, err = LoadRewards(*rewardsFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	review := DefaultReviewPolicy()
+	if *reviewFile != "" {
+		review, err = LoadReviewPolicy(*reviewFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	fraud := DefaultFraudPolicy()
+	if *fraudFile != "" {
+		fraud, err = LoadFraudPolicy(*fraudFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	var staff []StaffKey
+	if *staffFile != "" {
+		staff, err = LoadStaffKeys(*staffFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	members := NewMemberRegistry(
+		WithPointsExpiry(PointsExpiry{Months: *pointsExpiry, Basis: expiryBasis}),
+		WithTiers(tiers),
+		WithChallenges(challenges),
+		WithEarningCaps(EarningCaps{Daily: *dailyCap, Monthly: *monthlyCap}),
+		WithRewards(rewards),
+		WithReservationTimeout(*reservationTimeout),
+	)
+	members.StartExpiry(*expiryInterval)
+
+	handler := NewReceiptServer(store,
+		WithDuplicatePolicy(DuplicatePolicy{Exact: exactAction, Near: nearAction}),
+		WithIdempotencyWindow(*idempotencyWindow),
+		WithTenants(tenants),
+		WithJobQueue(NewJobQueue(*workers, *queueDepth)),
+		WithMembers(members),
+		WithReviews(NewReviewQueue(review)),
+		WithFraudDetector(NewFraudDetector(fraud)),
+		WithStaff(staff...),
+	)
+	server := &http.Server{Addr: ":8080", Handler: handler}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	go func() {
+		if err := server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Fatal(err)
+		}
+	}()
+	<-ctx.Done()
+
+	log.Println("shutting down")
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), *shutdownTimeout)
+	defer cancel()
+	if err := server.Shutdown(shutdownCtx); err != nil {
+		log.Println(err)
+	}
+	if err := handler.Shutdown(shutdownCtx); err != nil {
+		log.Println(err)
+	}
+	members.Close()
+	store.Close()
 }
@@ -0,0 +1,226 @@
+package main
+
+import (
+	"container/list"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"regexp"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+const memberIDParam = "memberId"
+const memberNotFoundMessage = "No member found for that ID."
+const invalidMemberIDMessage = "The member ID must be 1 to 64 letters, digits, underscores or hyphens."
+
+var ErrMemberNotFound = errors.New("member not found")
+var ErrInvalidMemberID = errors.New("invalid member ID")
+
+var memberIDPattern = regexp.MustCompile(`^[\w\-]{1,64}$`)
+
+func ValidateMemberID(id string) error {
+	if !memberIDPattern.MatchString(id) {
+		return fmt.Errorf("%w: %q", ErrInvalidMemberID, id)
+	}
+	return nil
+}
+
+// used to encode the response to GET /members/{id}/balance
+type Member struct {
+	Id       string    `json:"id"`
+	Balance  int       `json:"balance"`
+	Receipts int       `json:"receipts"`
+	Tier     string    `json:"tier,omitempty"`
+	JoinedAt time.Time `json:"joinedAt"`
+	// points held by pending reservations, not included in Balance
+	Reserved int `json:"reserved"`
+}
+
+type memberContribution struct {
+	tenant   string
+	memberID string
+	points   int
+	refunds  int
+	// set once the store drops the receipt on its own, which leaves the
+	// member's points alone
+	evicted bool
+}
+
+// used to credit the points on each stored receipt to its member through the
+// ledger, so balances move together with the receipts; members are created
+// by their first receipt
+type MemberRegistry struct {
+	mu      sync.Mutex
+	now     func() time.Time
+	members map[string]*Member
+	// the points each stored receipt has credited to its member
+	contributions map[uuid.UUID]memberContribution
+	ledger        *Ledger
+	expiry        PointsExpiry
+	tiers         TierPolicy
+	caps          EarningCaps
+	// what each member earned by receipt and their tier changes, by tenant
+	// and member
+	earnings    map[string]map[uuid.UUID]earning
+	tierHistory map[string][]TierChange
+	windows     map[string]*tierWindow
+	challenges  []Challenge
+	// each member's stored receipts and the challenges they completed, by
+	// tenant and member
+	visits map[string]map[uuid.UUID]visit
+	awards map[string]map[string]LedgerTransaction
+	// the configured rewards and each tenant's copy of them
+	rewards            []Reward
+	catalogs           map[string]map[string]*Reward
+	reservations       map[uuid.UUID]*Reservation
+	pending            map[uuid.UUID]*Reservation
+	reservationTimeout time.Duration
+	// closed reservations in the order they closed, kept for
+	// reservationRetention
+	closedReservations   *list.List
+	reservationRetention time.Duration
+	// used to stop the expiry job and wait for it
+	stop chan struct{}
+	done chan struct{}
+}
+
+type MemberOption func(*MemberRegistry)
+
+func NewMemberRegistry(options ...MemberOption) *MemberRegistry {
+	m := &MemberRegistry{
+		now:           time.Now,
+		members:       make(map[string]*Member),
+		contributions: make(map[uuid.UUID]memberContribution),
+		ledger:        NewLedger(),
+		expiry:        DefaultPointsExpiry(),
+		tiers:         DefaultTierPolicy(),
+		earnings:      make(map[string]map[uuid.UUID]earning),
+		tierHistory:   make(map[string][]TierChange),
+		windows:       make(map[string]*tierWindow),
+		visits:        make(map[string]map[uuid.UUID]visit),
+		awards:        make(map[string]map[string]LedgerTransaction),
+		catalogs:      make(map[string]map[string]*Reward),
+		reservations:  make(map[uuid.UUID]*Reservation),
+		pending:       make(map[uuid.UUID]*Reservation),
+
+		closedReservations:   list.New(),
+		reservationTimeout:   DefaultReservationTimeout,
+		reservationRetention: DefaultReservationRetention,
+	}
+	for _, option := range options {
+		option(m)
+	}
+	return m
+}
+
+func WithMemberClock(now func() time.Time) MemberOption {
+	return func(m *MemberRegistry) {
+		m.now = now
+	}
+}
+
+func memberKey(tenant, id string) string {
+	return tenant + "\x00" + id
+}
+
+// posts whatever changed in the points the receipt credits to its member
+// since it was last recorded
+func (m *MemberRegistry) Record(ctx context.Context, score ReceiptScore, exists bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if !exists || score.MemberID == "" {
+		m.forget(score.Id, "receipt deleted")
+		return
+	}
+	tenant := TenantFromContext(ctx)
+	key := memberKey(tenant, score.MemberID)
+	member, ok := m.members[key]
+	if !ok {
+		member = &Member{Id: score.MemberID, JoinedAt: score.ProcessedAt}
+		m.members[key] = member
+	}
+
+	previous, recorded := m.contributions[score.Id]
+	m.contributions[score.Id] = memberContribution{tenant: tenant, memberID: score.MemberID, points: score.Points, refunds: len(score.Refunds)}
+	if !recorded {
+		member.Receipts++
+		m.ledger.credit(tenant, score.MemberID, score.Id, TransactionEarned, score.Points, "", m.now(), m.expiry.expiresAt(score))
+	} else if score.Points != previous.points {
+		reason := "receipt corrected"
+		if len(score.Refunds) > previous.refunds {
+			reason = "items returned"
+		}
+		m.reclaim(score.Id, previous.points-score.Points)
+		m.ledger.credit(tenant, score.MemberID, score.Id, TransactionAdjusted, score.Points-previous.points, reason, m.now(), m.expiry.expiresAt(score))
+	}
+	m.recordEarning(key, score.Id, score.Points)
+	if remaining, _ := remainingItems(score, nil); score.held() || len(remaining) == 0 {
+		m.forgetVisit(tenant, score.MemberID, score.Id)
+		return
+	}
+	m.recordVisit(tenant, score.MemberID, score)
+}
+
+// notes that the store dropped a receipt on its own, such as on eviction;
+// storage limits never take points back, so the member keeps what it earned
+func (m *MemberRegistry) Forget(id uuid.UUID) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if contribution, ok := m.contributions[id]; ok {
+		contribution.evicted = true
+		m.contributions[id] = contribution
+	}
+}
+
+// callers must hold m.mu
+func (m *MemberRegistry) forget(id uuid.UUID, reason string) {
+	contribution, ok := m.contributions[id]
+	if !ok {
+		return
+	}
+	m.reclaim(id, contribution.points)
+	m.ledger.credit(contribution.tenant, contribution.memberID, id, TransactionReversed, -contribution.points, reason, m.now(), time.Time{})
+	key := memberKey(contribution.tenant, contribution.memberID)
+	m.members[key].Receipts--
+	m.forgetEarning(key, id)
+	m.forgetVisit(contribution.tenant, contribution.memberID, id)
+	delete(m.contributions, id)
+}
+
+func (m *MemberRegistry) Get(ctx context.Context, id string) (Member, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	tenant := TenantFromContext(ctx)
+	member, ok := m.members[memberKey(tenant, id)]
+	if !ok {
+		return Member{}, ErrMemberNotFound
+	}
+	m.ledger.expire(tenant, id, m.now())
+	m.refreshTier(memberKey(tenant, id))
+	found := *member
+	m.releaseReservations()
+	found.Balance = m.ledger.balance(tenant, memberAccount(id))
+	found.Reserved = m.ledger.balance(tenant, reservedAccount(id))
+	if history := m.tierHistory[memberKey(tenant, id)]; len(history) > 0 {
+		found.Tier = history[len(history)-1].Tier
+	}
+	return found, nil
+}
+
+func (rs *ReceiptServer) getMemberBalance(w http.ResponseWriter, r *http.Request) {
+	member, err := rs.members.Get(r.Context(), r.PathValue("id"))
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", jsonContentType)
+	if err := json.NewEncoder(w).Encode(member); err != nil {
+		log.Println(err)
+	}
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/google/uuid"
+)
+
+func TestMemberBalances(t *testing.T) {
+	t.Run("credits each receipt submitted for a member", func(t *testing.T) {
+		server := NewReceiptServer(NewReceiptStore())
+		postMemberReceipt(t, server, "alice", walgreensReceipt)
+		postMemberReceipt(t, server, "alice", cornerMarketReceipt)
+		postReceipt(t, server, recasedWalgreensReceipt)
+
+		member := getMember(t, server, "alice")
+		if member.Balance != 124 || member.Receipts != 2 {
+			t.Errorf("expected a balance of 124 from 2 receipts but got %+v", member)
+		}
+	})
+
+	t.Run("follows corrections and deletions", func(t *testing.T) {
+		server := NewReceiptServer(NewReceiptStore())
+		walgreens := postMemberReceipt(t, server, "alice", walgreensReceipt)
+		corner := postMemberReceipt(t, server, "alice", cornerMarketReceipt)
+
+		response := sendCorrection(server, http.MethodPatch, walgreens.Id, "", `{"retailer": "Walgreens Pharmacy"}`)
+		assertResponseCode(t, response.Code, http.StatusOK)
+		response = sendRequest(server, http.MethodDelete, "/receipts/"+corner.Id.String(), "")
+		assertResponseCode(t, response.Code, http.StatusNoContent)
+
+		member := getMember(t, server, "alice")
+		if member.Balance != 23 || member.Receipts != 1 {
+			t.Errorf("expected a balance of 23 from 1 receipt but got %+v", member)
+		}
+	})
+
+	t.Run("never disagrees with the stored receipts under concurrent submissions", func(t *testing.T) {
+		store := NewReceiptStore()
+		server := NewReceiptServer(store, WithDuplicatePolicy(DuplicatePolicy{Exact: AllowDuplicates, Near: AllowDuplicates}))
+		done := make(chan struct{})
+		for range 20 {
+			go func() {
+				defer func() { done <- struct{}{} }()
+				response := httptest.NewRecorder()
+				server.ServeHTTP(response, newMemberReceiptRequest("alice", walgreensReceipt))
+			}()
+		}
+		for range 20 {
+			<-done
+		}
+
+		scores, err := store.List(context.Background())
+		assertNoError(t, err)
+		sum := 0
+		for _, score := range scores {
+			sum += score.Points
+		}
+		if member := getMember(t, server, "alice"); member.Balance != sum || member.Receipts != len(scores) {
+			t.Errorf("expected a balance of %d from %d receipts but got %+v", sum, len(scores), member)
+		}
+	})
+
+	t.Run("credits an imported receipt as it scores rather than as exported", func(t *testing.T) {
+		server := NewReceiptServer(NewReceiptStore(), WithStaff(testAdmin))
+		line := fmt.Sprintf(`{"id": %q, "memberId": "mallory", "points": 999999, "rawPoints": 999999, "receipt": %s}`, uuid.New(), compactJSON(t, walgreensReceipt))
+
+		_, summary := importNDJSON(t, server, "", line)
+
+		assertExpectedPoints(t, summary.Imported, 1)
+		if member := getMember(t, server, "mallory"); member.Balance != 15 {
+			t.Errorf("expected a balance of 15 but got %d", member.Balance)
+		}
+	})
+
+	t.Run("keeps the points of receipts the store evicts", func(t *testing.T) {
+		store := NewReceiptStore(WithRetention(RetentionPolicy{MaxReceipts: 1}))
+		server := NewReceiptServer(store, WithStaff(testAdmin))
+		postMemberReceipt(t, server, "alice", walgreensReceipt)
+		postMemberReceipt(t, server, "bob", cornerMarketReceipt)
+
+		if member := getMember(t, server, "alice"); member.Balance != 15 {
+			t.Errorf("expected eviction to leave a balance of 15 but got %d", member.Balance)
+		}
+		var reconciliation Reconciliation
+		getAdminJSON(t, server, "/admin/reconcile", &reconciliation)
+		if !reconciliation.Balanced {
+			t.Errorf("expected a balanced ledger but got %+v", reconciliation)
+		}
+	})
+
+	t.Run("rejects an invalid member ID", func(t *testing.T) {
+		server := NewReceiptServer(NewReceiptStore())
+		response := httptest.NewRecorder()
+		server.ServeHTTP(response, newMemberReceiptRequest("not a member", walgreensReceipt))
+		assertResponseCode(t, response.Code, http.StatusBadRequest)
+	})
+
+	t.Run("hides members from other tenants", func(t *testing.T) {
+		server := NewReceiptServer(NewReceiptStore())
+		postMemberReceipt(t, server, "alice", walgreensReceipt)
+
+		request, _ := http.NewRequest(http.MethodGet, "/members/alice/balance", nil)
+		request.Header.Set(tenantHeader, "globex")
+		response := httptest.NewRecorder()
+		server.ServeHTTP(response, request)
+
+		assertResponseCode(t, response.Code, http.StatusNotFound)
+	})
+}
+
+func newMemberReceiptRequest(member, receipt string) *http.Request {
+	request := newPostReceiptRequest(receipt)
+	request.URL.RawQuery = "memberId=" + member
+	return request
+}
+
+func postMemberReceipt(t testing.TB, server http.Handler, member, body string) ID {
+	t.Helper()
+	response := httptest.NewRecorder()
+	server.ServeHTTP(response, newMemberReceiptRequest(member, body))
+	assertResponseCode(t, response.Code, http.StatusOK)
+	return decodeID(t, response)
+}
+
+func getMember(t testing.TB, server http.Handler, id string) Member {
+	t.Helper()
+	request, _ := http.NewRequest(http.MethodGet, "/members/"+id+"/balance", nil)
+	response := httptest.NewRecorder()
+	server.ServeHTTP(response, request)
+	assertResponseCode(t, response.Code, http.StatusOK)
+	var member Member
+	decodeJSON(t, response, &member)
+	return member
+}
+
+func decodeJSON(t testing.TB, response *httptest.ResponseRecorder, v any) {
+	t.Helper()
+	err := json.NewDecoder(response.Body).Decode(v)
+	checkDecodeErr(t, response, err)
+}
@@ -10,63 +10,104 @@ import (
 	"regexp"
 	"strconv"
 	"strings"
-	"sync"
+	"time"
 	"unicode"
 
 	"github.com/google/uuid"
 )
 
 type ReceiptScore struct {
-	Id      uuid.UUID
-	Receipt Receipt
-	Points  int
+	Id          uuid.UUID `json:"id"`
+	Tenant      string    `json:"tenant,omitempty"`
+	MemberID    string    `json:"memberId,omitempty"`
+	Receipt     Receipt   `json:"receipt"`
+	Points      int       `json:"points"`
+	ProcessedAt time.Time `json:"processedAt"`
+	Fingerprint string    `json:"fingerprint,omitempty"`
+	// set when a flagged duplicate was accepted, to the receipt it duplicates
+	DuplicateOf    *uuid.UUID `json:"duplicateOf,omitempty"`
+	DuplicateMatch string     `json:"duplicateMatch,omitempty"`
+	// the member's tier whose multiplier was applied to the points
+	Tier string `json:"tier,omitempty"`
+	// the points before the member's earning caps, the same as Points when
+	// no cap applied
+	RawPoints int `json:"rawPoints"`
+	// refunds for items returned from the receipt, oldest first
+	Refunds []Refund `json:"refunds,omitempty"`
+	// whether the receipt's points are held for or were refused in review
+	Status ReceiptStatus `json:"status"`
+	Review *Review       `json:"review,omitempty"`
+	// the fraud signals seen when the receipt was submitted
+	Risk *RiskAssessment `json:"risk,omitempty"`
+	// the sequence number of the last event folded into this score
+	Version int `json:"version"`
 }
 
 type Receipt struct {
-	Retailer     string `regex:"^[\\w\\s\\-&]+$"`
-	PurchaseDate string `regex:"^\\d{4}-(0[1-9]|1[0-2])-([0-2]\\d|3[0-1])$"`
-	PurchaseTime string `regex:"^([01]\\d|2[0-3]):([0-5]\\d)$"`
-	Items        []Item
-	Total        string `regex:"^\\d+\\.\\d{2}$"`
+	Retailer     string `json:"retailer" regex:"^[\\w\\s\\-&]+$"`
+	PurchaseDate string `json:"purchaseDate" regex:"^\\d{4}-(0[1-9]|1[0-2])-([0-2]\\d|3[0-1])$"`
+	PurchaseTime string `json:"purchaseTime" regex:"^([01]\\d|2[0-3]):([0-5]\\d)$"`
+	Items        []Item `json:"items"`
+	Total        string `json:"total" regex:"^\\d+\\.\\d{2}$"`
 }
 
 type Item struct {
-	ShortDescription string `regex:"^[\\w\\s\\-]+$"`
-	Price            string `regex:"^\\d+\\.\\d{2}$"`
+	ShortDescription string `json:"shortDescription" regex:"^[\\w\\s\\-]+$"`
+	Price            string `json:"price" regex:"^\\d+\\.\\d{2}$"`
 }
 
-type InMemoryReceiptStore struct {
-	receipts map[uuid.UUID]ReceiptScore
-	mu       sync.Mutex
+// returns anything noteworthy about an accepted receipt, such as items that do
+// not add up to its total
+func (s ReceiptScore) Warnings() []string {
+	warnings := []string{}
+	if sum, ok := itemsTotalCents(s.Receipt.Items); ok {
+		if total, err := parseCents(s.Receipt.Total); err == nil && total != sum {
+			warnings = append(warnings, fmt.Sprintf("item prices add up to %s but the total is %s", formatCents(sum), s.Receipt.Total))
+		}
+	}
+	if s.DuplicateOf != nil {
+		warnings = append(warnings, fmt.Sprintf("%s duplicate of receipt %v", s.DuplicateMatch, *s.DuplicateOf))
+	}
+	return warnings
 }
 
-func NewReceiptStore() *InMemoryReceiptStore {
-	receipts := make(map[uuid.UUID]ReceiptScore)
-	return &InMemoryReceiptStore{receipts: receipts}
+var ErrInvalidReceipt = errors.New("invalid receipt")
+
+// used to parse, validate and score receipt submissions independently of storage
+type ReceiptProcessor struct {
+	now func() time.Time
 }
 
-func (i *InMemoryReceiptStore) GetPoints(id uuid.UUID) (int, error) {
-	i.mu.Lock()
-	defer i.mu.Unlock()
-	receiptScore, ok := i.receipts[id]
-	if ok {
-		return receiptScore.Points, nil
-	} else {
-		return 0, errors.New("no receipt found")
-	}
+func NewReceiptProcessor() *ReceiptProcessor {
+	return &ReceiptProcessor{now: time.Now}
 }
 
-func (i *InMemoryReceiptStore) ProcessReceipt(id uuid.UUID, body io.Reader) error {
-	i.mu.Lock()
-	defer i.mu.Unlock()
-	var receipt Receipt
-	err := json.NewDecoder(body).Decode(&receipt)
+func (p *ReceiptProcessor) Process(id uuid.UUID, body io.Reader, rules ScoringRules) (ReceiptScore, error) {
+	receipt, err := ParseReceipt(body)
+	if err != nil {
+		return ReceiptScore{}, fmt.Errorf("%w: %v", ErrInvalidReceipt, err)
+	}
 
+	err = ValidateReceipt(receipt)
 	if err != nil {
-		return err
+		return ReceiptScore{}, fmt.Errorf("%w: %v", ErrInvalidReceipt, err)
 	}
 
-	err = validateStruct(receipt)
+	return p.Score(id, receipt, rules), nil
+}
+
+func (p *ReceiptProcessor) Score(id uuid.UUID, receipt Receipt, rules ScoringRules) ReceiptScore {
+	return ReceiptScore{Id: id, Receipt: receipt, Points: rules.Points(receipt), ProcessedAt: p.now()}
+}
+
+func ParseReceipt(body io.Reader) (Receipt, error) {
+	var receipt Receipt
+	err := json.NewDecoder(body).Decode(&receipt)
+	return receipt, err
+}
+
+func ValidateReceipt(receipt Receipt) error {
+	err := validateStruct(receipt)
 
 	if err != nil {
 		return err
@@ -83,21 +124,11 @@ func (i *InMemoryReceiptStore) ProcessReceipt(id uuid.UUID, body io.Reader) erro
 			return err
 		}
 	}
-	points := calculatePoints(receipt)
-	i.receipts[id] = ReceiptScore{Id: id, Receipt: receipt, Points: points}
 	return nil
 }
 
 func calculatePoints(receipt Receipt) int {
-	sum := 0
-	sum += namePoints(receipt.Retailer)
-	sum += roundDollarPoints(receipt.Total)
-	sum += multiplesOfQuartersPoints(receipt.Total)
-	sum += itemPairPoints(len(receipt.Items))
-	sum += itemPoints(receipt.Items)
-	sum += purchaseDatePoints(receipt.PurchaseDate)
-	sum += purchaseTimePoints(receipt.PurchaseTime)
-	return sum
+	return ScoringRules{}.Points(receipt)
 }
 
 func namePoints(name string) int {
@@ -179,6 +210,36 @@ func purchaseTimePoints(time string) int {
 	return 0
 }
 
+// returns when a validated receipt says the purchase was made
+func purchaseTime(receipt Receipt) (time.Time, error) {
+	return time.Parse("2006-01-02 15:04", receipt.PurchaseDate+" "+receipt.PurchaseTime)
+}
+
+func itemsTotalCents(items []Item) (int, bool) {
+	sum := 0
+	for _, item := range items {
+		cents, err := parseCents(item.Price)
+		if err != nil {
+			return 0, false
+		}
+		sum += cents
+	}
+	return sum, true
+}
+
+// parses a validated amount such as "12.25" without going through floats
+func parseCents(amount string) (int, error) {
+	dollars, cents, ok := strings.Cut(amount, ".")
+	if !ok || len(cents) != 2 {
+		return 0, fmt.Errorf("invalid amount %q", amount)
+	}
+	return strconv.Atoi(dollars + cents)
+}
+
+func formatCents(cents int) string {
+	return fmt.Sprintf("%d.%02d", cents/100, cents%100)
+}
+
 // used to validate the regex tags on Receipt and Item
 func validateStruct[T any](data T) error {
 	val := reflect.ValueOf(data)
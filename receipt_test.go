@@ -1,6 +1,11 @@
 package main
 
-import "testing"
+import (
+	"strings"
+	"testing"
+
+	"github.com/google/uuid"
+)
 
 func TestNamePoints(t *testing.T) {
 	t.Run("handles non-alphanumeric characters", func(t *testing.T) {
@@ -170,3 +175,43 @@ func assertExpectedPoints(t testing.TB, got, want int) {
 		t.Errorf("expected points of %d but got %d", want, got)
 	}
 }
+
+func TestReceiptProcessor(t *testing.T) {
+	processor := NewReceiptProcessor()
+	id := uuid.New()
+
+	t.Run("scores a valid receipt", func(t *testing.T) {
+		body := strings.NewReader(`{
+			"retailer": "Walgreens",
+			"purchaseDate": "2022-01-02",
+			"purchaseTime": "08:13",
+			"total": "2.65",
+			"items": [
+				{"shortDescription": "Pepsi - 12-oz", "price": "1.25"},
+				{"shortDescription": "Dasani", "price": "1.40"}
+			]
+		}`)
+		score, err := processor.Process(id, body, ScoringRules{})
+		if err != nil {
+			t.Fatalf("expected no error but got %v", err)
+		}
+		if score.Id != id {
+			t.Errorf("expected ID %v but got %v", id, score.Id)
+		}
+		assertExpectedPoints(t, score.Points, 15)
+	})
+
+	t.Run("rejects malformed JSON", func(t *testing.T) {
+		_, err := processor.Process(id, strings.NewReader(`{"retailer":`), ScoringRules{})
+		if err == nil {
+			t.Errorf("expected an error for malformed JSON")
+		}
+	})
+
+	t.Run("rejects a receipt without items", func(t *testing.T) {
+		err := ValidateReceipt(Receipt{Retailer: "Target", PurchaseDate: "2022-01-01", PurchaseTime: "13:01", Total: "1.00"})
+		if err == nil {
+			t.Errorf("expected an error for a receipt without items")
+		}
+	})
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+const invalidRefundMessage = "The refund must be a valid receipt from the same retailer, made after the original purchase, returning items on the original that have not already been returned."
+
+var ErrInvalidRefund = errors.New("invalid refund")
+
+// a refund receipt for items returned from an earlier receipt, recorded on
+// that receipt along with the points it took back
+type Refund struct {
+	Id         uuid.UUID `json:"id"`
+	OriginalID uuid.UUID `json:"originalId"`
+	Receipt
+	// the change to the original receipt's points, zero or less
+	Points     int       `json:"points"`
+	RefundedAt time.Time `json:"refundedAt"`
+}
+
+func itemKey(item Item) string {
+	return strings.ToLower(strings.TrimSpace(item.ShortDescription)) + "\x00" + item.Price
+}
+
+// returns the items on the receipt that are neither among its earlier refunds
+// nor returned, and fails if any returned item is not left to return
+func remainingItems(score ReceiptScore, returned []Item) ([]Item, error) {
+	outstanding := make(map[string]int)
+	for _, refund := range score.Refunds {
+		for _, item := range refund.Items {
+			outstanding[itemKey(item)]++
+		}
+	}
+	for _, item := range returned {
+		outstanding[itemKey(item)]++
+	}
+	remaining := []Item{}
+	for _, item := range score.Receipt.Items {
+		if key := itemKey(item); outstanding[key] > 0 {
+			outstanding[key]--
+			continue
+		}
+		remaining = append(remaining, item)
+	}
+	for key, count := range outstanding {
+		if count > 0 {
+			description, price, _ := strings.Cut(key, "\x00")
+			return nil, fmt.Errorf("%w: %q at %s is not left to return", ErrInvalidRefund, description, price)
+		}
+	}
+	return remaining, nil
+}
+
+// returns the receipt with only the remaining items, its total reduced by what
+// the others cost
+func keptReceipt(receipt Receipt, remaining []Item) Receipt {
+	kept := receipt
+	kept.Items = remaining
+	if total, err := parseCents(receipt.Total); err == nil {
+		bought, _ := itemsTotalCents(receipt.Items)
+		left, _ := itemsTotalCents(remaining)
+		kept.Total = formatCents(max(total-(bought-left), 0))
+	}
+	return kept
+}
+
+func validateRefund(original ReceiptScore, refund Refund) error {
+	if err := ValidateReceipt(refund.Receipt); err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidRefund, err)
+	}
+	if NormalizeRetailer(refund.Retailer) != NormalizeRetailer(original.Receipt.Retailer) {
+		return fmt.Errorf("%w: retailer %q does not match the original's", ErrInvalidRefund, refund.Retailer)
+	}
+	refundedAt, err := purchaseTime(refund.Receipt)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidRefund, err)
+	}
+	if purchasedAt, err := purchaseTime(original.Receipt); err == nil && refundedAt.Before(purchasedAt) {
+		return fmt.Errorf("%w: refunded before the original purchase", ErrInvalidRefund)
+	}
+	return nil
+}
+
+// takes back the points the returned items earned by rescoring the original
+// receipt without them, with the tier it was first scored with. Points
+// an earning cap withheld are taken back first, and the original never goes
+// below zero or above what it had
+func (rs *ReceiptServer) refundReceipt(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	var refund Refund
+	if err := json.NewDecoder(r.Body).Decode(&refund); err != nil {
+		http.Error(w, invalidRefundMessage, http.StatusBadRequest)
+		log.Println(err)
+		return
+	}
+
+	rs.commitMu.Lock()
+	defer rs.commitMu.Unlock()
+	original, err := rs.store.Get(ctx, refund.OriginalID)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	if err := validateRefund(original, refund); err != nil {
+		writeError(w, err)
+		return
+	}
+	remaining, err := remainingItems(original, refund.Items)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	rawPoints := 0
+	if len(remaining) > 0 {
+		rescored := rs.processor.Score(original.Id, keptReceipt(original.Receipt, remaining), rs.tenantConfig(ctx).Rules)
+		rescored.MemberID = original.MemberID
+		rs.reapplyTier(&rescored, original.Tier)
+		rawPoints = min(rescored.Points, original.RawPoints)
+	}
+	change := min(original.Points, rawPoints) - original.Points
+
+	refund.Id = uuid.New()
+	refund.Points = change
+	refund.RefundedAt = rs.processor.now()
+	event := ReceiptEvent{
+		ReceiptID: original.Id,
+		Type:      EventRefunded,
+		At:        refund.RefundedAt,
+		Actor:     actorFromRequest(r),
+		Points:    &change,
+		RawPoints: &rawPoints,
+		Refund:    &refund,
+	}
+	if _, err := rs.commitLocked(ctx, original.Id, original.Version, event); err != nil {
+		writeError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", jsonContentType)
+	w.Header().Set("Location", "/receipts/"+original.Id.String())
+	w.WriteHeader(http.StatusCreated)
+	if err := json.NewEncoder(w).Encode(refund); err != nil {
+		log.Println(err)
+	}
+}
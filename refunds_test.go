@@ -0,0 +1,107 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/google/uuid"
+)
+
+const pepsi = `{"shortDescription": "Pepsi - 12-oz", "price": "1.25"}`
+const dasani = `{"shortDescription": "Dasani", "price": "1.40"}`
+const gatorade = `{"shortDescription": "Gatorade", "price": "2.25"}`
+
+func TestRefunds(t *testing.T) {
+	t.Run("takes back what the returned items earned", func(t *testing.T) {
+		server := NewReceiptServer(NewReceiptStore())
+		walgreens := postReceipt(t, server, walgreensReceipt)
+
+		response := sendRefund(server, walgreens.Id, "Walgreens", pepsi)
+
+		assertResponseCode(t, response.Code, http.StatusCreated)
+		var refund Refund
+		decodeJSON(t, response, &refund)
+		if refund.Points != -5 {
+			t.Errorf("expected the refund to take back 5 points but got %d", refund.Points)
+		}
+		assertReceiptPoints(t, server, walgreens, 10)
+		response = httptest.NewRecorder()
+		server.ServeHTTP(response, newGetReceiptRequest(walgreens.Id))
+		if details := decodeDetails(t, response); len(details.Refunds) != 1 || len(details.Items) != 2 {
+			t.Errorf("expected the receipt to keep its items and list the refund but got %+v", details)
+		}
+	})
+
+	t.Run("keeps returned items out of a corrected receipt's points", func(t *testing.T) {
+		server := NewReceiptServer(NewReceiptStore())
+		walgreens := postReceipt(t, server, walgreensReceipt)
+		response := sendRefund(server, walgreens.Id, "Walgreens", pepsi)
+		assertResponseCode(t, response.Code, http.StatusCreated)
+
+		response = sendCorrection(server, http.MethodPatch, walgreens.Id, "", `{"purchaseTime": "08:13"}`)
+
+		assertResponseCode(t, response.Code, http.StatusOK)
+		assertReceiptPoints(t, server, walgreens, 10)
+	})
+
+	t.Run("never raises or lowers the original past what it earned", func(t *testing.T) {
+		server := NewReceiptServer(NewReceiptStore())
+		walgreens := postReceipt(t, server, walgreensReceipt)
+
+		// without Dasani the total would be a multiple of 0.25
+		assertResponseCode(t, sendRefund(server, walgreens.Id, "Walgreens", dasani).Code, http.StatusCreated)
+		assertReceiptPoints(t, server, walgreens, 15)
+		assertResponseCode(t, sendRefund(server, walgreens.Id, "Walgreens", pepsi).Code, http.StatusCreated)
+		assertReceiptPoints(t, server, walgreens, 0)
+	})
+
+	t.Run("rejects items that are not left to return", func(t *testing.T) {
+		server := NewReceiptServer(NewReceiptStore())
+		walgreens := postReceipt(t, server, walgreensReceipt)
+		assertResponseCode(t, sendRefund(server, walgreens.Id, "Walgreens", pepsi).Code, http.StatusCreated)
+
+		assertResponseCode(t, sendRefund(server, walgreens.Id, "Walgreens", pepsi).Code, http.StatusUnprocessableEntity)
+		assertResponseCode(t, sendRefund(server, walgreens.Id, "Walgreens", gatorade).Code, http.StatusUnprocessableEntity)
+		assertResponseCode(t, sendRefund(server, walgreens.Id, "Target", dasani).Code, http.StatusUnprocessableEntity)
+		assertResponseCode(t, sendRefund(server, uuid.New(), "Walgreens", dasani).Code, http.StatusNotFound)
+	})
+
+	t.Run("claws back a member's points without overdrawing them", func(t *testing.T) {
+		server := NewReceiptServer(NewReceiptStore(), WithStaff(testAdmin))
+		corner := postMemberReceipt(t, server, "alice", cornerMarketReceipt)
+		assertResponseCode(t, redeem(server, "alice", `{"points": 100}`).Code, http.StatusCreated)
+
+		assertResponseCode(t, sendRefund(server, corner.Id, "M&M Corner Market", gatorade).Code, http.StatusCreated)
+
+		assertReceiptPoints(t, server, corner, 54)
+		if member := getMember(t, server, "alice"); member.Balance != 0 {
+			t.Errorf("expected the balance to stop at 0 but got %d", member.Balance)
+		}
+		var reconciliation Reconciliation
+		getAdminJSON(t, server, "/admin/reconcile", &reconciliation)
+		if !reconciliation.Balanced {
+			t.Errorf("expected a balanced ledger but got %+v", reconciliation)
+		}
+	})
+
+	t.Run("takes back points withheld by a cap first", func(t *testing.T) {
+		members := NewMemberRegistry(WithEarningCaps(EarningCaps{Daily: 80}))
+		server := NewReceiptServer(NewReceiptStore(), WithMembers(members))
+		corner := postMemberReceipt(t, server, "alice", cornerMarketReceipt)
+
+		assertResponseCode(t, sendRefund(server, corner.Id, "M&M Corner Market", gatorade).Code, http.StatusCreated)
+
+		assertBreakdown(t, server, corner, PointsBreakdown{RawPoints: 54, Tier: "bronze", Withheld: 0, Points: 54})
+	})
+}
+
+func sendRefund(server http.Handler, original uuid.UUID, retailer string, items ...string) *httptest.ResponseRecorder {
+	body := fmt.Sprintf(`{"originalId": %q, "retailer": %q, "purchaseDate": "2022-04-01", "purchaseTime": "10:00", "total": "0.00", "items": [%s]}`, original, retailer, strings.Join(items, ","))
+	request, _ := http.NewRequest(http.MethodPost, "/receipts/refunds", strings.NewReader(body))
+	response := httptest.NewRecorder()
+	server.ServeHTTP(response, request)
+	return response
+}
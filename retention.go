@@ -0,0 +1,241 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+var ErrReceiptExpired = errors.New("receipt expired or was evicted")
+var ErrOverCapacity = errors.New("more receipts than the store can hold at once")
+
+// caps how many tombstones are remembered so that expired IDs keep returning
+// ErrReceiptExpired without the tombstones themselves growing forever
+const maxTombstones = 100000
+
+type tombstone struct {
+	id     uuid.UUID
+	tenant string
+}
+
+type EvictionStrategy int
+
+const (
+	EvictOldest EvictionStrategy = iota
+	EvictLeastRecentlyUsed
+)
+
+type TTLBasis int
+
+const (
+	TTLFromProcessedAt TTLBasis = iota
+	TTLFromPurchaseDate
+)
+
+// zero values mean unlimited: no capacity limit and no expiry
+type RetentionPolicy struct {
+	MaxReceipts int
+	Eviction    EvictionStrategy
+	TTL         time.Duration
+	TTLBasis    TTLBasis
+}
+
+type RetentionStats struct {
+	Evicted int
+	Expired int
+}
+
+type StoreOption func(*InMemoryReceiptStore)
+
+func WithRetention(policy RetentionPolicy) StoreOption {
+	return func(i *InMemoryReceiptStore) {
+		i.retention = policy
+	}
+}
+
+func WithStoreClock(now func() time.Time) StoreOption {
+	return func(i *InMemoryReceiptStore) {
+		i.now = now
+	}
+}
+
+func ParseEvictionStrategy(s string) (EvictionStrategy, error) {
+	switch s {
+	case "oldest":
+		return EvictOldest, nil
+	case "lru":
+		return EvictLeastRecentlyUsed, nil
+	}
+	return 0, fmt.Errorf("unknown eviction strategy %q", s)
+}
+
+func ParseTTLBasis(s string) (TTLBasis, error) {
+	switch s {
+	case "processed":
+		return TTLFromProcessedAt, nil
+	case "purchase":
+		return TTLFromPurchaseDate, nil
+	}
+	return 0, fmt.Errorf("unknown TTL basis %q", s)
+}
+
+// starts a background goroutine that removes expired receipts every interval
+// until Close is called
+func (i *InMemoryReceiptStore) StartSweeper(interval time.Duration) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	if i.stop != nil {
+		return
+	}
+	i.stop = make(chan struct{})
+	i.done = make(chan struct{})
+	go func(stop <-chan struct{}, done chan<- struct{}) {
+		defer close(done)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				i.Sweep()
+			case <-stop:
+				return
+			}
+		}
+	}(i.stop, i.done)
+}
+
+// stops the sweeper, waiting for an in-progress sweep to finish
+func (i *InMemoryReceiptStore) Close() error {
+	i.mu.Lock()
+	stop, done := i.stop, i.done
+	i.stop, i.done = nil, nil
+	i.mu.Unlock()
+	if stop != nil {
+		close(stop)
+		<-done
+	}
+	return nil
+}
+
+// removes every expired receipt and returns how many were removed
+func (i *InMemoryReceiptStore) Sweep() int {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	if i.retention.TTL <= 0 {
+		return 0
+	}
+	now := i.now()
+	removed := 0
+	for id, score := range i.receipts {
+		if i.isExpired(score, now) {
+			i.expire(id)
+			removed++
+		}
+	}
+	if removed > 0 {
+		log.Printf("retention sweep expired %d receipts", removed)
+	}
+	return removed
+}
+
+// registers fn to be called with the ID of every receipt that is evicted or
+// expires; fn runs while the store is locked and must not call back into it
+func (i *InMemoryReceiptStore) OnEvict(fn func(uuid.UUID)) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	i.onEvict = append(i.onEvict, fn)
+}
+
+func (i *InMemoryReceiptStore) Stats() RetentionStats {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	return i.stats
+}
+
+// callers must hold i.mu for everything below
+
+func (i *InMemoryReceiptStore) isExpired(score ReceiptScore, now time.Time) bool {
+	if i.retention.TTL <= 0 {
+		return false
+	}
+	return !now.Before(i.expiresAt(score))
+}
+
+func (i *InMemoryReceiptStore) expiresAt(score ReceiptScore) time.Time {
+	start := score.ProcessedAt
+	if i.retention.TTLBasis == TTLFromPurchaseDate {
+		purchasedAt, err := purchaseTime(score.Receipt)
+		if err == nil {
+			start = purchasedAt
+		}
+	}
+	return start.Add(i.retention.TTL)
+}
+
+// used on every write so that the eviction order reflects insertion or use
+func (i *InMemoryReceiptStore) track(id uuid.UUID) {
+	if element, ok := i.elements[id]; ok {
+		if i.retention.Eviction == EvictLeastRecentlyUsed {
+			i.order.MoveToBack(element)
+		}
+		return
+	}
+	i.elements[id] = i.order.PushBack(id)
+	if element, ok := i.tombstones[id]; ok {
+		i.graveyard.Remove(element)
+		delete(i.tombstones, id)
+	}
+}
+
+// used on reads, which only affect the order under LRU eviction
+func (i *InMemoryReceiptStore) touch(id uuid.UUID) {
+	if i.retention.Eviction != EvictLeastRecentlyUsed {
+		return
+	}
+	if element, ok := i.elements[id]; ok {
+		i.order.MoveToBack(element)
+	}
+}
+
+func (i *InMemoryReceiptStore) enforceCapacity() {
+	if i.retention.MaxReceipts <= 0 {
+		return
+	}
+	for len(i.receipts) > i.retention.MaxReceipts && i.order.Len() > 0 {
+		id := i.order.Front().Value.(uuid.UUID)
+		i.bury(id)
+		i.remove(id)
+		i.notifyEvicted(id)
+		i.stats.Evicted++
+		log.Printf("evicted receipt %v: store is at its capacity of %d", id, i.retention.MaxReceipts)
+	}
+}
+
+func (i *InMemoryReceiptStore) expire(id uuid.UUID) {
+	i.bury(id)
+	i.remove(id)
+	i.notifyEvicted(id)
+	i.stats.Expired++
+	log.Printf("expired receipt %v", id)
+}
+
+func (i *InMemoryReceiptStore) notifyEvicted(id uuid.UUID) {
+	for _, fn := range i.onEvict {
+		fn(id)
+	}
+}
+
+// remembers that a stored receipt is gone; must be called before it is removed
+func (i *InMemoryReceiptStore) bury(id uuid.UUID) {
+	if element, ok := i.tombstones[id]; ok {
+		i.graveyard.Remove(element)
+	}
+	i.tombstones[id] = i.graveyard.PushBack(tombstone{id: id, tenant: i.receipts[id].Tenant})
+	for i.graveyard.Len() > maxTombstones {
+		oldest := i.graveyard.Remove(i.graveyard.Front()).(tombstone)
+		delete(i.tombstones, oldest.id)
+	}
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+type fakeClock struct {
+	current time.Time
+}
+
+func (c *fakeClock) now() time.Time {
+	return c.current
+}
+
+func (c *fakeClock) advance(d time.Duration) {
+	c.current = c.current.Add(d)
+}
+
+func TestRetentionCapacity(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("evicts the oldest receipt", func(t *testing.T) {
+		store := NewReceiptStore(WithRetention(RetentionPolicy{MaxReceipts: 2}))
+		first, second, third := uuid.New(), uuid.New(), uuid.New()
+		assertNoError(t, store.Save(ctx, ReceiptScore{Id: first}))
+		assertNoError(t, store.Save(ctx, ReceiptScore{Id: second}))
+		_, err := store.Get(ctx, first)
+		assertNoError(t, err)
+		assertNoError(t, store.Save(ctx, ReceiptScore{Id: third}))
+
+		_, err = store.Get(ctx, first)
+		assertErrorIs(t, err, ErrReceiptExpired)
+		_, err = store.Get(ctx, second)
+		assertNoError(t, err)
+		assertExpectedPoints(t, store.Stats().Evicted, 1)
+	})
+
+	t.Run("evicts the least recently used receipt", func(t *testing.T) {
+		store := NewReceiptStore(WithRetention(RetentionPolicy{MaxReceipts: 2, Eviction: EvictLeastRecentlyUsed}))
+		first, second, third := uuid.New(), uuid.New(), uuid.New()
+		assertNoError(t, store.Save(ctx, ReceiptScore{Id: first}))
+		assertNoError(t, store.Save(ctx, ReceiptScore{Id: second}))
+		_, err := store.Get(ctx, first)
+		assertNoError(t, err)
+		assertNoError(t, store.Save(ctx, ReceiptScore{Id: third}))
+
+		_, err = store.Get(ctx, second)
+		assertErrorIs(t, err, ErrReceiptExpired)
+		_, err = store.Get(ctx, first)
+		assertNoError(t, err)
+	})
+}
+
+func TestRetentionTTL(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("expires receipts after their processing time", func(t *testing.T) {
+		clock := &fakeClock{current: time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)}
+		store := NewReceiptStore(WithStoreClock(clock.now), WithRetention(RetentionPolicy{TTL: time.Hour}))
+		id := uuid.New()
+		assertNoError(t, store.Save(ctx, ReceiptScore{Id: id, ProcessedAt: clock.now()}))
+
+		clock.advance(59 * time.Minute)
+		_, err := store.Get(ctx, id)
+		assertNoError(t, err)
+
+		clock.advance(time.Minute)
+		_, err = store.Get(ctx, id)
+		assertErrorIs(t, err, ErrReceiptExpired)
+		assertExpectedPoints(t, store.Stats().Expired, 1)
+	})
+
+	t.Run("expires receipts after their purchase date", func(t *testing.T) {
+		clock := &fakeClock{current: time.Date(2022, 1, 3, 0, 0, 0, 0, time.UTC)}
+		store := NewReceiptStore(WithStoreClock(clock.now), WithRetention(RetentionPolicy{TTL: 24 * time.Hour, TTLBasis: TTLFromPurchaseDate}))
+		id := uuid.New()
+		receipt := Receipt{PurchaseDate: "2022-01-01", PurchaseTime: "13:01"}
+		assertNoError(t, store.Save(ctx, ReceiptScore{Id: id, Receipt: receipt, ProcessedAt: clock.now()}))
+
+		_, err := store.Get(ctx, id)
+		assertErrorIs(t, err, ErrReceiptExpired)
+	})
+
+	t.Run("sweeper removes expired receipts and stops cleanly", func(t *testing.T) {
+		clock := &fakeClock{current: time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)}
+		store := NewReceiptStore(WithStoreClock(clock.now), WithRetention(RetentionPolicy{TTL: time.Hour}))
+		assertNoError(t, store.Save(ctx, ReceiptScore{Id: uuid.New(), ProcessedAt: clock.now()}))
+		assertNoError(t, store.Save(ctx, ReceiptScore{Id: uuid.New(), ProcessedAt: clock.now().Add(2 * time.Hour)}))
+		clock.advance(time.Hour)
+
+		assertExpectedPoints(t, store.Sweep(), 1)
+
+		store.StartSweeper(time.Millisecond)
+		assertNoError(t, store.Close())
+		scores, err := store.List(ctx)
+		assertNoError(t, err)
+		assertExpectedPoints(t, len(scores), 1)
+	})
+}
+
+func TestGetPointsForExpiredReceipt(t *testing.T) {
+	store := NewReceiptStore(WithRetention(RetentionPolicy{MaxReceipts: 1}))
+	server := NewReceiptServer(store)
+	evicted := uuid.New()
+	assertNoError(t, store.Save(context.Background(), ReceiptScore{Id: evicted}))
+	assertNoError(t, store.Save(context.Background(), ReceiptScore{Id: uuid.New()}))
+
+	response := httptest.NewRecorder()
+	server.ServeHTTP(response, newGetPointsRequest(evicted))
+
+	assertResponseCode(t, response.Code, http.StatusGone)
+	assertResponseBody(t, response.Body.String(), goneMessage+"\n")
+}
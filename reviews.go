@@ -0,0 +1,333 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+const invalidDecisionMessage = "A review decision needs a reason."
+const notPendingReviewMessage = "The receipt is not awaiting review."
+const selfReviewMessage = "A reviewer cannot approve a receipt they submitted."
+
+var ErrInvalidDecision = errors.New("invalid review decision")
+var ErrNotPendingReview = errors.New("receipt is not pending review")
+var ErrSelfReview = errors.New("reviewer submitted the receipt")
+
+type ReceiptStatus string
+
+const (
+	ReceiptAccepted      ReceiptStatus = "accepted"
+	ReceiptPendingReview ReceiptStatus = "pending_review"
+	ReceiptRejected      ReceiptStatus = "rejected"
+)
+
+// why a receipt was held for review and, once reviewed, who decided and why
+type Review struct {
+	Reasons    []string   `json:"reasons"`
+	Reviewer   string     `json:"reviewer,omitempty"`
+	Reason     string     `json:"reason,omitempty"`
+	ReviewedAt *time.Time `json:"reviewedAt,omitempty"`
+}
+
+// reports whether the receipt's points are being kept from its member
+func (s ReceiptScore) held() bool {
+	return s.Status == ReceiptPendingReview || s.Status == ReceiptRejected
+}
+
+// the criteria that hold a receipt for review; each is off when left zero
+type ReviewPolicy struct {
+	// a total above this amount, such as "500.00"
+	MaxTotal string `json:"maxTotal,omitempty"`
+	// more than this many of the same item
+	MaxIdenticalItems int `json:"maxIdenticalItems,omitempty"`
+	// a purchase time from OffHoursFrom up to OffHoursTo, such as "01:00" to
+	// "05:00", which may wrap past midnight
+	OffHoursFrom string `json:"offHoursFrom,omitempty"`
+	OffHoursTo   string `json:"offHoursTo,omitempty"`
+	// more than this many receipts from one member within the window
+	RapidSubmissions   int `json:"rapidSubmissions,omitempty"`
+	RapidWindowMinutes int `json:"rapidWindowMinutes,omitempty"`
+	// a fraud risk score of at least this
+	RiskScore int `json:"riskScore,omitempty"`
+}
+
+// holds no receipts; criteria are only applied once configured
+func DefaultReviewPolicy() ReviewPolicy {
+	return ReviewPolicy{}
+}
+
+func (p ReviewPolicy) Validate() error {
+	if p.MaxTotal != "" {
+		if _, err := parseCents(p.MaxTotal); err != nil {
+			return fmt.Errorf("review maxTotal: %w", err)
+		}
+	}
+	if (p.OffHoursFrom == "") != (p.OffHoursTo == "") {
+		return errors.New("review offHoursFrom and offHoursTo must be set together")
+	}
+	for _, clock := range []string{p.OffHoursFrom, p.OffHoursTo} {
+		if _, err := time.Parse("15:04", clock); clock != "" && err != nil {
+			return fmt.Errorf("review off hours: %w", err)
+		}
+	}
+	if p.MaxIdenticalItems < 0 || p.RapidSubmissions < 0 || p.RapidWindowMinutes < 0 || p.RiskScore < 0 {
+		return errors.New("review limits must not be negative")
+	}
+	if p.RapidSubmissions > 0 && p.RapidWindowMinutes == 0 {
+		return errors.New("review rapidSubmissions needs a rapidWindowMinutes")
+	}
+	return nil
+}
+
+func LoadReviewPolicy(path string) (ReviewPolicy, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return ReviewPolicy{}, err
+	}
+	var policy ReviewPolicy
+	if err := json.Unmarshal(data, &policy); err != nil {
+		return ReviewPolicy{}, fmt.Errorf("parsing %s: %w", path, err)
+	}
+	if err := policy.Validate(); err != nil {
+		return ReviewPolicy{}, fmt.Errorf("%s: %w", path, err)
+	}
+	return policy, nil
+}
+
+// returns the reasons the receipt on its own should be reviewed
+func (p ReviewPolicy) risks(receipt Receipt) []string {
+	reasons := []string{}
+	if p.MaxTotal != "" {
+		limit, _ := parseCents(p.MaxTotal)
+		if total, err := parseCents(receipt.Total); err == nil && total > limit {
+			reasons = append(reasons, fmt.Sprintf("total %s is over %s", receipt.Total, p.MaxTotal))
+		}
+	}
+	if p.MaxIdenticalItems > 0 {
+		counts := make(map[string]int)
+		for _, item := range receipt.Items {
+			counts[itemKey(item)]++
+		}
+		for _, item := range receipt.Items {
+			if count := counts[itemKey(item)]; count > p.MaxIdenticalItems {
+				reasons = append(reasons, fmt.Sprintf("%d of %q", count, item.ShortDescription))
+				delete(counts, itemKey(item))
+			}
+		}
+	}
+	if p.OffHoursFrom != "" {
+		at := receipt.PurchaseTime
+		inside := p.OffHoursFrom <= at && at < p.OffHoursTo
+		if p.OffHoursTo <= p.OffHoursFrom {
+			inside = at >= p.OffHoursFrom || at < p.OffHoursTo
+		}
+		if inside {
+			reasons = append(reasons, fmt.Sprintf("purchased at %s, between %s and %s", at, p.OffHoursFrom, p.OffHoursTo))
+		}
+	}
+	return reasons
+}
+
+type pendingReview struct {
+	tenant string
+	heldAt time.Time
+}
+
+// used to decide which receipts are held for review and to keep track of
+// those awaiting a decision
+type ReviewQueue struct {
+	mu     sync.Mutex
+	now    func() time.Time
+	policy ReviewPolicy
+	// each member's recent submissions by tenant and member
+	submissions map[string][]time.Time
+	// the size at which submissions is next swept
+	sweepAt int
+	pending map[uuid.UUID]pendingReview
+}
+
+func NewReviewQueue(policy ReviewPolicy) *ReviewQueue {
+	return &ReviewQueue{
+		now:         time.Now,
+		policy:      policy,
+		submissions: make(map[string][]time.Time),
+		pending:     make(map[uuid.UUID]pendingReview),
+	}
+}
+
+// counts a new submission towards its member's rate and returns the reasons
+// it should be reviewed, if any
+func (q *ReviewQueue) Assess(ctx context.Context, score ReceiptScore) []string {
+	reasons := q.policy.risks(score.Receipt)
+	if q.policy.RiskScore > 0 && score.Risk != nil && score.Risk.Score >= q.policy.RiskScore {
+		reasons = append(reasons, fmt.Sprintf("fraud risk score %d", score.Risk.Score))
+	}
+	if score.MemberID == "" || q.policy.RapidSubmissions == 0 {
+		return reasons
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	now := q.now()
+	key := memberKey(TenantFromContext(ctx), score.MemberID)
+	since := now.Add(-time.Duration(q.policy.RapidWindowMinutes) * time.Minute)
+	recent := slices.DeleteFunc(q.submissions[key], func(at time.Time) bool {
+		return !at.After(since)
+	})
+	recent = append(recent, now)
+	q.submissions[key] = recent
+	sweepWindows(q.submissions, since, func(at time.Time) time.Time { return at }, &q.sweepAt)
+	if len(recent) > q.policy.RapidSubmissions {
+		reasons = append(reasons, fmt.Sprintf("%d submissions within %d minutes", len(recent), q.policy.RapidWindowMinutes))
+	}
+	return reasons
+}
+
+// keeps the queue in step with each committed receipt
+func (q *ReviewQueue) Record(ctx context.Context, score ReceiptScore, exists bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if !exists || score.Status != ReceiptPendingReview {
+		delete(q.pending, score.Id)
+		return
+	}
+	if _, ok := q.pending[score.Id]; !ok {
+		q.pending[score.Id] = pendingReview{tenant: TenantFromContext(ctx), heldAt: q.now()}
+	}
+}
+
+// drops a receipt the store dropped on its own, such as on eviction
+func (q *ReviewQueue) Forget(id uuid.UUID) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	delete(q.pending, id)
+}
+
+// returns the IDs of the tenant's receipts awaiting review, longest waiting
+// first
+func (q *ReviewQueue) Pending(ctx context.Context) []uuid.UUID {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	tenant := TenantFromContext(ctx)
+	ids := []uuid.UUID{}
+	for id, pending := range q.pending {
+		if pending.tenant == tenant {
+			ids = append(ids, id)
+		}
+	}
+	slices.SortFunc(ids, func(a, b uuid.UUID) int {
+		return q.pending[a].heldAt.Compare(q.pending[b].heldAt)
+	})
+	return ids
+}
+
+// holds a new or corrected receipt for review if it meets any criteria
+func (rs *ReceiptServer) assessRisk(ctx context.Context, score *ReceiptScore) {
+	if reasons := rs.reviews.Assess(ctx, *score); len(reasons) > 0 {
+		score.Status = ReceiptPendingReview
+		score.Review = &Review{Reasons: reasons}
+	}
+}
+
+// used to decode the body of the approve and reject endpoints
+type ReviewDecision struct {
+	Reason string `json:"reason"`
+}
+
+func (rs *ReceiptServer) approveReceipt(w http.ResponseWriter, r *http.Request) {
+	rs.decideReview(w, r, EventApproved)
+}
+
+func (rs *ReceiptServer) rejectReceipt(w http.ResponseWriter, r *http.Request) {
+	rs.decideReview(w, r, EventRejected)
+}
+
+// releases the held points of an approved receipt, subject to the member's
+// earning caps, or keeps them from the member for good if it is rejected.
+// Nobody may approve a receipt they submitted themselves
+func (rs *ReceiptServer) decideReview(w http.ResponseWriter, r *http.Request, decision EventType) {
+	ctx := r.Context()
+	id, err := uuid.Parse(r.PathValue("id"))
+	if err != nil {
+		http.Error(w, notFoundMessage, http.StatusNotFound)
+		log.Println(err)
+		return
+	}
+	var body ReviewDecision
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil || body.Reason == "" {
+		writeError(w, ErrInvalidDecision)
+		return
+	}
+
+	rs.commitMu.Lock()
+	defer rs.commitMu.Unlock()
+	current, err := rs.currentVersion(ctx, r, id)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	if current.Status != ReceiptPendingReview {
+		writeError(w, fmt.Errorf("%w: %s", ErrNotPendingReview, current.Status))
+		return
+	}
+	actor := actorFromRequest(r)
+	if decision == EventApproved {
+		history, err := rs.journal.History(ctx, id)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		if history[0].Actor == actor {
+			writeError(w, fmt.Errorf("%w: %s", ErrSelfReview, actor))
+			return
+		}
+	}
+	event := ReceiptEvent{ReceiptID: id, Type: decision, At: rs.processor.now(), Actor: actor, Reason: body.Reason}
+	if decision == EventApproved {
+		approved := current
+		approved.Status = ReceiptAccepted
+		approved.Points = current.RawPoints
+		rs.applyCaps(ctx, &approved)
+		event.Points = &approved.Points
+	}
+	committed, err := rs.commitLocked(ctx, id, current.Version, event)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeReceiptDetails(w, committed)
+}
+
+// used to encode the response to GET /reviews
+type ReviewList struct {
+	Receipts []ReceiptDetails `json:"receipts"`
+}
+
+func (rs *ReceiptServer) listReviews(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	list := ReviewList{Receipts: []ReceiptDetails{}}
+	for _, id := range rs.reviews.Pending(ctx) {
+		score, err := rs.store.Get(ctx, id)
+		if errors.Is(err, ErrReceiptNotFound) || errors.Is(err, ErrReceiptExpired) {
+			continue
+		}
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		list.Receipts = append(list.Receipts, newReceiptDetails(score))
+	}
+	w.Header().Set("Content-Type", jsonContentType)
+	if err := json.NewEncoder(w).Encode(list); err != nil {
+		log.Println(err)
+	}
+}
@@ -0,0 +1,210 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestReviewPolicy(t *testing.T) {
+	receipt := Receipt{
+		Retailer:     "Walgreens",
+		PurchaseDate: "2022-01-02",
+		PurchaseTime: "23:30",
+		Total:        "12.00",
+		Items:        []Item{{"Dasani", "3.00"}, {"dasani ", "3.00"}, {"Dasani", "3.00"}, {"Pepsi", "3.00"}},
+	}
+	cases := []struct {
+		name   string
+		policy ReviewPolicy
+		want   int
+	}{
+		{"no criteria", ReviewPolicy{}, 0},
+		{"total over the limit", ReviewPolicy{MaxTotal: "11.99"}, 1},
+		{"total at the limit", ReviewPolicy{MaxTotal: "12.00"}, 0},
+		{"too many identical items", ReviewPolicy{MaxIdenticalItems: 2}, 1},
+		{"off hours", ReviewPolicy{OffHoursFrom: "23:00", OffHoursTo: "23:59"}, 1},
+		{"off hours past midnight", ReviewPolicy{OffHoursFrom: "22:00", OffHoursTo: "05:00"}, 1},
+		{"outside off hours", ReviewPolicy{OffHoursFrom: "01:00", OffHoursTo: "05:00"}, 0},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			if got := c.policy.risks(receipt); len(got) != c.want {
+				t.Errorf("expected %d reasons but got %v", c.want, got)
+			}
+		})
+	}
+}
+
+func TestManualReview(t *testing.T) {
+	newServer := func(policy ReviewPolicy, options ...MemberOption) *ReceiptServer {
+		return NewReceiptServer(NewReceiptStore(),
+			WithReviews(NewReviewQueue(policy)),
+			WithMembers(NewMemberRegistry(options...)),
+			WithStaff(testReviewer, testAdmin),
+		)
+	}
+
+	t.Run("holds the points of a risky receipt until it is approved", func(t *testing.T) {
+		server := newServer(ReviewPolicy{MaxTotal: "5.00"})
+		corner := postMemberReceipt(t, server, "alice", cornerMarketReceipt)
+
+		assertPointsStatus(t, server, corner, Points{0, ReceiptPendingReview})
+		if member := getMember(t, server, "alice"); member.Balance != 0 {
+			t.Errorf("expected the points to be held but the balance is %d", member.Balance)
+		}
+		var reviews ReviewList
+		getReviewerJSON(t, server, "/reviews", &reviews)
+		if len(reviews.Receipts) != 1 || reviews.Receipts[0].Breakdown.Held != 109 {
+			t.Fatalf("expected the receipt to await review but got %+v", reviews)
+		}
+
+		response := sendReviewDecision(server, corner, "approve", `{"reason": "checked with the store"}`)
+		assertResponseCode(t, response.Code, http.StatusOK)
+		details := decodeDetails(t, response)
+		if details.Review == nil || details.Review.Reviewer != "reviewer" || details.Review.Reason != "checked with the store" {
+			t.Errorf("expected the decision to be recorded but got %+v", details.Review)
+		}
+		assertPointsStatus(t, server, corner, Points{109, ReceiptAccepted})
+		if member := getMember(t, server, "alice"); member.Balance != 109 {
+			t.Errorf("expected a balance of 109 but got %d", member.Balance)
+		}
+		getReviewerJSON(t, server, "/reviews", &reviews)
+		if len(reviews.Receipts) != 0 {
+			t.Errorf("expected no receipts to await review but got %+v", reviews)
+		}
+	})
+
+	t.Run("keeps the points of a rejected receipt", func(t *testing.T) {
+		server := newServer(ReviewPolicy{MaxIdenticalItems: 3})
+		corner := postMemberReceipt(t, server, "alice", cornerMarketReceipt)
+
+		assertResponseCode(t, sendReviewDecision(server, corner, "reject", `{}`).Code, http.StatusBadRequest)
+		assertResponseCode(t, sendReviewDecision(server, corner, "reject", `{"reason": "not a real purchase"}`).Code, http.StatusOK)
+
+		assertPointsStatus(t, server, corner, Points{0, ReceiptRejected})
+		assertResponseCode(t, sendReviewDecision(server, corner, "approve", `{"reason": "changed my mind"}`).Code, http.StatusConflict)
+		if member := getMember(t, server, "alice"); member.Balance != 0 {
+			t.Errorf("expected no points but the balance is %d", member.Balance)
+		}
+	})
+
+	t.Run("needs a reviewer's staff key", func(t *testing.T) {
+		server := newServer(ReviewPolicy{MaxTotal: "5.00"})
+		corner := postMemberReceipt(t, server, "alice", cornerMarketReceipt)
+
+		for _, key := range []string{"", "nope", testAdmin.Key} {
+			for _, request := range []*http.Request{
+				httptest.NewRequest(http.MethodGet, "/reviews", nil),
+				httptest.NewRequest(http.MethodPost, "/receipts/"+corner.Id.String()+"/approve", strings.NewReader(`{"reason": "fine"}`)),
+			} {
+				if key != "" {
+					request.Header.Set(staffKeyHeader, key)
+				}
+				response := httptest.NewRecorder()
+				server.ServeHTTP(response, request)
+
+				want := http.StatusUnauthorized
+				if key == testAdmin.Key {
+					want = http.StatusForbidden
+				}
+				assertResponseCode(t, response.Code, want)
+			}
+		}
+		assertPointsStatus(t, server, corner, Points{0, ReceiptPendingReview})
+	})
+
+	t.Run("refuses to let a reviewer approve their own receipt", func(t *testing.T) {
+		server := newServer(ReviewPolicy{MaxTotal: "2.00"})
+		submissions := []struct {
+			header, value, date string
+		}{
+			{staffKeyHeader, testReviewer.Key, "2022-01-04"},
+			{actorHeader, testReviewer.Name, "2022-01-06"},
+		}
+		for _, submission := range submissions {
+			request := newMemberReceiptRequest("alice", walgreensOn(submission.date))
+			request.Header.Set(submission.header, submission.value)
+			response := httptest.NewRecorder()
+			server.ServeHTTP(response, request)
+			assertResponseCode(t, response.Code, http.StatusOK)
+			walgreens := decodeID(t, response)
+
+			response = sendReviewDecision(server, walgreens, "approve", `{"reason": "looks fine to me"}`)
+
+			assertResponseCode(t, response.Code, http.StatusForbidden)
+			assertResponseBody(t, response.Body.String(), selfReviewMessage+"\n")
+			assertPointsStatus(t, server, walgreens, Points{0, ReceiptPendingReview})
+		}
+	})
+
+	t.Run("holds rapid submissions from a member", func(t *testing.T) {
+		server := newServer(ReviewPolicy{RapidSubmissions: 2, RapidWindowMinutes: 10})
+		postMemberReceipt(t, server, "alice", walgreensOn("2022-01-04"))
+		postMemberReceipt(t, server, "alice", walgreensOn("2022-01-06"))
+		third := postMemberReceipt(t, server, "alice", walgreensOn("2022-01-08"))
+		other := postMemberReceipt(t, server, "bob", walgreensOn("2022-01-10"))
+
+		assertPointsStatus(t, server, third, Points{0, ReceiptPendingReview})
+		assertPointsStatus(t, server, other, Points{15, ReceiptAccepted})
+	})
+
+	t.Run("puts a corrected receipt up for review", func(t *testing.T) {
+		server := newServer(ReviewPolicy{OffHoursFrom: "01:00", OffHoursTo: "05:00"})
+		walgreens := postMemberReceipt(t, server, "alice", walgreensReceipt)
+
+		response := sendCorrection(server, http.MethodPatch, walgreens.Id, "", `{"purchaseTime": "03:00"}`)
+		assertResponseCode(t, response.Code, http.StatusOK)
+
+		assertPointsStatus(t, server, walgreens, Points{0, ReceiptPendingReview})
+		if member := getMember(t, server, "alice"); member.Balance != 0 {
+			t.Errorf("expected the points to be held but the balance is %d", member.Balance)
+		}
+	})
+
+	t.Run("caps the points of an approved receipt", func(t *testing.T) {
+		server := newServer(ReviewPolicy{MaxTotal: "5.00"}, WithEarningCaps(EarningCaps{Daily: 50}))
+		corner := postMemberReceipt(t, server, "alice", cornerMarketReceipt)
+
+		assertResponseCode(t, sendReviewDecision(server, corner, "approve", `{"reason": "fine"}`).Code, http.StatusOK)
+
+		assertBreakdown(t, server, corner, PointsBreakdown{RawPoints: 109, Tier: "bronze", Withheld: 59, Points: 50})
+	})
+}
+
+func sendReviewDecision(server http.Handler, id ID, decision, body string) *httptest.ResponseRecorder {
+	request, _ := http.NewRequest(http.MethodPost, "/receipts/"+id.Id.String()+"/"+decision, strings.NewReader(body))
+	request.Header.Set(staffKeyHeader, testReviewer.Key)
+	response := httptest.NewRecorder()
+	server.ServeHTTP(response, request)
+	return response
+}
+
+var testReviewer = StaffKey{Key: "reviewer-key", Name: "reviewer", Roles: []StaffRole{RoleReviewer}}
+
+func getReviewerJSON(t testing.TB, server http.Handler, path string, v any) {
+	t.Helper()
+	request := httptest.NewRequest(http.MethodGet, path, nil)
+	request.Header.Set(staffKeyHeader, testReviewer.Key)
+	response := httptest.NewRecorder()
+	server.ServeHTTP(response, request)
+	assertResponseCode(t, response.Code, http.StatusOK)
+	err := json.NewDecoder(response.Body).Decode(v)
+	checkDecodeErr(t, response, err)
+}
+
+func assertPointsStatus(t testing.TB, server http.Handler, id ID, want Points) {
+	t.Helper()
+	response := httptest.NewRecorder()
+	server.ServeHTTP(response, newGetPointsRequest(id.Id))
+	assertResponseCode(t, response.Code, http.StatusOK)
+	var got Points
+	if err := json.NewDecoder(response.Body).Decode(&got); err != nil {
+		t.Fatal(err)
+	}
+	if got != want {
+		t.Errorf("expected %+v but got %+v", want, got)
+	}
+}
@@ -0,0 +1,479 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+const DefaultReservationTimeout = 15 * time.Minute
+
+// how long confirmed, cancelled and expired reservations can still be looked up
+const DefaultReservationRetention = 24 * time.Hour
+
+const rewardIDParam = "rewardId"
+const rewardNotFoundMessage = "No reward found for that ID."
+const invalidRewardMessage = "A reward needs a name, a positive cost, an inventory of zero or more and an availability window that ends after it starts."
+const rewardUnavailableMessage = "That reward is not available right now."
+const outOfStockMessage = "Not enough of that reward is left."
+const reservationNotFoundMessage = "No reservation found for that ID."
+const invalidReservationMessage = "A reservation needs a reward ID and a quantity of at least 1."
+const reservationClosedMessage = "The reservation is no longer pending."
+
+var ErrRewardNotFound = errors.New("reward not found")
+var ErrInvalidReward = errors.New("invalid reward")
+var ErrRewardUnavailable = errors.New("reward unavailable")
+var ErrOutOfStock = errors.New("reward out of stock")
+var ErrReservationNotFound = errors.New("reservation not found")
+var ErrInvalidReservation = errors.New("invalid reservation")
+var ErrReservationClosed = errors.New("reservation closed")
+
+const (
+	TransactionReserved TransactionType = "reserved"
+	TransactionReleased TransactionType = "released"
+)
+
+// holds a member's points while a reservation is pending
+func reservedAccount(id string) string {
+	return "reserved:" + id
+}
+
+// something members can spend their points on; the inventory is what is left
+// to reserve, and either end of the availability window may be left open
+type Reward struct {
+	Id             string     `json:"id"`
+	Name           string     `json:"name"`
+	Cost           int        `json:"cost"`
+	Inventory      int        `json:"inventory"`
+	AvailableFrom  *time.Time `json:"availableFrom,omitempty"`
+	AvailableUntil *time.Time `json:"availableUntil,omitempty"`
+}
+
+func (r Reward) Validate() error {
+	if r.Id == "" || strings.Contains(r.Id, "/") || r.Name == "" || r.Cost < 1 || r.Inventory < 0 {
+		return fmt.Errorf("%w: %q", ErrInvalidReward, r.Id)
+	}
+	if r.AvailableFrom != nil && r.AvailableUntil != nil && !r.AvailableUntil.After(*r.AvailableFrom) {
+		return fmt.Errorf("%w: %q is never available", ErrInvalidReward, r.Id)
+	}
+	return nil
+}
+
+func (r Reward) availableAt(at time.Time) bool {
+	if r.AvailableFrom != nil && at.Before(*r.AvailableFrom) {
+		return false
+	}
+	return r.AvailableUntil == nil || at.Before(*r.AvailableUntil)
+}
+
+// sets the catalog every tenant starts with; each tenant then keeps its own
+// inventory
+func WithRewards(rewards []Reward) MemberOption {
+	return func(m *MemberRegistry) {
+		m.rewards = rewards
+	}
+}
+
+// how long reserved points and inventory are held before being released
+func WithReservationTimeout(timeout time.Duration) MemberOption {
+	return func(m *MemberRegistry) {
+		m.reservationTimeout = timeout
+	}
+}
+
+// reads a JSON array of Reward
+func LoadRewards(path string) ([]Reward, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var rewards []Reward
+	if err := json.Unmarshal(data, &rewards); err != nil {
+		return nil, fmt.Errorf("parsing %s: %w", path, err)
+	}
+	ids := make(map[string]bool)
+	for _, reward := range rewards {
+		if err := reward.Validate(); err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+		if ids[reward.Id] {
+			return nil, fmt.Errorf("%s: reward %q is configured twice", path, reward.Id)
+		}
+		ids[reward.Id] = true
+	}
+	return rewards, nil
+}
+
+type ReservationStatus string
+
+const (
+	ReservationPending   ReservationStatus = "pending"
+	ReservationConfirmed ReservationStatus = "confirmed"
+	ReservationCancelled ReservationStatus = "cancelled"
+	ReservationExpired   ReservationStatus = "expired"
+)
+
+// used to decode the body of POST /members/{id}/reservations
+type ReservationRequest struct {
+	RewardID string `json:"rewardId"`
+	// defaults to 1
+	Quantity int `json:"quantity"`
+}
+
+// points and inventory set aside for a member until they confirm or cancel,
+// or until ExpiresAt passes
+type Reservation struct {
+	Id         uuid.UUID         `json:"id"`
+	MemberID   string            `json:"memberId"`
+	RewardID   string            `json:"rewardId"`
+	Quantity   int               `json:"quantity"`
+	Points     int               `json:"points"`
+	Status     ReservationStatus `json:"status"`
+	ReservedAt time.Time         `json:"reservedAt"`
+	ExpiresAt  time.Time         `json:"expiresAt"`
+	ClosedAt   *time.Time        `json:"closedAt,omitempty"`
+	tenant     string
+	// the lots the points were taken from, to put them back on release
+	shares []lotShare
+}
+
+// returns the tenant's rewards, copying the configured catalog on first use;
+// callers must hold m.mu
+func (m *MemberRegistry) catalog(tenant string) map[string]*Reward {
+	catalog, ok := m.catalogs[tenant]
+	if !ok {
+		catalog = make(map[string]*Reward)
+		for _, reward := range m.rewards {
+			catalog[reward.Id] = &reward
+		}
+		m.catalogs[tenant] = catalog
+	}
+	return catalog
+}
+
+// returns the tenant's rewards ordered by ID
+func (m *MemberRegistry) Rewards(ctx context.Context) []Reward {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.releaseReservations()
+	rewards := []Reward{}
+	for _, reward := range m.catalog(TenantFromContext(ctx)) {
+		rewards = append(rewards, *reward)
+	}
+	slices.SortFunc(rewards, func(a, b Reward) int {
+		return strings.Compare(a.Id, b.Id)
+	})
+	return rewards
+}
+
+// adds the reward to the tenant's catalog or replaces it, returning whether it
+// was added
+func (m *MemberRegistry) PutReward(ctx context.Context, reward Reward) (bool, error) {
+	if err := reward.Validate(); err != nil {
+		return false, err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	catalog := m.catalog(TenantFromContext(ctx))
+	_, exists := catalog[reward.Id]
+	catalog[reward.Id] = &reward
+	return !exists, nil
+}
+
+// holds the reward's cost in points and its inventory for the member until
+// the reservation is confirmed, cancelled or times out
+func (m *MemberRegistry) Reserve(ctx context.Context, memberID string, request ReservationRequest) (Reservation, error) {
+	if request.Quantity == 0 {
+		request.Quantity = 1
+	}
+	if request.RewardID == "" || request.Quantity < 1 {
+		return Reservation{}, ErrInvalidReservation
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	tenant := TenantFromContext(ctx)
+	if _, ok := m.members[memberKey(tenant, memberID)]; !ok {
+		return Reservation{}, ErrMemberNotFound
+	}
+	now := m.now()
+	m.releaseReservations()
+	reward, ok := m.catalog(tenant)[request.RewardID]
+	if !ok {
+		return Reservation{}, ErrRewardNotFound
+	}
+	if !reward.availableAt(now) {
+		return Reservation{}, fmt.Errorf("%w: %q", ErrRewardUnavailable, reward.Id)
+	}
+	if reward.Inventory < request.Quantity {
+		return Reservation{}, fmt.Errorf("%w: %d of %q left, %d requested", ErrOutOfStock, reward.Inventory, reward.Id, request.Quantity)
+	}
+	points := reward.Cost * request.Quantity
+	account := memberAccount(memberID)
+	m.ledger.expire(tenant, memberID, now)
+	if available := m.ledger.balance(tenant, account); available < points {
+		return Reservation{}, fmt.Errorf("%w: %d available, %d requested", ErrInsufficientPoints, available, points)
+	}
+
+	reward.Inventory -= request.Quantity
+	reservation := &Reservation{
+		Id:         uuid.New(),
+		MemberID:   memberID,
+		RewardID:   reward.Id,
+		Quantity:   request.Quantity,
+		Points:     points,
+		Status:     ReservationPending,
+		ReservedAt: now,
+		ExpiresAt:  now.Add(m.reservationTimeout),
+		tenant:     tenant,
+		shares:     m.ledger.take(tenant, memberID, points),
+	}
+	m.ledger.post(tenant, LedgerTransaction{
+		Type:     TransactionReserved,
+		At:       now,
+		MemberID: memberID,
+		Reason:   reward.Name,
+		Postings: []Posting{{Account: account, Amount: -points}, {Account: reservedAccount(memberID), Amount: points}},
+	})
+	m.reservations[reservation.Id] = reservation
+	m.pending[reservation.Id] = reservation
+	return *reservation, nil
+}
+
+// returns one of the member's reservations
+func (m *MemberRegistry) Reservation(ctx context.Context, memberID string, id uuid.UUID) (Reservation, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.releaseReservations()
+	reservation, err := m.reservation(ctx, memberID, id)
+	if err != nil {
+		return Reservation{}, err
+	}
+	return *reservation, nil
+}
+
+// callers must hold m.mu
+func (m *MemberRegistry) reservation(ctx context.Context, memberID string, id uuid.UUID) (*Reservation, error) {
+	reservation, ok := m.reservations[id]
+	if !ok || reservation.tenant != TenantFromContext(ctx) || reservation.MemberID != memberID {
+		return nil, ErrReservationNotFound
+	}
+	return reservation, nil
+}
+
+// redeems the points held by a pending reservation
+func (m *MemberRegistry) ConfirmReservation(ctx context.Context, memberID string, id uuid.UUID) (Reservation, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.releaseReservations()
+	reservation, err := m.reservation(ctx, memberID, id)
+	if err != nil {
+		return Reservation{}, err
+	}
+	if reservation.Status != ReservationPending {
+		return Reservation{}, fmt.Errorf("%w: %s", ErrReservationClosed, reservation.Status)
+	}
+	now := m.now()
+	m.ledger.post(reservation.tenant, LedgerTransaction{
+		Type:     TransactionRedeemed,
+		At:       now,
+		MemberID: memberID,
+		Reason:   "reservation " + reservation.Id.String() + " confirmed",
+		Postings: []Posting{{Account: reservedAccount(memberID), Amount: -reservation.Points}, {Account: redeemedAccount, Amount: reservation.Points}},
+	})
+	m.close(reservation, ReservationConfirmed, now)
+	return *reservation, nil
+}
+
+// returns the points and inventory held by a pending reservation
+func (m *MemberRegistry) CancelReservation(ctx context.Context, memberID string, id uuid.UUID) (Reservation, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.releaseReservations()
+	reservation, err := m.reservation(ctx, memberID, id)
+	if err != nil {
+		return Reservation{}, err
+	}
+	if reservation.Status != ReservationPending {
+		return Reservation{}, fmt.Errorf("%w: %s", ErrReservationClosed, reservation.Status)
+	}
+	m.release(reservation, ReservationCancelled, "reservation cancelled", m.now())
+	return *reservation, nil
+}
+
+// releases every pending reservation that has timed out and returns how many
+// there were
+func (m *MemberRegistry) ReleaseReservations() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.releaseReservations()
+}
+
+// callers must hold m.mu
+func (m *MemberRegistry) releaseReservations() int {
+	now := m.now()
+	released := 0
+	for _, reservation := range m.pending {
+		if now.Before(reservation.ExpiresAt) {
+			continue
+		}
+		m.release(reservation, ReservationExpired, "reservation timed out", now)
+		released++
+	}
+	m.pruneReservations(now)
+	return released
+}
+
+// forgets reservations closed longer than the retention ago; callers must hold
+// m.mu
+func (m *MemberRegistry) pruneReservations(now time.Time) {
+	for m.closedReservations.Len() > 0 {
+		front := m.closedReservations.Front()
+		reservation := front.Value.(*Reservation)
+		if now.Before(reservation.ClosedAt.Add(m.reservationRetention)) {
+			return
+		}
+		m.closedReservations.Remove(front)
+		delete(m.reservations, reservation.Id)
+	}
+}
+
+// puts the reservation's points back into the lots they came from, where they
+// expire as they would have, and its quantity back into the reward's
+// inventory; callers must hold m.mu
+func (m *MemberRegistry) release(reservation *Reservation, status ReservationStatus, reason string, at time.Time) {
+	for _, share := range reservation.shares {
+		share.lot.remaining += share.points
+	}
+	m.ledger.post(reservation.tenant, LedgerTransaction{
+		Type:     TransactionReleased,
+		At:       at,
+		MemberID: reservation.MemberID,
+		Reason:   reason,
+		Postings: []Posting{{Account: reservedAccount(reservation.MemberID), Amount: -reservation.Points}, {Account: memberAccount(reservation.MemberID), Amount: reservation.Points}},
+	})
+	if reward, ok := m.catalog(reservation.tenant)[reservation.RewardID]; ok {
+		reward.Inventory += reservation.Quantity
+	}
+	m.close(reservation, status, at)
+}
+
+// cancels pending reservations holding points from the lot until it has the
+// points about to be taken back from it, so that taking back a receipt's or a
+// bonus's points takes back those reserved instead of leaving them to return
+// to the member when the reservation is released; callers must hold m.mu
+func (m *MemberRegistry) reclaim(lotID uuid.UUID, points int) {
+	lot, ok := m.ledger.lotsByReceipt[lotID]
+	if !ok {
+		return
+	}
+	for _, reservation := range m.pending {
+		if lot.remaining >= points {
+			return
+		}
+		if slices.ContainsFunc(reservation.shares, func(share lotShare) bool { return share.lot == lot }) {
+			m.release(reservation, ReservationCancelled, "reserved points taken back", m.now())
+		}
+	}
+}
+
+// callers must hold m.mu
+func (m *MemberRegistry) close(reservation *Reservation, status ReservationStatus, at time.Time) {
+	reservation.Status = status
+	reservation.ClosedAt = &at
+	reservation.shares = nil
+	delete(m.pending, reservation.Id)
+	m.closedReservations.PushBack(reservation)
+}
+
+func (rs *ReceiptServer) listRewards(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", jsonContentType)
+	if err := json.NewEncoder(w).Encode(rs.members.Rewards(r.Context())); err != nil {
+		log.Println(err)
+	}
+}
+
+func (rs *ReceiptServer) putReward(w http.ResponseWriter, r *http.Request) {
+	var reward Reward
+	if err := json.NewDecoder(r.Body).Decode(&reward); err != nil {
+		http.Error(w, invalidRewardMessage, http.StatusBadRequest)
+		log.Println(err)
+		return
+	}
+	id := r.PathValue(rewardIDParam)
+	if reward.Id != "" && reward.Id != id {
+		http.Error(w, invalidRewardMessage, http.StatusBadRequest)
+		return
+	}
+	reward.Id = id
+	created, err := rs.members.PutReward(r.Context(), reward)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", jsonContentType)
+	if created {
+		w.WriteHeader(http.StatusCreated)
+	}
+	if err := json.NewEncoder(w).Encode(reward); err != nil {
+		log.Println(err)
+	}
+}
+
+func (rs *ReceiptServer) reserveReward(w http.ResponseWriter, r *http.Request) {
+	var request ReservationRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		http.Error(w, invalidReservationMessage, http.StatusBadRequest)
+		log.Println(err)
+		return
+	}
+	memberID := r.PathValue("id")
+	reservation, err := rs.members.Reserve(r.Context(), memberID, request)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", jsonContentType)
+	w.Header().Set("Location", "/members/"+memberID+"/reservations/"+reservation.Id.String())
+	w.WriteHeader(http.StatusCreated)
+	if err := json.NewEncoder(w).Encode(reservation); err != nil {
+		log.Println(err)
+	}
+}
+
+func (rs *ReceiptServer) getReservation(w http.ResponseWriter, r *http.Request) {
+	rs.handleReservation(w, r, rs.members.Reservation)
+}
+
+func (rs *ReceiptServer) confirmReservation(w http.ResponseWriter, r *http.Request) {
+	rs.handleReservation(w, r, rs.members.ConfirmReservation)
+}
+
+func (rs *ReceiptServer) cancelReservation(w http.ResponseWriter, r *http.Request) {
+	rs.handleReservation(w, r, rs.members.CancelReservation)
+}
+
+func (rs *ReceiptServer) handleReservation(w http.ResponseWriter, r *http.Request, action func(context.Context, string, uuid.UUID) (Reservation, error)) {
+	id, err := uuid.Parse(r.PathValue("reservationId"))
+	if err != nil {
+		writeError(w, ErrReservationNotFound)
+		return
+	}
+	reservation, err := action(r.Context(), r.PathValue("id"), id)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", jsonContentType)
+	if err := json.NewEncoder(w).Encode(reservation); err != nil {
+		log.Println(err)
+	}
+}
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestRewards(t *testing.T) {
+	start := time.Date(2022, 3, 1, 12, 0, 0, 0, time.UTC)
+	until := start.Add(48 * time.Hour)
+	newServer := func(clock *fakeClock) *ReceiptServer {
+		members := NewMemberRegistry(
+			WithMemberClock(clock.now),
+			WithRewards([]Reward{
+				{Id: "coffee", Name: "Free coffee", Cost: 50, Inventory: 3},
+				{Id: "tote", Name: "Tote bag", Cost: 10, Inventory: 1, AvailableUntil: &until},
+			}),
+		)
+		server := NewReceiptServer(NewReceiptStore(), WithMembers(members), WithStaff(testAdmin))
+		postMemberReceipt(t, server, "alice", cornerMarketReceipt)
+		return server
+	}
+
+	t.Run("confirming a reservation redeems its points", func(t *testing.T) {
+		server := newServer(&fakeClock{current: start})
+		reservation := reserve(t, server, "alice", `{"rewardId": "coffee", "quantity": 2}`)
+		if reservation.Points != 100 || reservation.Status != ReservationPending {
+			t.Fatalf("expected a pending reservation of 100 points but got %+v", reservation)
+		}
+		if member := getMember(t, server, "alice"); member.Balance != 9 || member.Reserved != 100 {
+			t.Errorf("expected 9 points left and 100 reserved but got %+v", member)
+		}
+
+		response := sendRequest(server, http.MethodPost, reservationPath(reservation)+"/confirm", "")
+		assertResponseCode(t, response.Code, http.StatusOK)
+		if member := getMember(t, server, "alice"); member.Balance != 9 || member.Reserved != 0 {
+			t.Errorf("expected 9 points left and none reserved but got %+v", member)
+		}
+		if coffee := getReward(t, server, "coffee"); coffee.Inventory != 1 {
+			t.Errorf("expected 1 coffee left but got %d", coffee.Inventory)
+		}
+		response = sendRequest(server, http.MethodPost, reservationPath(reservation)+"/cancel", "")
+		assertResponseCode(t, response.Code, http.StatusConflict)
+	})
+
+	t.Run("cancelling a reservation returns its points and inventory", func(t *testing.T) {
+		server := newServer(&fakeClock{current: start})
+		reservation := reserve(t, server, "alice", `{"rewardId": "coffee"}`)
+
+		response := sendRequest(server, http.MethodPost, reservationPath(reservation)+"/cancel", "")
+		assertResponseCode(t, response.Code, http.StatusOK)
+		if member := getMember(t, server, "alice"); member.Balance != 109 || member.Reserved != 0 {
+			t.Errorf("expected the full balance back but got %+v", member)
+		}
+		if coffee := getReward(t, server, "coffee"); coffee.Inventory != 3 {
+			t.Errorf("expected 3 coffees left but got %d", coffee.Inventory)
+		}
+	})
+
+	t.Run("releases reservations that time out", func(t *testing.T) {
+		clock := &fakeClock{current: start}
+		server := newServer(clock)
+		reservation := reserve(t, server, "alice", `{"rewardId": "coffee"}`)
+		clock.advance(DefaultReservationTimeout)
+
+		var released Reservation
+		getJSON(t, server, reservationPath(reservation), &released)
+		if released.Status != ReservationExpired {
+			t.Errorf("expected the reservation to have expired but got %q", released.Status)
+		}
+		if member := getMember(t, server, "alice"); member.Balance != 109 {
+			t.Errorf("expected the full balance back but got %d", member.Balance)
+		}
+		response := sendRequest(server, http.MethodPost, reservationPath(reservation)+"/confirm", "")
+		assertResponseCode(t, response.Code, http.StatusConflict)
+	})
+
+	t.Run("forgets closed reservations after the retention", func(t *testing.T) {
+		clock := &fakeClock{current: start}
+		server := newServer(clock)
+		reservation := reserve(t, server, "alice", `{"rewardId": "coffee"}`)
+		response := sendRequest(server, http.MethodPost, reservationPath(reservation)+"/confirm", "")
+		assertResponseCode(t, response.Code, http.StatusOK)
+
+		clock.advance(DefaultReservationRetention - time.Minute)
+		response = sendRequest(server, http.MethodGet, reservationPath(reservation), "")
+		assertResponseCode(t, response.Code, http.StatusOK)
+
+		clock.advance(time.Minute)
+		response = sendRequest(server, http.MethodGet, reservationPath(reservation), "")
+		assertResponseCode(t, response.Code, http.StatusNotFound)
+		if len(server.members.reservations) != 0 {
+			t.Errorf("expected no reservations left but got %d", len(server.members.reservations))
+		}
+	})
+
+	t.Run("takes back reserved points when the receipt that earned them is deleted", func(t *testing.T) {
+		members := NewMemberRegistry(WithMemberClock((&fakeClock{current: start}).now), WithRewards([]Reward{{Id: "coffee", Name: "Free coffee", Cost: 50, Inventory: 3}}))
+		server := NewReceiptServer(NewReceiptStore(), WithMembers(members), WithStaff(testAdmin))
+		corner := postMemberReceipt(t, server, "alice", cornerMarketReceipt)
+		reservation := reserve(t, server, "alice", `{"rewardId": "coffee", "quantity": 2}`)
+
+		response := sendRequest(server, http.MethodDelete, "/receipts/"+corner.Id.String(), "")
+		assertResponseCode(t, response.Code, http.StatusNoContent)
+		response = sendRequest(server, http.MethodPost, reservationPath(reservation)+"/cancel", "")
+		assertResponseCode(t, response.Code, http.StatusConflict)
+
+		if member := getMember(t, server, "alice"); member.Balance != 0 || member.Reserved != 0 {
+			t.Errorf("expected no points left or reserved but got %+v", member)
+		}
+		if coffee := getReward(t, server, "coffee"); coffee.Inventory != 3 {
+			t.Errorf("expected 3 coffees left but got %d", coffee.Inventory)
+		}
+		var reconciliation Reconciliation
+		getAdminJSON(t, server, "/admin/reconcile", &reconciliation)
+		if !reconciliation.Balanced {
+			t.Errorf("expected the ledger to reconcile but got %+v", reconciliation)
+		}
+	})
+
+	t.Run("refuses rewards that cannot be reserved", func(t *testing.T) {
+		clock := &fakeClock{current: start}
+		server := newServer(clock)
+
+		assertResponseCode(t, sendReservation(server, "alice", `{"rewardId": "coffee", "quantity": 3}`).Code, http.StatusUnprocessableEntity)
+		assertResponseCode(t, sendReservation(server, "alice", `{"rewardId": "coffee", "quantity": 4}`).Code, http.StatusConflict)
+		assertResponseCode(t, sendReservation(server, "alice", `{"rewardId": "mug"}`).Code, http.StatusNotFound)
+		assertResponseCode(t, sendReservation(server, "alice", `{"quantity": 1}`).Code, http.StatusBadRequest)
+		clock.advance(48 * time.Hour)
+		response := sendReservation(server, "alice", `{"rewardId": "tote"}`)
+		assertResponseCode(t, response.Code, http.StatusConflict)
+		assertResponseBody(t, response.Body.String(), rewardUnavailableMessage+"\n")
+	})
+
+	t.Run("never reserves more than the inventory under concurrent reservations", func(t *testing.T) {
+		server := newServer(&fakeClock{current: start})
+		postMemberReceipt(t, server, "bob", walgreensReceipt)
+
+		var wg sync.WaitGroup
+		var mu sync.Mutex
+		reserved := 0
+		for _, member := range []string{"alice", "bob", "alice", "bob"} {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				if sendReservation(server, member, `{"rewardId": "tote"}`).Code == http.StatusCreated {
+					mu.Lock()
+					reserved++
+					mu.Unlock()
+				}
+			}()
+		}
+		wg.Wait()
+
+		if reserved != 1 {
+			t.Errorf("expected 1 reservation to succeed but %d did", reserved)
+		}
+	})
+
+	t.Run("keeps a catalog per tenant", func(t *testing.T) {
+		server := newServer(&fakeClock{current: start})
+		response := sendAdminRequest(server, http.MethodPut, "/admin/rewards/mug", `{"name": "Mug", "cost": 200, "inventory": 5}`)
+		assertResponseCode(t, response.Code, http.StatusCreated)
+
+		var rewards []Reward
+		getJSON(t, server, "/rewards", &rewards)
+		if len(rewards) != 3 {
+			t.Errorf("expected 3 rewards but got %+v", rewards)
+		}
+		getJSON(t, server, "/tenants/acme/rewards", &rewards)
+		if len(rewards) != 2 {
+			t.Errorf("expected another tenant to keep 2 rewards but got %+v", rewards)
+		}
+	})
+}
+
+func sendReservation(server http.Handler, member, body string) *httptest.ResponseRecorder {
+	request, _ := http.NewRequest(http.MethodPost, "/members/"+member+"/reservations", strings.NewReader(body))
+	response := httptest.NewRecorder()
+	server.ServeHTTP(response, request)
+	return response
+}
+
+func reserve(t testing.TB, server http.Handler, member, body string) Reservation {
+	t.Helper()
+	response := sendReservation(server, member, body)
+	assertResponseCode(t, response.Code, http.StatusCreated)
+	var reservation Reservation
+	decodeJSON(t, response, &reservation)
+	return reservation
+}
+
+func reservationPath(reservation Reservation) string {
+	return "/members/" + reservation.MemberID + "/reservations/" + reservation.Id.String()
+}
+
+func getReward(t testing.TB, server http.Handler, id string) Reward {
+	t.Helper()
+	var rewards []Reward
+	getJSON(t, server, "/rewards", &rewards)
+	for _, reward := range rewards {
+		if reward.Id == id {
+			return reward
+		}
+	}
+	t.Fatalf("no reward %q in %+v", id, rewards)
+	return Reward{}
+}
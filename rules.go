@@ -0,0 +1,65 @@
+package main
+
+import (
+	"fmt"
+	"math"
+)
+
+type scoringRule struct {
+	name   string
+	points func(Receipt) int
+}
+
+var scoringRules = []scoringRule{
+	{"retailerName", func(r Receipt) int { return namePoints(r.Retailer) }},
+	{"roundDollarTotal", func(r Receipt) int { return roundDollarPoints(r.Total) }},
+	{"quarterMultipleTotal", func(r Receipt) int { return multiplesOfQuartersPoints(r.Total) }},
+	{"itemPairs", func(r Receipt) int { return itemPairPoints(len(r.Items)) }},
+	{"itemDescriptions", func(r Receipt) int { return itemPoints(r.Items) }},
+	{"oddPurchaseDay", func(r Receipt) int { return purchaseDatePoints(r.PurchaseDate) }},
+	{"afternoonPurchase", func(r Receipt) int { return purchaseTimePoints(r.PurchaseTime) }},
+}
+
+// the zero value scores receipts with every rule at its standard weight
+type ScoringRules struct {
+	// multiplies the points from each named rule; rules missing from the map
+	// keep a weight of 1 and a weight of 0 disables a rule
+	Weights map[string]float64 `json:"weights,omitempty"`
+}
+
+func (s ScoringRules) Validate() error {
+	for name, weight := range s.Weights {
+		if !isScoringRule(name) {
+			return fmt.Errorf("unknown scoring rule %q", name)
+		}
+		if weight < 0 {
+			return fmt.Errorf("scoring rule %q has a negative weight", name)
+		}
+	}
+	return nil
+}
+
+func (s ScoringRules) Points(receipt Receipt) int {
+	sum := 0
+	for _, rule := range scoringRules {
+		sum += s.weigh(rule.name, rule.points(receipt))
+	}
+	return sum
+}
+
+func (s ScoringRules) weigh(name string, points int) int {
+	weight, ok := s.Weights[name]
+	if !ok {
+		return points
+	}
+	return int(math.Round(float64(points) * weight))
+}
+
+func isScoringRule(name string) bool {
+	for _, rule := range scoringRules {
+		if rule.name == name {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,23 @@
+package main
+
+import "testing"
+
+func TestScoringRules(t *testing.T) {
+	receipt := Receipt{
+		Retailer:     "Target",
+		PurchaseDate: "2022-01-01",
+		PurchaseTime: "13:01",
+		Items:        []Item{{ShortDescription: "Mountain Dew 12PK", Price: "6.49"}},
+		Total:        "6.49",
+	}
+
+	t.Run("zero value matches calculatePoints", func(t *testing.T) {
+		assertExpectedPoints(t, ScoringRules{}.Points(receipt), calculatePoints(receipt))
+	})
+
+	t.Run("weights scale and disable rules", func(t *testing.T) {
+		rules := ScoringRules{Weights: map[string]float64{"retailerName": 2, "oddPurchaseDay": 0}}
+		// the retailer name doubles from 6 to 12 points while the 6 odd day points are dropped
+		assertExpectedPoints(t, rules.Points(receipt), calculatePoints(receipt))
+	})
+}
@@ -1,10 +1,16 @@
 package main
 
 import (
+	"cmp"
+	"context"
 	"encoding/json"
+	"errors"
 	"io"
 	"log"
 	"net/http"
+	"strconv"
+	"sync"
+	"time"
 
 	"github.com/google/uuid"
 )
@@ -12,6 +18,8 @@ import (
 const jsonContentType = "application/json"
 const notFoundMessage = "No receipt found for that ID."
 const badRequestMessage = "The receipt is invalid."
+const goneMessage = "That receipt has expired and is no longer available."
+const internalErrorMessage = "The receipt could not be processed."
 
 // used to encode the response to the POST /receipts/process route
 type ID struct {
@@ -20,31 +28,201 @@ type ID struct {
 
 // used to encode the response to the GET /receipts/{id}/points
 type Points struct {
-	Points int `json:"points"`
+	Points int           `json:"points"`
+	Status ReceiptStatus `json:"status"`
+}
+
+// used to encode the response to GET /receipts/{id}, with the receipt's
+// fields named as they were submitted
+type ReceiptDetails struct {
+	Id uuid.UUID `json:"id"`
+	Receipt
+	Points      int             `json:"points"`
+	ProcessedAt time.Time       `json:"processedAt"`
+	MemberID    string          `json:"memberId,omitempty"`
+	Tier        string          `json:"tier,omitempty"`
+	Breakdown   PointsBreakdown `json:"breakdown"`
+	Status      ReceiptStatus   `json:"status"`
+	Review      *Review         `json:"review,omitempty"`
+	Risk        *RiskAssessment `json:"risk,omitempty"`
+	Refunds     []Refund        `json:"refunds,omitempty"`
+	Warnings    []string        `json:"warnings"`
+}
+
+func newReceiptDetails(score ReceiptScore) ReceiptDetails {
+	return ReceiptDetails{
+		Id:          score.Id,
+		Receipt:     score.Receipt,
+		Points:      score.Points,
+		ProcessedAt: score.ProcessedAt,
+		MemberID:    score.MemberID,
+		Tier:        score.Tier,
+		Breakdown:   newPointsBreakdown(score),
+		Status:      score.Status,
+		Review:      score.Review,
+		Risk:        score.Risk,
+		Refunds:     score.Refunds,
+		Warnings:    score.Warnings(),
+	}
 }
 
 type ReceiptServer struct {
-	store ReceiptStore
+	store       ReceiptStore
+	processor   *ReceiptProcessor
+	duplicates  *DuplicateDetector
+	idempotency *IdempotencyStore
+	journal     EventJournal
+	tenants     *TenantRegistry
+	jobs        *JobQueue
+	aggregates  *Aggregates
+	members     *MemberRegistry
+	reviews     *ReviewQueue
+	fraud       *FraudDetector
+	staff       map[string]StaffKey
+	// serializes commits so each folds onto the latest history
+	commitMu sync.Mutex
 	http.Handler
 }
 
-type ReceiptStore interface {
-	GetPoints(uuid.UUID) (int, error)
-	ProcessReceipt(uuid.UUID, io.Reader) error
+// implemented by stores that drop receipts on their own, such as under a
+// retention policy, so that their history can be dropped too
+type evictionNotifier interface {
+	OnEvict(func(uuid.UUID))
 }
 
-func NewReceiptServer(store ReceiptStore) *ReceiptServer {
+type ServerOption func(*ReceiptServer)
+
+func WithDuplicatePolicy(policy DuplicatePolicy) ServerOption {
+	return func(rs *ReceiptServer) {
+		rs.duplicates = NewDuplicateDetector(policy)
+	}
+}
+
+func WithIdempotencyWindow(window time.Duration) ServerOption {
+	return func(rs *ReceiptServer) {
+		rs.idempotency = NewIdempotencyStore(window)
+	}
+}
+
+func WithEventJournal(journal EventJournal) ServerOption {
+	return func(rs *ReceiptServer) {
+		rs.journal = journal
+	}
+}
+
+func WithTenants(tenants *TenantRegistry) ServerOption {
+	return func(rs *ReceiptServer) {
+		rs.tenants = tenants
+	}
+}
+
+func WithJobQueue(jobs *JobQueue) ServerOption {
+	return func(rs *ReceiptServer) {
+		rs.jobs = jobs
+	}
+}
+
+func WithMembers(members *MemberRegistry) ServerOption {
+	return func(rs *ReceiptServer) {
+		rs.members = members
+	}
+}
+
+func WithReviews(reviews *ReviewQueue) ServerOption {
+	return func(rs *ReceiptServer) {
+		rs.reviews = reviews
+	}
+}
+
+func WithFraudDetector(fraud *FraudDetector) ServerOption {
+	return func(rs *ReceiptServer) {
+		rs.fraud = fraud
+	}
+}
+
+func NewReceiptServer(store ReceiptStore, options ...ServerOption) *ReceiptServer {
 	router := http.NewServeMux()
 
-	rs := &ReceiptServer{store: store}
+	rs := &ReceiptServer{
+		store:       store,
+		processor:   NewReceiptProcessor(),
+		duplicates:  NewDuplicateDetector(DefaultDuplicatePolicy()),
+		idempotency: NewIdempotencyStore(DefaultIdempotencyWindow),
+		journal:     NewEventJournal(),
+		tenants:     &TenantRegistry{},
+		jobs:        NewJobQueue(DefaultJobWorkers, DefaultJobQueueDepth),
+		aggregates:  NewAggregates(),
+		members:     NewMemberRegistry(),
+		reviews:     NewReviewQueue(DefaultReviewPolicy()),
+		fraud:       NewFraudDetector(DefaultFraudPolicy()),
+	}
+	for _, option := range options {
+		option(rs)
+	}
+	if notifier, ok := store.(evictionNotifier); ok {
+		notifier.OnEvict(rs.aggregates.Forget)
+		notifier.OnEvict(rs.members.Forget)
+		notifier.OnEvict(rs.reviews.Forget)
+		if journal, ok := rs.journal.(*InMemoryEventJournal); ok {
+			notifier.OnEvict(journal.Forget)
+		}
+	}
 
+	router.Handle("GET /receipts", http.HandlerFunc(rs.listReceipts))
+	router.Handle("GET /receipts/{id}", http.HandlerFunc(rs.getReceipt))
+	router.Handle("PUT /receipts/{id}", http.HandlerFunc(rs.replaceReceipt))
+	router.Handle("PATCH /receipts/{id}", http.HandlerFunc(rs.patchReceipt))
+	router.Handle("DELETE /receipts/{id}", http.HandlerFunc(rs.deleteReceipt))
+	router.Handle("POST /receipts/{id}/restore", http.HandlerFunc(rs.restoreReceipt))
 	router.Handle("GET /receipts/{id}/points", http.HandlerFunc(rs.getReceiptPointsTotal))
-	router.Handle("POST /receipts/process", http.HandlerFunc(rs.processReceipt))
-	rs.Handler = router
+	router.Handle("GET /receipts/{id}/history", http.HandlerFunc(rs.getReceiptHistory))
+	router.Handle("POST /receipts/{id}/approve", rs.requireRole(RoleReviewer, rs.approveReceipt))
+	router.Handle("POST /receipts/{id}/reject", rs.requireRole(RoleReviewer, rs.rejectReceipt))
+	router.Handle("GET /reviews", rs.requireRole(RoleReviewer, rs.listReviews))
+	router.Handle("POST /receipts/batch", rs.idempotency.Middleware(rs.processBatch))
+	router.Handle("POST /receipts/process", rs.idempotency.Middleware(rs.processReceipt))
+	router.Handle("POST /receipts/refunds", rs.idempotency.Middleware(rs.refundReceipt))
+	router.Handle("GET /jobs/{id}", http.HandlerFunc(rs.getJob))
+	router.Handle("GET /members/{id}/balance", http.HandlerFunc(rs.getMemberBalance))
+	router.Handle("GET /members/{id}/ledger", http.HandlerFunc(rs.getMemberLedger))
+	router.Handle("GET /members/{id}/challenges", http.HandlerFunc(rs.getMemberChallenges))
+	router.Handle("GET /members/{id}/tiers", http.HandlerFunc(rs.getMemberTiers))
+	router.Handle("GET /members/{id}/expirations", http.HandlerFunc(rs.getMemberExpirations))
+	router.Handle("POST /members/{id}/redemptions", rs.idempotency.Middleware(rs.redeemPoints))
+	router.Handle("POST /members/{id}/reservations", rs.idempotency.Middleware(rs.reserveReward))
+	router.Handle("GET /members/{id}/reservations/{reservationId}", http.HandlerFunc(rs.getReservation))
+	router.Handle("POST /members/{id}/reservations/{reservationId}/confirm", http.HandlerFunc(rs.confirmReservation))
+	router.Handle("POST /members/{id}/reservations/{reservationId}/cancel", http.HandlerFunc(rs.cancelReservation))
+	router.Handle("GET /rewards", http.HandlerFunc(rs.listRewards))
+	router.Handle("GET /stats/summary", rs.statsHandler(rs.summaryStats))
+	router.Handle("GET /stats/retailers", rs.statsHandler(rs.retailerStats))
+	router.Handle("GET /stats/days", rs.statsHandler(rs.dailyStats))
+	router.Handle("GET /stats/items", rs.statsHandler(rs.itemCountStats))
+	router.Handle("GET /stats/leaderboard", rs.statsHandler(rs.leaderboard))
+	router.Handle("GET /admin/export", rs.requireRole(RoleAdmin, rs.exportReceipts))
+	router.Handle("POST /admin/import", rs.requireRole(RoleAdmin, rs.importReceipts))
+	router.Handle("GET /admin/reconcile", rs.requireRole(RoleAdmin, rs.reconcileLedger))
+	router.Handle("PUT /admin/rewards/{rewardId}", rs.requireRole(RoleAdmin, rs.putReward))
+	rs.Handler = rs.tenants.Middleware(submitterMiddleware(rs.staffMiddleware(router)))
 
 	return rs
 }
 
+func (rs *ReceiptServer) getReceipt(w http.ResponseWriter, r *http.Request) {
+	id, err := uuid.Parse(r.PathValue("id"))
+	if err != nil {
+		http.Error(w, notFoundMessage, http.StatusNotFound)
+		log.Println(err)
+		return
+	}
+	receiptScore, err := rs.store.Get(r.Context(), id)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeReceiptDetails(w, receiptScore)
+}
+
 func (rs *ReceiptServer) getReceiptPointsTotal(w http.ResponseWriter, r *http.Request) {
 	id := r.PathValue("id")
 	uuid, err := uuid.Parse(id)
@@ -53,33 +231,65 @@ func (rs *ReceiptServer) getReceiptPointsTotal(w http.ResponseWriter, r *http.Re
 		log.Println(err)
 		return
 	}
-	points, err := rs.store.GetPoints(uuid)
+	receiptScore, err := rs.store.Get(r.Context(), uuid)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", jsonContentType)
+	err = json.NewEncoder(w).Encode(Points{receiptScore.Points, receiptScore.Status})
 	if err != nil {
 		http.Error(w, notFoundMessage, http.StatusNotFound)
 		log.Println(err)
 		return
 	}
-	w.Header().Set("Content-Type", jsonContentType)
-	err = json.NewEncoder(w).Encode(Points{points})
+}
+
+func (rs *ReceiptServer) getReceiptHistory(w http.ResponseWriter, r *http.Request) {
+	id, err := uuid.Parse(r.PathValue("id"))
 	if err != nil {
 		http.Error(w, notFoundMessage, http.StatusNotFound)
 		log.Println(err)
 		return
 	}
+	events, err := rs.journal.History(r.Context(), id)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", jsonContentType)
+	err = json.NewEncoder(w).Encode(events)
+	if err != nil {
+		log.Println(err)
+	}
+}
+
+// stops accepting asynchronous submissions and waits for queued ones to be
+// processed or ctx to be done
+func (rs *ReceiptServer) Shutdown(ctx context.Context) error {
+	return rs.jobs.Close(ctx)
 }
 
 func (rs *ReceiptServer) processReceipt(w http.ResponseWriter, r *http.Request) {
-	id := uuid.New()
-	err := rs.store.ProcessReceipt(id, r.Body)
+	async, err := strconv.ParseBool(cmp.Or(r.URL.Query().Get("async"), "false"))
+	if err != nil {
+		http.Error(w, "The async parameter must be true or false.", http.StatusBadRequest)
+		return
+	}
+	if async {
+		rs.enqueueReceipt(w, r)
+		return
+	}
+
+	receiptScore, err := rs.ingest(r.Context(), r.Body, actorFromRequest(r), r.URL.Query().Get(memberIDParam))
 
 	if err != nil {
-		http.Error(w, badRequestMessage, http.StatusBadRequest)
-		log.Println(err)
+		writeError(w, err)
 		return
 	}
 
 	w.Header().Set("Content-Type", jsonContentType)
-	uuid := ID{id}
+	uuid := ID{receiptScore.Id}
 	err = json.NewEncoder(w).Encode(uuid)
 
 	if err != nil {
@@ -88,3 +298,245 @@ func (rs *ReceiptServer) processReceipt(w http.ResponseWriter, r *http.Request)
 		return
 	}
 }
+
+// parses, scores and stores a newly submitted receipt under a fresh ID,
+// crediting its points to memberID unless that is empty
+func (rs *ReceiptServer) ingest(ctx context.Context, body io.Reader, actor, memberID string) (ReceiptScore, error) {
+	receiptScore, err := rs.prepare(ctx, body, memberID)
+	if err != nil {
+		return ReceiptScore{}, err
+	}
+
+	committed, err := rs.commitSubmission(ctx, receiptScore, actor)
+	if err != nil {
+		rs.duplicates.Release(receiptScore)
+		return ReceiptScore{}, err
+	}
+	rs.duplicates.Confirm(committed)
+	return committed, nil
+}
+
+// scores a new receipt and claims its fingerprints without storing it; the
+// caller must commit it and confirm the claim or release it
+func (rs *ReceiptServer) prepare(ctx context.Context, body io.Reader, memberID string) (ReceiptScore, error) {
+	if memberID != "" {
+		if err := ValidateMemberID(memberID); err != nil {
+			return ReceiptScore{}, err
+		}
+	}
+	receiptScore, err := rs.processor.Process(uuid.New(), body, rs.tenantConfig(ctx).Rules)
+	if err != nil {
+		return ReceiptScore{}, err
+	}
+	receiptScore.Tenant = TenantFromContext(ctx)
+	receiptScore.MemberID = memberID
+	if memberID != "" {
+		rs.applyTier(ctx, &receiptScore)
+	}
+	if err := rs.assessFraud(ctx, &receiptScore); err != nil {
+		return ReceiptScore{}, err
+	}
+	rs.assessRisk(ctx, &receiptScore)
+
+	err = rs.duplicates.Claim(ctx, rs.store, &receiptScore)
+	if err != nil {
+		return ReceiptScore{}, err
+	}
+	return receiptScore, nil
+}
+
+// records events against a receipt and stores the state folded from its whole
+// history, so the store only ever holds a projection of the journal
+func (rs *ReceiptServer) commit(ctx context.Context, id uuid.UUID, events ...ReceiptEvent) (ReceiptScore, error) {
+	return rs.commitIf(ctx, id, anyVersion, events...)
+}
+
+// like commit, but fails with ErrVersionMismatch unless the receipt is still
+// at the expected version
+func (rs *ReceiptServer) commitIf(ctx context.Context, id uuid.UUID, expected int, events ...ReceiptEvent) (ReceiptScore, error) {
+	rs.commitMu.Lock()
+	defer rs.commitMu.Unlock()
+	return rs.commitLocked(ctx, id, expected, events...)
+}
+
+// callers must hold rs.commitMu
+func (rs *ReceiptServer) commitLocked(ctx context.Context, id uuid.UUID, expected int, events ...ReceiptEvent) (ReceiptScore, error) {
+	staged, err := rs.stage(ctx, id, expected, events...)
+	if err != nil {
+		return ReceiptScore{}, err
+	}
+	if staged.exists && !staged.existed {
+		err = rs.checkQuota(ctx, 1)
+		if err != nil {
+			return ReceiptScore{}, err
+		}
+	}
+	err = rs.project(ctx, id, staged.current, staged.exists)
+	if err != nil {
+		return ReceiptScore{}, err
+	}
+	err = rs.journal.Append(ctx, staged.events...)
+	if err != nil {
+		if revertErr := rs.project(context.WithoutCancel(ctx), id, staged.previous, staged.existed); revertErr != nil {
+			log.Println(revertErr)
+		}
+		return ReceiptScore{}, err
+	}
+	rs.record(ctx, staged)
+	return staged.current, nil
+}
+
+// events folded onto a receipt's history but not yet recorded or projected
+type stagedCommit struct {
+	events            []ReceiptEvent
+	previous, current ReceiptScore
+	existed, exists   bool
+}
+
+// callers must hold rs.commitMu
+func (rs *ReceiptServer) stage(ctx context.Context, id uuid.UUID, expected int, events ...ReceiptEvent) (stagedCommit, error) {
+	history, err := rs.journal.History(ctx, id)
+	if err != nil && !errors.Is(err, ErrNoHistory) {
+		return stagedCommit{}, err
+	}
+	previous, existed := foldEvents(history)
+	if expected != anyVersion && previous.Version != expected {
+		return stagedCommit{}, ErrVersionMismatch
+	}
+	for i := range events {
+		events[i].Sequence = len(history) + i + 1
+	}
+	current, exists := foldEvents(append(history, events...))
+	return stagedCommit{events: events, previous: previous, current: current, existed: existed, exists: exists}, nil
+}
+
+// keeps the read models in step with a commit once it is recorded
+func (rs *ReceiptServer) record(ctx context.Context, staged stagedCommit) {
+	rs.aggregates.Record(ctx, staged.current, staged.exists)
+	rs.members.Record(ctx, staged.current, staged.exists)
+	rs.reviews.Record(ctx, staged.current, staged.exists)
+}
+
+// implemented by stores that can count a tenant's receipts without listing them
+type receiptCounter interface {
+	Count(ctx context.Context) (int, error)
+}
+
+// returns how many more receipts the tenant may store, and false if it has no
+// quota; callers must hold rs.commitMu so that concurrent commits cannot both
+// take the last slot in a quota
+func (rs *ReceiptServer) quotaRoom(ctx context.Context) (int, bool, error) {
+	limit := rs.tenantConfig(ctx).MaxReceipts
+	if limit <= 0 {
+		return 0, false, nil
+	}
+	var count int
+	if counter, ok := rs.store.(receiptCounter); ok {
+		var err error
+		count, err = counter.Count(ctx)
+		if err != nil {
+			return 0, true, err
+		}
+	} else {
+		scores, err := rs.store.List(ctx)
+		if err != nil {
+			return 0, true, err
+		}
+		count = len(scores)
+	}
+	return max(limit-count, 0), true, nil
+}
+
+// fails with ErrQuotaExceeded unless the tenant may store adding more
+// receipts; callers must hold rs.commitMu
+func (rs *ReceiptServer) checkQuota(ctx context.Context, adding int) error {
+	room, limited, err := rs.quotaRoom(ctx)
+	if err != nil {
+		return err
+	}
+	if limited && adding > room {
+		return ErrQuotaExceeded
+	}
+	return nil
+}
+
+func (rs *ReceiptServer) tenantConfig(ctx context.Context) TenantConfig {
+	config, _ := rs.tenants.Config(TenantFromContext(ctx))
+	return config
+}
+
+func (rs *ReceiptServer) project(ctx context.Context, id uuid.UUID, score ReceiptScore, exists bool) error {
+	if exists {
+		return rs.store.Save(ctx, score)
+	}
+	err := rs.store.Delete(ctx, id)
+	if errors.Is(err, ErrReceiptNotFound) {
+		return nil
+	}
+	return err
+}
+
+// used to map errors from processing and storage onto a response
+func writeError(w http.ResponseWriter, err error) {
+	log.Println(err)
+	var duplicate *DuplicateError
+	switch {
+	case errors.Is(err, ErrInvalidReceipt):
+		http.Error(w, badRequestMessage, http.StatusBadRequest)
+	case errors.Is(err, ErrInvalidListQuery), errors.Is(err, ErrInvalidStatsQuery):
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	case errors.As(err, &duplicate):
+		w.Header().Set("Content-Type", jsonContentType)
+		w.WriteHeader(http.StatusConflict)
+		json.NewEncoder(w).Encode(ID{duplicate.OriginalID})
+	case errors.Is(err, ErrReceiptNotFound), errors.Is(err, ErrNoHistory):
+		http.Error(w, notFoundMessage, http.StatusNotFound)
+	case errors.Is(err, ErrReceiptExpired):
+		http.Error(w, goneMessage, http.StatusGone)
+	case errors.Is(err, ErrVersionMismatch):
+		http.Error(w, versionMismatchMessage, http.StatusPreconditionFailed)
+	case errors.Is(err, ErrNotDeleted):
+		http.Error(w, notDeletedMessage, http.StatusConflict)
+	case errors.Is(err, ErrQuotaExceeded):
+		http.Error(w, quotaExceededMessage, http.StatusForbidden)
+	case errors.Is(err, ErrSubmissionBlocked):
+		http.Error(w, blockedMessage, http.StatusForbidden)
+	case errors.Is(err, ErrInvalidDecision):
+		http.Error(w, invalidDecisionMessage, http.StatusBadRequest)
+	case errors.Is(err, ErrNotPendingReview):
+		http.Error(w, notPendingReviewMessage, http.StatusConflict)
+	case errors.Is(err, ErrSelfReview):
+		http.Error(w, selfReviewMessage, http.StatusForbidden)
+	case errors.Is(err, ErrInvalidRefund):
+		http.Error(w, invalidRefundMessage, http.StatusUnprocessableEntity)
+	case errors.Is(err, ErrInvalidMemberID):
+		http.Error(w, invalidMemberIDMessage, http.StatusBadRequest)
+	case errors.Is(err, ErrMemberNotFound):
+		http.Error(w, memberNotFoundMessage, http.StatusNotFound)
+	case errors.Is(err, ErrInvalidRedemption):
+		http.Error(w, invalidRedemptionMessage, http.StatusBadRequest)
+	case errors.Is(err, ErrInsufficientPoints):
+		http.Error(w, insufficientPointsMessage, http.StatusUnprocessableEntity)
+	case errors.Is(err, ErrRewardNotFound):
+		http.Error(w, rewardNotFoundMessage, http.StatusNotFound)
+	case errors.Is(err, ErrInvalidReward):
+		http.Error(w, invalidRewardMessage, http.StatusBadRequest)
+	case errors.Is(err, ErrRewardUnavailable):
+		http.Error(w, rewardUnavailableMessage, http.StatusConflict)
+	case errors.Is(err, ErrOutOfStock):
+		http.Error(w, outOfStockMessage, http.StatusConflict)
+	case errors.Is(err, ErrReservationNotFound):
+		http.Error(w, reservationNotFoundMessage, http.StatusNotFound)
+	case errors.Is(err, ErrInvalidReservation):
+		http.Error(w, invalidReservationMessage, http.StatusBadRequest)
+	case errors.Is(err, ErrReservationClosed):
+		http.Error(w, reservationClosedMessage, http.StatusConflict)
+	case errors.Is(err, ErrJobNotFound):
+		http.Error(w, jobNotFoundMessage, http.StatusNotFound)
+	case errors.Is(err, ErrQueueFull), errors.Is(err, ErrQueueClosed):
+		w.Header().Set("Retry-After", queueFullRetryAfter)
+		http.Error(w, queueFullMessage, http.StatusServiceUnavailable)
+	default:
+		http.Error(w, internalErrorMessage, http.StatusInternalServerError)
+	}
+}
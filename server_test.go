@@ -2,6 +2,7 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"net/http"
 	"net/http/httptest"
@@ -89,7 +90,10 @@ func TestProcessingReceiptsAndFetchingThem(t *testing.T) {
 func TestGetReceiptPoints(t *testing.T) {
 	store := NewReceiptStore()
 	id := uuid.New()
-	store.receipts[id] = ReceiptScore{Id: id, Receipt: Receipt{}, Points: 100}
+	err := store.Save(context.Background(), ReceiptScore{Id: id, Receipt: Receipt{}, Points: 100})
+	if err != nil {
+		t.Fatalf("unable to save receipt: %v", err)
+	}
 	server := NewReceiptServer(store)
 
 	t.Run("returns receipt points", func(t *testing.T) {
@@ -140,8 +144,8 @@ func TestProcessReceipt(t *testing.T) {
 		var id ID
 		err := json.NewDecoder(response.Body).Decode(&id)
 		checkDecodeErr(t, response, err)
-		savedReceipt, ok := store.receipts[id.Id]
-		if !ok {
+		savedReceipt, err := store.Get(context.Background(), id.Id)
+		if err != nil {
 			t.Errorf("receipt was not saved during POST request")
 		}
 		if savedReceipt.Id != id.Id {
@@ -418,6 +422,60 @@ func TestProcessReceipt(t *testing.T) {
 	})
 }
 
+func TestGetReceipt(t *testing.T) {
+	store := NewReceiptStore()
+	server := NewReceiptServer(store)
+	id := postReceipt(t, server, `{
+		"retailer": "Walgreens",
+		"purchaseDate": "2022-01-02",
+		"purchaseTime": "08:13",
+		"total": "3.00",
+		"items": [
+			{"shortDescription": "Pepsi - 12-oz", "price": "1.25"},
+			{"shortDescription": "Dasani", "price": "1.40"}
+		]
+	}`)
+
+	t.Run("returns the stored receipt with its points", func(t *testing.T) {
+		response := httptest.NewRecorder()
+		server.ServeHTTP(response, newGetReceiptRequest(id.Id))
+
+		assertResponseCode(t, response.Code, http.StatusOK)
+		assertContentType(t, response.Header(), "application/json")
+		var fields map[string]any
+		err := json.NewDecoder(response.Body).Decode(&fields)
+		checkDecodeErr(t, response, err)
+		for _, name := range []string{"id", "retailer", "purchaseDate", "purchaseTime", "items", "total", "points", "processedAt", "warnings"} {
+			if _, ok := fields[name]; !ok {
+				t.Errorf("expected field %q in %v", name, fields)
+			}
+		}
+		if fields["retailer"] != "Walgreens" || fields["points"] != float64(90) {
+			t.Errorf("unexpected receipt %v", fields)
+		}
+	})
+
+	t.Run("warns when items do not add up to the total", func(t *testing.T) {
+		response := httptest.NewRecorder()
+		server.ServeHTTP(response, newGetReceiptRequest(id.Id))
+
+		var details ReceiptDetails
+		err := json.NewDecoder(response.Body).Decode(&details)
+		checkDecodeErr(t, response, err)
+		if len(details.Warnings) != 1 || details.Warnings[0] != "item prices add up to 2.65 but the total is 3.00" {
+			t.Errorf("unexpected warnings %q", details.Warnings)
+		}
+	})
+
+	t.Run("request is made with id for non-existent receipt", func(t *testing.T) {
+		response := httptest.NewRecorder()
+		server.ServeHTTP(response, newGetReceiptRequest(uuid.New()))
+
+		assertResponseCode(t, response.Code, http.StatusNotFound)
+		assertResponseBody(t, response.Body.String(), notFoundMessage+"\n")
+	})
+}
+
 func newPostReceiptRequest(receipt string) *http.Request {
 	body := []byte(receipt)
 	req, _ := http.NewRequest(http.MethodPost, "/receipts/process", bytes.NewReader(body))
@@ -430,6 +488,11 @@ func newGetPointsRequest(id uuid.UUID) *http.Request {
 	return req
 }
 
+func newGetReceiptRequest(id uuid.UUID) *http.Request {
+	req, _ := http.NewRequest(http.MethodGet, "/receipts/"+id.String(), nil)
+	return req
+}
+
 func assertResponseBody(t testing.TB, body, expected string) {
 	t.Helper()
 	if body != expected {
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"slices"
+)
+
+const staffKeyHeader = "X-Staff-Key"
+
+const staffKeyRequiredMessage = "A valid staff key is required."
+const forbiddenRoleMessage = "The staff key does not grant access to this endpoint."
+
+type StaffRole string
+
+const (
+	// may export, import and reconcile receipts and edit the rewards catalog
+	RoleAdmin StaffRole = "admin"
+	// may list the receipts awaiting review and approve or reject them
+	RoleReviewer StaffRole = "reviewer"
+)
+
+var staffRoles = []StaffRole{RoleAdmin, RoleReviewer}
+
+// a person or system allowed past the staff endpoints, identified by the key
+// sent in the X-Staff-Key header
+type StaffKey struct {
+	Key   string      `json:"key"`
+	Name  string      `json:"name"`
+	Roles []StaffRole `json:"roles"`
+}
+
+type staffContextKey struct{}
+
+// returns the staff member the request was authorized as, if any
+func StaffFromContext(ctx context.Context) (StaffKey, bool) {
+	staff, ok := ctx.Value(staffContextKey{}).(StaffKey)
+	return staff, ok
+}
+
+// grants the keys access to the staff endpoints their roles allow; with none
+// configured those endpoints refuse every request
+func WithStaff(keys ...StaffKey) ServerOption {
+	return func(rs *ReceiptServer) {
+		rs.staff = make(map[string]StaffKey, len(keys))
+		for _, key := range keys {
+			rs.staff[key.Key] = key
+		}
+	}
+}
+
+// reads a JSON array of StaffKey
+func LoadStaffKeys(path string) ([]StaffKey, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var keys []StaffKey
+	if err := json.Unmarshal(data, &keys); err != nil {
+		return nil, fmt.Errorf("parsing %s: %w", path, err)
+	}
+	seen := make(map[string]bool)
+	for _, key := range keys {
+		if key.Key == "" || key.Name == "" {
+			return nil, errors.New("every staff key needs a key and a name")
+		}
+		if seen[key.Key] {
+			return nil, fmt.Errorf("staff member %q reuses a key", key.Name)
+		}
+		seen[key.Key] = true
+		for _, role := range key.Roles {
+			if !slices.Contains(staffRoles, role) {
+				return nil, fmt.Errorf("staff member %q has unknown role %q", key.Name, role)
+			}
+		}
+	}
+	return keys, nil
+}
+
+// used to put the staff member whose key a request sends on its context, so
+// that anything they do is recorded under their name
+func (rs *ReceiptServer) staffMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if staff, ok := rs.staff[r.Header.Get(staffKeyHeader)]; ok && staff.Key != "" {
+			r = r.WithContext(context.WithValue(r.Context(), staffContextKey{}, staff))
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// used to refuse requests without a staff key granting role
+func (rs *ReceiptServer) requireRole(role StaffRole, next http.HandlerFunc) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		staff, ok := StaffFromContext(r.Context())
+		if !ok {
+			http.Error(w, staffKeyRequiredMessage, http.StatusUnauthorized)
+			return
+		}
+		if !slices.Contains(staff.Roles, role) {
+			http.Error(w, forbiddenRoleMessage, http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,223 @@
+package main
+
+import (
+	"container/list"
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+var ErrReceiptNotFound = errors.New("no receipt found")
+var ErrReceiptExists = errors.New("a receipt with that ID already exists")
+
+// ReceiptStore only deals with persistence; parsing, validation and scoring
+// happen in ReceiptProcessor before a ReceiptScore ever reaches the store.
+//
+// Stores are partitioned by the tenant on the context: Save stamps that tenant
+// on the receipt, and receipts belonging to any other tenant are not found.
+type ReceiptStore interface {
+	Save(ctx context.Context, score ReceiptScore) error
+	Get(ctx context.Context, id uuid.UUID) (ReceiptScore, error)
+	Delete(ctx context.Context, id uuid.UUID) error
+	List(ctx context.Context) ([]ReceiptScore, error)
+}
+
+type InMemoryReceiptStore struct {
+	receipts map[uuid.UUID]ReceiptScore
+	mu       sync.Mutex
+	index    *receiptIndex
+
+	retention  RetentionPolicy
+	stats      RetentionStats
+	now        func() time.Time
+	order      *list.List
+	elements   map[uuid.UUID]*list.Element
+	graveyard  *list.List
+	tombstones map[uuid.UUID]*list.Element
+	stop       chan struct{}
+	done       chan struct{}
+	onEvict    []func(uuid.UUID)
+	counts     map[string]int
+}
+
+func NewReceiptStore(options ...StoreOption) *InMemoryReceiptStore {
+	receipts := make(map[uuid.UUID]ReceiptScore)
+	store := &InMemoryReceiptStore{
+		receipts:   receipts,
+		index:      newReceiptIndex(),
+		now:        time.Now,
+		order:      list.New(),
+		elements:   make(map[uuid.UUID]*list.Element),
+		graveyard:  list.New(),
+		tombstones: make(map[uuid.UUID]*list.Element),
+		counts:     make(map[string]int),
+	}
+	for _, option := range options {
+		option(store)
+	}
+	return store
+}
+
+func (i *InMemoryReceiptStore) Save(ctx context.Context, score ReceiptScore) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	score.Tenant = TenantFromContext(ctx)
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	if previous, ok := i.receipts[score.Id]; ok {
+		if previous.Tenant != score.Tenant {
+			return ErrReceiptExists
+		}
+		i.index.remove(previous)
+	} else {
+		i.counts[score.Tenant]++
+	}
+	i.receipts[score.Id] = score
+	i.index.add(score)
+	i.track(score.Id)
+	i.enforceCapacity()
+	return nil
+}
+
+// saves every receipt or, if any ID belongs to another tenant or they would not
+// all fit within the capacity, none of them, so that readers never see part of
+// the set
+func (i *InMemoryReceiptStore) SaveAll(ctx context.Context, scores []ReceiptScore) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	tenant := TenantFromContext(ctx)
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	added := 0
+	for _, score := range scores {
+		previous, ok := i.receipts[score.Id]
+		if ok && previous.Tenant != tenant {
+			return ErrReceiptExists
+		}
+		if !ok {
+			added++
+		}
+	}
+	// saving more than the capacity would evict some of these receipts before
+	// their events are recorded, so refuse rather than store part of them
+	if i.retention.MaxReceipts > 0 && added > i.retention.MaxReceipts {
+		return ErrOverCapacity
+	}
+	for _, score := range scores {
+		score.Tenant = tenant
+		if previous, ok := i.receipts[score.Id]; ok {
+			i.index.remove(previous)
+		} else {
+			i.counts[score.Tenant]++
+		}
+		i.receipts[score.Id] = score
+		i.index.add(score)
+		i.track(score.Id)
+	}
+	i.enforceCapacity()
+	return nil
+}
+
+func (i *InMemoryReceiptStore) Get(ctx context.Context, id uuid.UUID) (ReceiptScore, error) {
+	if err := ctx.Err(); err != nil {
+		return ReceiptScore{}, err
+	}
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	tenant := TenantFromContext(ctx)
+	receiptScore, ok := i.receipts[id]
+	if !ok || receiptScore.Tenant != tenant {
+		if element, gone := i.tombstones[id]; gone && element.Value.(tombstone).tenant == tenant {
+			return ReceiptScore{}, ErrReceiptExpired
+		}
+		return ReceiptScore{}, ErrReceiptNotFound
+	}
+	if i.isExpired(receiptScore, i.now()) {
+		i.expire(id)
+		return ReceiptScore{}, ErrReceiptExpired
+	}
+	i.touch(id)
+	return receiptScore, nil
+}
+
+func (i *InMemoryReceiptStore) Delete(ctx context.Context, id uuid.UUID) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	if score, ok := i.receipts[id]; !ok || score.Tenant != TenantFromContext(ctx) {
+		return ErrReceiptNotFound
+	}
+	i.remove(id)
+	return nil
+}
+
+// returns every unexpired receipt in no particular order
+func (i *InMemoryReceiptStore) List(ctx context.Context) ([]ReceiptScore, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	tenant := TenantFromContext(ctx)
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	now := i.now()
+	scores := make([]ReceiptScore, 0, i.counts[tenant])
+	for _, score := range i.receipts {
+		if score.Tenant != tenant || i.isExpired(score, now) {
+			continue
+		}
+		scores = append(scores, score)
+	}
+	return scores, nil
+}
+
+// answers retailer and purchase date queries from the secondary indexes,
+// returning matches ordered by purchase date
+func (i *InMemoryReceiptStore) Query(ctx context.Context, query ReceiptQuery) ([]ReceiptScore, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	tenant := TenantFromContext(ctx)
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	now := i.now()
+	var scores []ReceiptScore
+	for _, id := range i.index.candidates(tenant, query) {
+		score, ok := i.receipts[id]
+		if !ok || score.Tenant != tenant || i.isExpired(score, now) || !query.Matches(score) {
+			continue
+		}
+		scores = append(scores, score)
+	}
+	return scores, nil
+}
+
+// drops a receipt along with its index and eviction order entries; callers must hold i.mu
+func (i *InMemoryReceiptStore) remove(id uuid.UUID) {
+	if score, ok := i.receipts[id]; ok {
+		i.index.remove(score)
+		i.counts[score.Tenant]--
+	}
+	delete(i.receipts, id)
+	if element, ok := i.elements[id]; ok {
+		i.order.Remove(element)
+		delete(i.elements, id)
+	}
+}
+
+// returns how many receipts the context's tenant holds, including any that
+// have expired but not yet been swept
+func (i *InMemoryReceiptStore) Count(ctx context.Context) (int, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	return i.counts[TenantFromContext(ctx)], nil
+}
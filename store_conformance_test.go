@@ -0,0 +1,53 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/cwkarwisch/receipt-processor/storetest"
+	"github.com/google/uuid"
+)
+
+// StoreFactory returns a fresh, empty store. Backends that persist receipts
+// also return a reopen function that closes the store and opens it again over
+// the same data; in-memory backends return nil.
+type StoreFactory func(t *testing.T) (store ReceiptStore, reopen func() ReceiptStore)
+
+// RunReceiptStoreConformance holds a ReceiptStore implementation to the same
+// contract as InMemoryReceiptStore through the storetest suite. Every backend
+// should call it from its own test, e.g.
+// RunReceiptStoreConformance(t, newSQLStoreForTest).
+func RunReceiptStoreConformance(t *testing.T, newStore StoreFactory) {
+	storetest.Run(t, storetest.Contract[ReceiptScore]{
+		NewStore: func(t *testing.T) (storetest.Store[ReceiptScore], func() storetest.Store[ReceiptScore]) {
+			store, reopen := newStore(t)
+			if reopen == nil {
+				return store, nil
+			}
+			return store, func() storetest.Store[ReceiptScore] { return reopen() }
+		},
+		NewReceipt:  conformanceScore,
+		ID:          func(score ReceiptScore) uuid.UUID { return score.Id },
+		Tenant:      func(score ReceiptScore) string { return score.Tenant },
+		WithTenant:  WithTenant,
+		ErrNotFound: ErrReceiptNotFound,
+		ErrExists:   ErrReceiptExists,
+	})
+}
+
+func conformanceScore(id uuid.UUID, n int) ReceiptScore {
+	return ReceiptScore{
+		Id:     id,
+		Tenant: DefaultTenant,
+		Receipt: Receipt{
+			Retailer:     fmt.Sprintf("Retailer %d", n),
+			PurchaseDate: "2022-01-02",
+			PurchaseTime: "13:01",
+			Items:        []Item{{ShortDescription: "Dasani", Price: "1.40"}},
+			Total:        "1.40",
+		},
+		Points:      n,
+		ProcessedAt: time.Now().UTC().Truncate(time.Second),
+	}
+}
@@ -0,0 +1,26 @@
+package main
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestInMemoryReceiptStore(t *testing.T) {
+	RunReceiptStoreConformance(t, func(t *testing.T) (ReceiptStore, func() ReceiptStore) {
+		return NewReceiptStore(), nil
+	})
+}
+
+func assertNoError(t testing.TB, err error) {
+	t.Helper()
+	if err != nil {
+		t.Fatalf("expected no error but got %v", err)
+	}
+}
+
+func assertErrorIs(t testing.TB, got, want error) {
+	t.Helper()
+	if !errors.Is(got, want) {
+		t.Errorf("expected error %v but got %v", want, got)
+	}
+}
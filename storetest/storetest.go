@@ -0,0 +1,284 @@
+// Package storetest holds receipt store backends to the contract the
+// in-memory store follows.
+//
+// The receipt processor itself is a main package, so the suite is generic over
+// the receipt type: a backend describes how to build and inspect its receipts
+// in a Contract and hands it to Run from its own test.
+package storetest
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"sync"
+	"testing"
+
+	"github.com/google/uuid"
+)
+
+// Store is the persistence contract every receipt store implements.
+type Store[S any] interface {
+	Save(ctx context.Context, score S) error
+	Get(ctx context.Context, id uuid.UUID) (S, error)
+	Delete(ctx context.Context, id uuid.UUID) error
+	List(ctx context.Context) ([]S, error)
+}
+
+// Factory returns a fresh, empty store. Backends that persist receipts also
+// return a reopen function that closes the store and opens it again over the
+// same data; in-memory backends return nil.
+type Factory[S any] func(t *testing.T) (store Store[S], reopen func() Store[S])
+
+// Contract describes a backend and the receipts it stores.
+type Contract[S any] struct {
+	NewStore Factory[S]
+	// returns a receipt with the given ID that differs from the receipt built
+	// for any other n
+	NewReceipt func(id uuid.UUID, n int) S
+	ID         func(score S) uuid.UUID
+	// returns the tenant the store stamped on a saved receipt
+	Tenant     func(score S) string
+	WithTenant func(ctx context.Context, tenant string) context.Context
+	// the errors for an unknown ID and for an ID another tenant already holds
+	ErrNotFound error
+	ErrExists   error
+}
+
+// Run holds the backend described by c to the receipt store contract.
+func Run[S any](t *testing.T, c Contract[S]) {
+	ctx := context.Background()
+	newStore := c.NewStore
+	newReceipt := func(n int) S {
+		return c.NewReceipt(uuid.New(), n)
+	}
+
+	t.Run("get returns not found for an unknown ID", func(t *testing.T) {
+		store, _ := newStore(t)
+		_, err := store.Get(ctx, uuid.New())
+		assertErrorIs(t, err, c.ErrNotFound)
+	})
+
+	t.Run("delete returns not found for an unknown ID", func(t *testing.T) {
+		store, _ := newStore(t)
+		err := store.Delete(ctx, uuid.New())
+		assertErrorIs(t, err, c.ErrNotFound)
+	})
+
+	t.Run("get returns exactly what was saved", func(t *testing.T) {
+		store, _ := newStore(t)
+		want := newReceipt(1)
+		assertNoError(t, store.Save(ctx, want))
+
+		got, err := store.Get(ctx, c.ID(want))
+		assertNoError(t, err)
+		assertSameScore(t, got, want)
+	})
+
+	t.Run("saving an existing ID replaces it", func(t *testing.T) {
+		store, _ := newStore(t)
+		first := newReceipt(1)
+		second := c.NewReceipt(c.ID(first), 2)
+		assertNoError(t, store.Save(ctx, first))
+		assertNoError(t, store.Save(ctx, second))
+
+		got, err := store.Get(ctx, c.ID(first))
+		assertNoError(t, err)
+		assertSameScore(t, got, second)
+		scores, err := store.List(ctx)
+		assertNoError(t, err)
+		assertCount(t, len(scores), 1)
+	})
+
+	t.Run("each ID names a single receipt", func(t *testing.T) {
+		store, _ := newStore(t)
+		id := uuid.New()
+		versions := make(map[int]S)
+		for n := range 20 {
+			versions[n] = c.NewReceipt(id, n)
+		}
+		var wg sync.WaitGroup
+		for _, score := range versions {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				if err := store.Save(ctx, score); err != nil {
+					t.Errorf("save failed: %v", err)
+				}
+			}()
+		}
+		wg.Wait()
+
+		scores, err := store.List(ctx)
+		assertNoError(t, err)
+		assertCount(t, len(scores), 1)
+		got, err := store.Get(ctx, id)
+		assertNoError(t, err)
+		if !containsScore(versions, got) {
+			t.Errorf("expected one of the saved receipts but got %+v", got)
+		}
+		assertSameScore(t, got, scores[0])
+	})
+
+	t.Run("deleted receipts are not found", func(t *testing.T) {
+		store, _ := newStore(t)
+		score := newReceipt(1)
+		assertNoError(t, store.Save(ctx, score))
+		assertNoError(t, store.Delete(ctx, c.ID(score)))
+
+		_, err := store.Get(ctx, c.ID(score))
+		assertErrorIs(t, err, c.ErrNotFound)
+		assertErrorIs(t, store.Delete(ctx, c.ID(score)), c.ErrNotFound)
+	})
+
+	t.Run("list returns each receipt once", func(t *testing.T) {
+		store, _ := newStore(t)
+		want := make(map[uuid.UUID]S)
+		for n := range 5 {
+			score := newReceipt(n)
+			want[c.ID(score)] = score
+			assertNoError(t, store.Save(ctx, score))
+		}
+
+		scores, err := store.List(ctx)
+		assertNoError(t, err)
+		assertCount(t, len(scores), len(want))
+		for _, score := range scores {
+			assertSameScore(t, score, want[c.ID(score)])
+			delete(want, c.ID(score))
+		}
+	})
+
+	t.Run("concurrent writes and reads keep every receipt", func(t *testing.T) {
+		store, _ := newStore(t)
+		var wg sync.WaitGroup
+		ids := make([]uuid.UUID, 50)
+		for n := range ids {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				score := newReceipt(n)
+				ids[n] = c.ID(score)
+				if err := store.Save(ctx, score); err != nil {
+					t.Errorf("save failed: %v", err)
+					return
+				}
+				got, err := store.Get(ctx, c.ID(score))
+				if err != nil {
+					t.Errorf("get failed: %v", err)
+					return
+				}
+				assertSameScore(t, got, score)
+				if _, err := store.List(ctx); err != nil {
+					t.Errorf("list failed: %v", err)
+				}
+			}()
+		}
+		wg.Wait()
+
+		scores, err := store.List(ctx)
+		assertNoError(t, err)
+		assertCount(t, len(scores), len(ids))
+	})
+
+	t.Run("methods fail with a cancelled context", func(t *testing.T) {
+		store, _ := newStore(t)
+		cancelled, cancel := context.WithCancel(ctx)
+		cancel()
+		score := newReceipt(1)
+
+		assertErrorIs(t, store.Save(cancelled, score), context.Canceled)
+		_, err := store.Get(cancelled, c.ID(score))
+		assertErrorIs(t, err, context.Canceled)
+		assertErrorIs(t, store.Delete(cancelled, c.ID(score)), context.Canceled)
+		_, err = store.List(cancelled)
+		assertErrorIs(t, err, context.Canceled)
+	})
+
+	t.Run("receipts are isolated between tenants", func(t *testing.T) {
+		store, _ := newStore(t)
+		tenantA := c.WithTenant(ctx, "tenant-a")
+		tenantB := c.WithTenant(ctx, "tenant-b")
+		score := newReceipt(1)
+		assertNoError(t, store.Save(tenantA, score))
+
+		got, err := store.Get(tenantA, c.ID(score))
+		assertNoError(t, err)
+		if tenant := c.Tenant(got); tenant != "tenant-a" {
+			t.Errorf("expected the receipt to belong to tenant-a but got %q", tenant)
+		}
+		_, err = store.Get(tenantB, c.ID(score))
+		assertErrorIs(t, err, c.ErrNotFound)
+		assertErrorIs(t, store.Delete(tenantB, c.ID(score)), c.ErrNotFound)
+		scores, err := store.List(tenantB)
+		assertNoError(t, err)
+		assertCount(t, len(scores), 0)
+	})
+
+	t.Run("an ID held by one tenant cannot be taken by another", func(t *testing.T) {
+		store, _ := newStore(t)
+		tenantA := c.WithTenant(ctx, "tenant-a")
+		tenantB := c.WithTenant(ctx, "tenant-b")
+		original := newReceipt(1)
+		assertNoError(t, store.Save(tenantA, original))
+		want, err := store.Get(tenantA, c.ID(original))
+		assertNoError(t, err)
+
+		assertErrorIs(t, store.Save(tenantB, c.NewReceipt(c.ID(original), 2)), c.ErrExists)
+		got, err := store.Get(tenantA, c.ID(original))
+		assertNoError(t, err)
+		assertSameScore(t, got, want)
+		_, err = store.Get(tenantB, c.ID(original))
+		assertErrorIs(t, err, c.ErrNotFound)
+	})
+
+	t.Run("receipts survive reopening the store", func(t *testing.T) {
+		store, reopen := newStore(t)
+		if reopen == nil {
+			t.Skip("store does not persist receipts")
+		}
+		score := newReceipt(1)
+		assertNoError(t, store.Save(ctx, score))
+
+		reopened := reopen()
+		got, err := reopened.Get(ctx, c.ID(score))
+		assertNoError(t, err)
+		assertSameScore(t, got, score)
+	})
+}
+
+func containsScore[S any](scores map[int]S, score S) bool {
+	for _, candidate := range scores {
+		if reflect.DeepEqual(candidate, score) {
+			return true
+		}
+	}
+	return false
+}
+
+func assertSameScore[S any](t testing.TB, got, want S) {
+	t.Helper()
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("expected receipt %+v but got %+v", want, got)
+	}
+}
+
+func assertCount(t testing.TB, got, want int) {
+	t.Helper()
+	if got != want {
+		t.Errorf("expected %d receipts but got %d", want, got)
+	}
+}
+
+func assertNoError(t testing.TB, err error) {
+	t.Helper()
+	if err != nil {
+		t.Fatalf("expected no error but got %v", err)
+	}
+}
+
+func assertErrorIs(t testing.TB, got, want error) {
+	t.Helper()
+	if !errors.Is(got, want) {
+		t.Errorf("expected error %v but got %v", want, got)
+	}
+}
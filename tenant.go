@@ -0,0 +1,148 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+)
+
+const tenantHeader = "X-Tenant-ID"
+const apiKeyHeader = "X-API-Key"
+const tenantPathPrefix = "/tenants/"
+const DefaultTenant = "default"
+
+const unknownTenantMessage = "Unknown tenant."
+const unauthorizedMessage = "Invalid API key."
+const apiKeyRequiredMessage = "That tenant requires an API key."
+const tenantMismatchMessage = "The API key does not belong to that tenant."
+const quotaExceededMessage = "This tenant has reached its receipt quota."
+
+var ErrQuotaExceeded = errors.New("tenant receipt quota exceeded")
+
+type tenantContextKey struct{}
+
+type TenantConfig struct {
+	ID      string       `json:"id"`
+	APIKeys []string     `json:"apiKeys,omitempty"`
+	Rules   ScoringRules `json:"rules"`
+	// 0 means no limit on how many receipts the tenant may store
+	MaxReceipts int `json:"maxReceipts,omitempty"`
+}
+
+// used to resolve the tenant of each request and look up its configuration.
+// With no tenants configured any tenant ID is accepted with the default
+// rules and no quota; otherwise only configured tenants are.
+type TenantRegistry struct {
+	tenants  map[string]TenantConfig
+	byAPIKey map[string]string
+}
+
+func NewTenantRegistry(configs ...TenantConfig) (*TenantRegistry, error) {
+	registry := &TenantRegistry{
+		tenants:  make(map[string]TenantConfig),
+		byAPIKey: make(map[string]string),
+	}
+	for _, config := range configs {
+		if config.ID == "" || strings.Contains(config.ID, "/") {
+			return nil, fmt.Errorf("invalid tenant ID %q", config.ID)
+		}
+		if _, ok := registry.tenants[config.ID]; ok {
+			return nil, fmt.Errorf("tenant %q is configured twice", config.ID)
+		}
+		if err := config.Rules.Validate(); err != nil {
+			return nil, fmt.Errorf("tenant %q: %w", config.ID, err)
+		}
+		for _, key := range config.APIKeys {
+			if _, ok := registry.byAPIKey[key]; ok {
+				return nil, fmt.Errorf("tenant %q reuses an API key", config.ID)
+			}
+			registry.byAPIKey[key] = config.ID
+		}
+		registry.tenants[config.ID] = config
+	}
+	return registry, nil
+}
+
+// reads a JSON array of TenantConfig
+func LoadTenantRegistry(path string) (*TenantRegistry, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var configs []TenantConfig
+	if err := json.Unmarshal(data, &configs); err != nil {
+		return nil, fmt.Errorf("parsing %s: %w", path, err)
+	}
+	return NewTenantRegistry(configs...)
+}
+
+func (t *TenantRegistry) Config(id string) (TenantConfig, bool) {
+	if config, ok := t.tenants[id]; ok {
+		return config, true
+	}
+	if id == DefaultTenant || len(t.tenants) == 0 {
+		return TenantConfig{ID: id}, true
+	}
+	return TenantConfig{}, false
+}
+
+// used to resolve the tenant from an API key, a /tenants/{id} path prefix or
+// the X-Tenant-ID header, in that order of precedence, and put it on the
+// request context; requests naming no tenant belong to DefaultTenant, and
+// those naming a tenant with API keys must send one of them
+func (t *TenantRegistry) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		named := r.Header.Get(tenantHeader)
+		if rest, ok := strings.CutPrefix(r.URL.Path, tenantPathPrefix); ok {
+			tenant, path, _ := strings.Cut(rest, "/")
+			named = tenant
+			r = r.Clone(r.Context())
+			r.URL.Path = "/" + path
+			r.URL.RawPath = ""
+		}
+
+		tenant := named
+		if key := r.Header.Get(apiKeyHeader); key != "" {
+			owner, ok := t.byAPIKey[key]
+			if !ok {
+				http.Error(w, unauthorizedMessage, http.StatusUnauthorized)
+				return
+			}
+			if named != "" && named != owner {
+				http.Error(w, tenantMismatchMessage, http.StatusForbidden)
+				return
+			}
+			tenant = owner
+		}
+		if tenant == "" {
+			tenant = DefaultTenant
+		}
+		config, ok := t.Config(tenant)
+		if !ok {
+			http.Error(w, unknownTenantMessage, http.StatusNotFound)
+			return
+		}
+		if len(config.APIKeys) > 0 && r.Header.Get(apiKeyHeader) == "" {
+			http.Error(w, apiKeyRequiredMessage, http.StatusUnauthorized)
+			return
+		}
+
+		next.ServeHTTP(w, r.WithContext(WithTenant(r.Context(), tenant)))
+	})
+}
+
+func WithTenant(ctx context.Context, tenant string) context.Context {
+	return context.WithValue(ctx, tenantContextKey{}, tenant)
+}
+
+// returns DefaultTenant when ctx carries no tenant
+func TenantFromContext(ctx context.Context) string {
+	if tenant, ok := ctx.Value(tenantContextKey{}).(string); ok {
+		return tenant
+	}
+	return DefaultTenant
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/google/uuid"
+)
+
+func TestTenantIsolation(t *testing.T) {
+	tenants, err := NewTenantRegistry(
+		TenantConfig{ID: "acme", APIKeys: []string{"acme-key"}},
+		TenantConfig{ID: "globex", MaxReceipts: 1, Rules: ScoringRules{Weights: map[string]float64{"retailerName": 0}}},
+	)
+	assertNoError(t, err)
+	server := NewReceiptServer(NewReceiptStore(), WithTenants(tenants))
+	acme := postAPIKeyReceipt(t, server, "acme-key", walgreensReceipt)
+
+	t.Run("a receipt ID from one tenant is not found for another", func(t *testing.T) {
+		for _, path := range []string{"/points", "/history"} {
+			request := httptest.NewRequest(http.MethodGet, "/receipts/"+acme.Id.String()+path, nil)
+			request.Header.Set(tenantHeader, "globex")
+			response := httptest.NewRecorder()
+			server.ServeHTTP(response, request)
+
+			assertResponseCode(t, response.Code, http.StatusNotFound)
+		}
+	})
+
+	t.Run("resolves the tenant from a path prefix", func(t *testing.T) {
+		request := httptest.NewRequest(http.MethodGet, "/tenants/acme/receipts/"+acme.Id.String()+"/points", nil)
+		request.Header.Set(apiKeyHeader, "acme-key")
+		response := httptest.NewRecorder()
+		server.ServeHTTP(response, request)
+
+		assertResponseCode(t, response.Code, http.StatusOK)
+		assertPointTotalInResponse(t, response, 15)
+	})
+
+	t.Run("resolves the tenant from an API key", func(t *testing.T) {
+		request := newGetPointsRequest(acme.Id)
+		request.Header.Set(apiKeyHeader, "acme-key")
+		response := httptest.NewRecorder()
+		server.ServeHTTP(response, request)
+
+		assertResponseCode(t, response.Code, http.StatusOK)
+	})
+
+	t.Run("rejects naming a tenant with API keys without one", func(t *testing.T) {
+		prefixed := httptest.NewRequest(http.MethodGet, "/tenants/acme/receipts/"+acme.Id.String()+"/points", nil)
+		named := newGetPointsRequest(acme.Id)
+		named.Header.Set(tenantHeader, "acme")
+		submission := newPostReceiptRequest(cornerMarketReceipt)
+		submission.Header.Set(tenantHeader, "acme")
+		for _, request := range []*http.Request{prefixed, named, submission} {
+			response := httptest.NewRecorder()
+			server.ServeHTTP(response, request)
+
+			assertResponseCode(t, response.Code, http.StatusUnauthorized)
+			assertResponseBody(t, response.Body.String(), apiKeyRequiredMessage+"\n")
+		}
+	})
+
+	t.Run("rejects an unknown API key", func(t *testing.T) {
+		request := newGetPointsRequest(acme.Id)
+		request.Header.Set(apiKeyHeader, "nope")
+		response := httptest.NewRecorder()
+		server.ServeHTTP(response, request)
+
+		assertResponseCode(t, response.Code, http.StatusUnauthorized)
+	})
+
+	t.Run("rejects an API key used for another tenant", func(t *testing.T) {
+		request := newGetPointsRequest(acme.Id)
+		request.Header.Set(apiKeyHeader, "acme-key")
+		request.Header.Set(tenantHeader, "globex")
+		response := httptest.NewRecorder()
+		server.ServeHTTP(response, request)
+
+		assertResponseCode(t, response.Code, http.StatusForbidden)
+	})
+
+	t.Run("rejects an unknown tenant", func(t *testing.T) {
+		request := newGetPointsRequest(uuid.New())
+		request.Header.Set(tenantHeader, "initech")
+		response := httptest.NewRecorder()
+		server.ServeHTTP(response, request)
+
+		assertResponseCode(t, response.Code, http.StatusNotFound)
+		assertResponseBody(t, response.Body.String(), unknownTenantMessage+"\n")
+	})
+
+	t.Run("scores with the tenant's own rules", func(t *testing.T) {
+		globex := postTenantReceipt(t, server, "globex", walgreensReceipt)
+
+		request := newGetPointsRequest(globex.Id)
+		request.Header.Set(tenantHeader, "globex")
+		response := httptest.NewRecorder()
+		server.ServeHTTP(response, request)
+
+		assertPointTotalInResponse(t, response, 6)
+	})
+
+	t.Run("enforces the tenant's quota", func(t *testing.T) {
+		request := newPostReceiptRequest(cornerMarketReceipt)
+		request.Header.Set(tenantHeader, "globex")
+		response := httptest.NewRecorder()
+		server.ServeHTTP(response, request)
+
+		assertResponseCode(t, response.Code, http.StatusForbidden)
+		assertResponseBody(t, response.Body.String(), quotaExceededMessage+"\n")
+	})
+}
+
+func TestTenantRegistry(t *testing.T) {
+	t.Run("rejects unknown scoring rules", func(t *testing.T) {
+		_, err := NewTenantRegistry(TenantConfig{ID: "acme", Rules: ScoringRules{Weights: map[string]float64{"nope": 1}}})
+		if err == nil {
+			t.Errorf("expected an error for an unknown scoring rule")
+		}
+	})
+
+	t.Run("accepts any tenant when none are configured", func(t *testing.T) {
+		tenants, err := NewTenantRegistry()
+		assertNoError(t, err)
+		if _, ok := tenants.Config("anyone"); !ok {
+			t.Errorf("expected an unconfigured registry to accept any tenant")
+		}
+	})
+}
+
+const cornerMarketReceipt = `{
+	"retailer": "M&M Corner Market",
+	"purchaseDate": "2022-03-20",
+	"purchaseTime": "14:33",
+	"items": [
+		{"shortDescription": "Gatorade", "price": "2.25"},
+		{"shortDescription": "Gatorade", "price": "2.25"},
+		{"shortDescription": "Gatorade", "price": "2.25"},
+		{"shortDescription": "Gatorade", "price": "2.25"}
+	],
+	"total": "9.00"
+}`
+
+func postAPIKeyReceipt(t testing.TB, server http.Handler, key, body string) ID {
+	t.Helper()
+	request := newPostReceiptRequest(body)
+	request.Header.Set(apiKeyHeader, key)
+	response := httptest.NewRecorder()
+	server.ServeHTTP(response, request)
+	assertResponseCode(t, response.Code, http.StatusOK)
+	return decodeID(t, response)
+}
+
+func postTenantReceipt(t testing.TB, server http.Handler, tenant, body string) ID {
+	t.Helper()
+	request := newPostReceiptRequest(body)
+	request.Header.Set(tenantHeader, tenant)
+	response := httptest.NewRecorder()
+	server.ServeHTTP(response, request)
+	assertResponseCode(t, response.Code, http.StatusOK)
+	return decodeID(t, response)
+}
@@ -0,0 +1,274 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"os"
+	"slices"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+type Tier struct {
+	Name string `json:"name"`
+	// the points a member must have earned within the policy's window
+	MinPoints  int     `json:"minPoints"`
+	Multiplier float64 `json:"multiplier"`
+}
+
+// a member's tier is the highest whose MinPoints they have earned within the
+// window; with no tiers every member scores at the standard rate
+type TierPolicy struct {
+	Window time.Duration
+	Tiers  []Tier
+}
+
+func DefaultTierPolicy() TierPolicy {
+	return TierPolicy{
+		Window: 365 * 24 * time.Hour,
+		Tiers: []Tier{
+			{Name: "bronze", MinPoints: 0, Multiplier: 1},
+			{Name: "silver", MinPoints: 500, Multiplier: 1.25},
+			{Name: "gold", MinPoints: 2000, Multiplier: 1.5},
+		},
+	}
+}
+
+// reads a policy like {"windowDays": 365, "tiers": [{"name": "bronze", "minPoints": 0, "multiplier": 1}]}
+func LoadTierPolicy(path string) (TierPolicy, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return TierPolicy{}, err
+	}
+	var file struct {
+		WindowDays int    `json:"windowDays"`
+		Tiers      []Tier `json:"tiers"`
+	}
+	if err := json.Unmarshal(data, &file); err != nil {
+		return TierPolicy{}, fmt.Errorf("parsing %s: %w", path, err)
+	}
+	policy := TierPolicy{Window: time.Duration(file.WindowDays) * 24 * time.Hour, Tiers: file.Tiers}
+	if err := policy.Validate(); err != nil {
+		return TierPolicy{}, fmt.Errorf("%s: %w", path, err)
+	}
+	return policy, nil
+}
+
+func WithTiers(policy TierPolicy) MemberOption {
+	return func(m *MemberRegistry) {
+		m.tiers = policy
+	}
+}
+
+func (p TierPolicy) Validate() error {
+	for i, tier := range p.Tiers {
+		if tier.Name == "" {
+			return fmt.Errorf("tier %d has no name", i)
+		}
+		if tier.Multiplier < 0 {
+			return fmt.Errorf("tier %q has a negative multiplier", tier.Name)
+		}
+		if i > 0 && tier.MinPoints <= p.Tiers[i-1].MinPoints {
+			return fmt.Errorf("tier %q must need more points than tier %q", tier.Name, p.Tiers[i-1].Name)
+		}
+	}
+	if len(p.Tiers) > 0 && p.Window <= 0 {
+		return fmt.Errorf("the tier window must be positive")
+	}
+	return nil
+}
+
+func (p TierPolicy) tierFor(points int) Tier {
+	tier := Tier{Multiplier: 1}
+	for _, candidate := range p.Tiers {
+		if points >= candidate.MinPoints {
+			tier = candidate
+		}
+	}
+	return tier
+}
+
+func (t Tier) apply(points int) int {
+	return int(math.Round(float64(points) * t.Multiplier))
+}
+
+// used to encode the response to GET /members/{id}/tiers
+type TierChange struct {
+	Tier          string    `json:"tier"`
+	EffectiveFrom time.Time `json:"effectiveFrom"`
+	// the points earned within the window that put the member in the tier
+	RollingPoints int `json:"rollingPoints"`
+}
+
+type earning struct {
+	at     time.Time
+	points int
+}
+
+// the earnings still within a member's tier window, oldest first, and the
+// points they add up to
+type tierWindow struct {
+	entries []windowEntry
+	points  int
+}
+
+type windowEntry struct {
+	at time.Time
+	id uuid.UUID
+}
+
+// records every tier change up to now, including those from points leaving
+// the window since the last change, by moving the window along rather than
+// adding up the member's history again; callers must hold m.mu
+func (m *MemberRegistry) refreshTier(key string) {
+	history := m.tierHistory[key]
+	if len(history) == 0 {
+		return
+	}
+	now := m.now()
+	window := m.windows[key]
+	for len(window.entries) > 0 {
+		leaves := window.entries[0].at.Add(m.tiers.Window)
+		if leaves.After(now) {
+			break
+		}
+		for len(window.entries) > 0 && !window.entries[0].at.Add(m.tiers.Window).After(leaves) {
+			entry := window.entries[0]
+			window.entries = window.entries[1:]
+			// skip receipts forgotten or earned again since
+			if earning, ok := m.earnings[key][entry.id]; ok && earning.at.Equal(entry.at) {
+				window.points -= earning.points
+			}
+		}
+		if leaves.Before(now) {
+			history = m.changeTier(history, leaves, window.points)
+		}
+	}
+	m.tierHistory[key] = m.changeTier(history, now, window.points)
+}
+
+func (m *MemberRegistry) changeTier(history []TierChange, at time.Time, rolling int) []TierChange {
+	if tier := m.tiers.tierFor(rolling); tier.Name != history[len(history)-1].Tier {
+		history = append(history, TierChange{Tier: tier.Name, EffectiveFrom: at, RollingPoints: rolling})
+	}
+	return history
+}
+
+// returns the tier with the given name, the lowest tier if there is none
+func (p TierPolicy) named(name string) Tier {
+	for _, tier := range p.Tiers {
+		if tier.Name == name {
+			return tier
+		}
+	}
+	return p.tierFor(0)
+}
+
+// returns the member's tier as of now, the lowest tier if they have earned
+// nothing yet
+func (m *MemberRegistry) CurrentTier(ctx context.Context, memberID string) Tier {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	key := memberKey(TenantFromContext(ctx), memberID)
+	m.refreshTier(key)
+	history := m.tierHistory[key]
+	if len(history) == 0 {
+		return m.tiers.tierFor(0)
+	}
+	return m.tiers.named(history[len(history)-1].Tier)
+}
+
+func (m *MemberRegistry) TierHistory(ctx context.Context, memberID string) ([]TierChange, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	key := memberKey(TenantFromContext(ctx), memberID)
+	if _, ok := m.members[key]; !ok {
+		return nil, ErrMemberNotFound
+	}
+	m.refreshTier(key)
+	return slices.Clone(m.tierHistory[key]), nil
+}
+
+// records what a receipt earned towards its member's tier; callers must hold
+// m.mu
+func (m *MemberRegistry) recordEarning(key string, id uuid.UUID, points int) {
+	if _, ok := m.earnings[key]; !ok {
+		m.earnings[key] = make(map[uuid.UUID]earning)
+		m.tierHistory[key] = []TierChange{{Tier: m.tiers.tierFor(0).Name, EffectiveFrom: m.now()}}
+		m.windows[key] = &tierWindow{}
+	}
+	m.refreshTier(key)
+	window := m.windows[key]
+	if previous, ok := m.earnings[key][id]; ok {
+		// a rescored receipt keeps the time it first earned at
+		if m.inWindow(previous) {
+			window.points += points - previous.points
+		}
+		m.earnings[key][id] = earning{at: previous.at, points: points}
+	} else {
+		entry := windowEntry{at: m.now(), id: id}
+		i, _ := slices.BinarySearchFunc(window.entries, entry.at, func(e windowEntry, at time.Time) int {
+			return e.at.Compare(at)
+		})
+		window.entries = slices.Insert(window.entries, i, entry)
+		window.points += points
+		m.earnings[key][id] = earning{at: entry.at, points: points}
+	}
+	m.refreshTier(key)
+}
+
+// callers must hold m.mu
+func (m *MemberRegistry) forgetEarning(key string, id uuid.UUID) {
+	m.refreshTier(key)
+	if earning, ok := m.earnings[key][id]; ok && m.inWindow(earning) {
+		m.windows[key].points -= earning.points
+	}
+	delete(m.earnings[key], id)
+	m.refreshTier(key)
+}
+
+// reports whether an earning still counts towards its member's tier; callers
+// must hold m.mu
+func (m *MemberRegistry) inWindow(earning earning) bool {
+	return earning.at.Add(m.tiers.Window).After(m.now())
+}
+
+// multiplies a new receipt's points by its member's tier as of now; every
+// receipt's tier is judged when it is first scored
+func (rs *ReceiptServer) applyTier(ctx context.Context, score *ReceiptScore) {
+	if score.MemberID == "" {
+		return
+	}
+	tier := rs.members.CurrentTier(ctx, score.MemberID)
+	score.Tier = tier.Name
+	score.Points = tier.apply(score.Points)
+}
+
+// multiplies a rescored receipt's points by the tier it was first scored with,
+// so that corrections and refunds judge it at the same moment its submission
+// did
+func (rs *ReceiptServer) reapplyTier(score *ReceiptScore, tier string) {
+	if score.MemberID == "" {
+		return
+	}
+	applied := rs.members.tiers.named(tier)
+	score.Tier = applied.Name
+	score.Points = applied.apply(score.Points)
+}
+
+func (rs *ReceiptServer) getMemberTiers(w http.ResponseWriter, r *http.Request) {
+	history, err := rs.members.TierHistory(r.Context(), r.PathValue("id"))
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", jsonContentType)
+	if err := json.NewEncoder(w).Encode(history); err != nil {
+		log.Println(err)
+	}
+}
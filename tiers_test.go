@@ -0,0 +1,85 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestTiers(t *testing.T) {
+	clock := &fakeClock{current: time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC)}
+	members := NewMemberRegistry(
+		WithMemberClock(clock.now),
+		WithTiers(TierPolicy{
+			Window: 30 * 24 * time.Hour,
+			Tiers: []Tier{
+				{Name: "bronze", MinPoints: 0, Multiplier: 1},
+				{Name: "silver", MinPoints: 100, Multiplier: 2},
+			},
+		}),
+	)
+	server := NewReceiptServer(NewReceiptStore(), WithMembers(members))
+
+	corner := postMemberReceipt(t, server, "alice", cornerMarketReceipt)
+	walgreens := postMemberReceipt(t, server, "alice", walgreensReceipt)
+
+	t.Run("applies the multiplier of the tier at scoring time", func(t *testing.T) {
+		assertReceiptPoints(t, server, corner, 109)
+		assertReceiptPoints(t, server, walgreens, 30)
+		if member := getMember(t, server, "alice"); member.Tier != "silver" {
+			t.Errorf("expected a silver member but got %q", member.Tier)
+		}
+	})
+
+	t.Run("drops a tier once points leave the window", func(t *testing.T) {
+		clock.current = time.Date(2022, 3, 1, 0, 0, 0, 0, time.UTC)
+
+		var history []TierChange
+		getJSON(t, server, "/members/alice/tiers", &history)
+		last := history[len(history)-1]
+		if last.Tier != "bronze" || !last.EffectiveFrom.Equal(time.Date(2022, 1, 31, 0, 0, 0, 0, time.UTC)) {
+			t.Errorf("expected bronze from 2022-01-31 but got %+v", history)
+		}
+	})
+
+	t.Run("rescores with the tier the receipt was first scored at", func(t *testing.T) {
+		response := sendCorrection(server, http.MethodPatch, walgreens.Id, "", `{"retailer": "Walgreens Pharmacy"}`)
+		assertResponseCode(t, response.Code, http.StatusOK)
+
+		details := decodeDetails(t, response)
+		if details.Points != 46 || details.Tier != "silver" {
+			t.Errorf("expected 46 points at silver but got %d at %q", details.Points, details.Tier)
+		}
+	})
+
+	t.Run("keeps a receipt's tier when it is corrected after being bought before it was scored", func(t *testing.T) {
+		clock := &fakeClock{current: time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)}
+		members := NewMemberRegistry(WithMemberClock(clock.now), WithTiers(TierPolicy{
+			Window: 30 * 24 * time.Hour,
+			Tiers:  []Tier{{Name: "bronze", MinPoints: 0, Multiplier: 1}, {Name: "silver", MinPoints: 100, Multiplier: 2}},
+		}))
+		server := NewReceiptServer(NewReceiptStore(), WithMembers(members))
+		postMemberReceipt(t, server, "bob", cornerMarketReceipt)
+		walgreens := postMemberReceipt(t, server, "bob", walgreensReceipt)
+		assertReceiptPoints(t, server, walgreens, 30)
+
+		response := sendCorrection(server, http.MethodPatch, walgreens.Id, "", `{}`)
+		assertResponseCode(t, response.Code, http.StatusOK)
+		assertReceiptPoints(t, server, walgreens, 30)
+	})
+
+	t.Run("rejects tiers out of order", func(t *testing.T) {
+		policy := TierPolicy{Window: time.Hour, Tiers: []Tier{{Name: "gold", MinPoints: 10}, {Name: "silver", MinPoints: 5}}}
+		if policy.Validate() == nil {
+			t.Errorf("expected an error for tiers out of order")
+		}
+	})
+}
+
+func assertReceiptPoints(t testing.TB, server http.Handler, id ID, want int) {
+	t.Helper()
+	response := httptest.NewRecorder()
+	server.ServeHTTP(response, newGetPointsRequest(id.Id))
+	assertPointTotalInResponse(t, response, want)
+}